@@ -1,5 +1,6 @@
 #!/bin/bash
 
 openssl genrsa -out ca.key 2048
+chmod 600 ca.key
 
-openssl req -new -x509 -days 3650 -key ca.key -out ca.crt
\ No newline at end of file
+openssl req -new -x509 -days 3650 -key ca.key -out ca.crt -subj "/C=UA/L=Kyiv/O=Trust/OU=ca/CN=Trust Root CA" -addext "basicConstraints=critical,CA:TRUE,pathlen:1" -addext "keyUsage=critical,keyCertSign,cRLSign" -addext "nameConstraints=critical,permitted;DNS:trust"
@@ -1,13 +1,19 @@
 #!/bin/bash
 
 read -p "Certificate name: " cert_name
-read -p "IP address: " ip
+read -p "Role (node/client): " role
 
 openssl genrsa -out $cert_name.key 2048
+chmod 600 $cert_name.key
 
-openssl req -new -key $cert_name.key -out $cert_name.csr
+openssl req -new -key $cert_name.key -out $cert_name.csr -subj "/C=UA/L=Kyiv/O=Trust/OU=$role/CN=$cert_name"
 
-echo -e "[v3_req]\nsubjectAltName=IP:$ip" > $cert_name.ext
+if [ "$role" == "node" ]; then
+	read -p "IP address: " ip
+	echo -e "[v3_req]\nsubjectAltName=IP:$ip,DNS:$cert_name.nodes.trust\nextendedKeyUsage=serverAuth,clientAuth\nkeyUsage=digitalSignature,keyEncipherment" > $cert_name.ext
+else
+	echo -e "[v3_req]\nsubjectAltName=DNS:$cert_name.clients.trust\nextendedKeyUsage=clientAuth\nkeyUsage=digitalSignature,keyEncipherment" > $cert_name.ext
+fi
 
 openssl x509 -req -days 3650 -in $cert_name.csr -CA ca.crt -CAkey ca.key -CAcreateserial -out $cert_name.crt -extensions v3_req -extfile $cert_name.ext
 
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/app"
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/flags"
+	"github.com/jenyaftw/trust/internal/pkg/transparency"
+)
+
+func checkReceipt(path string, file string, ca string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var receipt transparency.Receipt
+	if err := json.Unmarshal(content, &receipt); err != nil {
+		log.Fatal(err)
+	}
+	if receipt.Head == nil {
+		log.Fatal("receipt has no signed log head")
+	}
+
+	caPem, err := crypto.LoadSecret(ca)
+	if err != nil {
+		log.Fatal(err)
+	}
+	roots, err := crypto.NewCertPool(caPem)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if file != "" {
+		hash, err := transparency.HashFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !bytes.Equal(hash, receipt.Hash) {
+			fmt.Printf("FAIL %s does not match the hash in the receipt\n", file)
+			os.Exit(1)
+		}
+	}
+
+	if err := receipt.Verify(roots); err != nil {
+		fmt.Println("FAIL", err)
+		os.Exit(1)
+	}
+	fmt.Printf("OK   entry %d of log %d, recorded %s, log size %d\n", receipt.Index, receipt.Head.LogID, receipt.Timestamp.Format(time.RFC3339), receipt.Head.Size)
+}
+
+func parseIDs(list string) []uint64 {
+	var ids []uint64
+	for _, id := range strings.Split(list, ",") {
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(id), 10, 64)
+		if err != nil {
+			log.Fatal("invalid ID: ", id)
+		}
+		ids = append(ids, n)
+	}
+	return ids
+}
+
+func main() {
+	logs := flag.String("logs", "", "Comma separated IDs of the transparency log nodes to audit")
+	auditors := flag.String("auditors", "", "Comma separated client IDs of other auditors to exchange log heads with")
+	interval := flag.Duration("interval", 30*time.Second, "Interval between log head checks")
+	receipt := flag.String("receipt", "", "Check a saved inclusion receipt offline instead of auditing")
+	file := flag.String("file", "", "File whose hash must match the receipt")
+	flags := flags.ParseClientFlags()
+
+	if *receipt != "" {
+		checkReceipt(*receipt, *file, flags.Ca)
+		return
+	}
+
+	logNodes := parseIDs(*logs)
+	if len(logNodes) == 0 {
+		log.Fatal("no log nodes to audit, set -logs")
+	}
+	peers := parseIDs(*auditors)
+
+	client, err := app.NewTrustClient(flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := client.Connect(flags.BufferSize); err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	go func() {
+		for event := range client.Events() {
+			if event.Type == app.EventSplitView {
+				fmt.Printf("ALERT auditor %d saw another view: %v\n", event.Peer, event.Err)
+				os.Exit(1)
+			}
+		}
+	}()
+
+	for {
+		for _, node := range logNodes {
+			head, err := client.AuditLog(node)
+			switch {
+			case errors.Is(err, transparency.ErrSplitView):
+				fmt.Printf("ALERT log %d: %v\n", node, err)
+				os.Exit(1)
+			case err != nil:
+				fmt.Printf("WARN log %d: %v\n", node, err)
+			default:
+				fmt.Printf("OK   log %d: %d entries, root %x, signed %s\n", node, head.Size, head.Root, head.Timestamp.Format(time.RFC3339))
+			}
+		}
+		for _, peer := range peers {
+			if err := client.GossipLogHeads(peer); err != nil {
+				fmt.Printf("WARN auditor %d: %v\n", peer, err)
+			}
+		}
+		time.Sleep(*interval)
+	}
+}
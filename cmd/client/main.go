@@ -3,42 +3,59 @@ package main
 import (
 	"bufio"
 	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jenyaftw/trust/internal/app"
+	"github.com/jenyaftw/trust/internal/pkg/capability"
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
 	"github.com/jenyaftw/trust/internal/pkg/flags"
-	"github.com/jenyaftw/trust/internal/pkg/structs"
+	"github.com/jenyaftw/trust/internal/pkg/logging"
+	"github.com/jenyaftw/trust/internal/pkg/transparency"
 )
 
 func main() {
 	flags := flags.ParseClientFlags()
 
+	if err := logging.Setup(os.Stderr, flags.LogLevel, flags.LogFormat); err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	client, err := app.NewTrustClient(flags)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Creating client", "err", err)
 		return
 	}
 
 	err = client.Connect(flags.BufferSize)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Connecting", "err", err)
 		return
 	}
 
 	fmt.Println("Connected to server")
+	go func() {
+		for event := range client.Events() {
+			slog.Info("Stream event", "event", event)
+		}
+	}()
+
 	for {
-		fmt.Print("Select message type (1 - text, 2 - benchmark, 3 - receive text): ")
+		fmt.Print("Select message type (1 - text, 2 - benchmark, 3 - receive text, 4 - notarize file, 5 - publish file, 6 - fetch file, 7 - share file, 8 - revoke share, 9 - block sender, 10 - unblock sender): ")
 		var msg int
 		_, err := fmt.Scanf("%d\n", &msg)
 		if err != nil {
-			log.Println(err)
+			slog.Error("Reading message type", "err", err)
 			return
 		}
 
-		if msg != 1 && msg != 2 && msg != 3 {
+		if msg < 1 || msg > 10 {
 			fmt.Println("Invalid message type")
 			continue
 		}
@@ -48,9 +65,15 @@ func main() {
 			fmt.Print("Enter destination ID: ")
 			_, err = fmt.Scanf("%d\n", &dest)
 			if err != nil {
-				log.Println(err)
+				slog.Error("Reading destination", "err", err)
 				return
 			}
+			if flags.OnionHops > 0 {
+				if err := pinDestination(client, dest); err != nil {
+					slog.Error("Pinning destination certificate", "err", err)
+					return
+				}
+			}
 		}
 
 		switch msg {
@@ -61,7 +84,7 @@ func main() {
 
 			err = client.Send([]byte(text), dest)
 			if err != nil {
-				log.Println(err)
+				slog.Error("Sending message", "err", err)
 				return
 			}
 		case 2:
@@ -69,7 +92,7 @@ func main() {
 			var recv uint64
 			_, err = fmt.Scanf("%d\n", &recv)
 			if err != nil {
-				log.Println(err)
+				slog.Error("Reading benchmark mode", "err", err)
 				return
 			}
 
@@ -78,21 +101,27 @@ func main() {
 				fmt.Print("Enter destination ID: ")
 				_, err = fmt.Scanf("%d\n", &dest)
 				if err != nil {
-					log.Println(err)
+					slog.Error("Reading destination", "err", err)
 					return
 				}
+				if flags.OnionHops > 0 {
+					if err := pinDestination(client, dest); err != nil {
+						slog.Error("Pinning destination certificate", "err", err)
+						return
+					}
+				}
 
 				bytes := make([]byte, flags.BufferSize-256)
 				_, err := rand.Read(bytes)
 				if err != nil {
-					log.Println(err)
+					slog.Error("Generating benchmark data", "err", err)
 					return
 				}
 
 				for {
 					err = client.Send(bytes, dest)
 					if err != nil {
-						log.Println("rip", err)
+						slog.Error("Sending benchmark data", "err", err)
 						return
 					}
 				}
@@ -104,19 +133,19 @@ func main() {
 				fileName := fmt.Sprintf("received_%d.csv", time.Now().Unix())
 				file, err := os.Create(fileName)
 				if err != nil {
-					log.Println(err)
+					slog.Error("Creating benchmark file", "err", err)
 					return
 				}
 				defer file.Close()
 
 				for {
-					data := <-read
-					bytesReceived += len(data)
+					received := <-read
+					bytesReceived += len(received.Payload)
 					if time.Now().UnixMilli()-start > 1000 {
 						fmt.Printf("%d Bytes per second\n", bytesReceived)
 						_, err := file.WriteString(fmt.Sprintf("%d\n", bytesReceived))
 						if err != nil {
-							log.Println(err)
+							slog.Error("Writing benchmark file", "err", err)
 							return
 						}
 						start = time.Now().UnixMilli()
@@ -125,16 +154,243 @@ func main() {
 				}
 			}
 		case 3:
-			read := client.Read()
+			fmt.Print("Enter sender ID (0 for any): ")
+			var sender uint64
+			_, err = fmt.Scanf("%d\n", &sender)
+			if err != nil {
+				slog.Error("Reading sender", "err", err)
+				return
+			}
+
+			var senders []uint64
+			if sender != 0 {
+				senders = append(senders, sender)
+			}
+
+			read := client.Read(senders...)
 			for {
-				data := <-read
-				block, err := structs.DecodeBlock(data)
-				if err != nil {
-					log.Println(err)
+				received := <-read
+				fmt.Printf("[%s] %s (%d, %s): %s\n", received.Time.Format(time.TimeOnly), received.Subject, received.From, received.Status, strings.TrimRight(string(received.Payload), "\n"))
+			}
+		case 4:
+			fmt.Print("Enter log node ID: ")
+			var logNode uint64
+			_, err = fmt.Scanf("%d\n", &logNode)
+			if err != nil {
+				slog.Error("Reading log node", "err", err)
+				return
+			}
+
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print("Enter file path: ")
+			path, _ := reader.ReadString('\n')
+			path = strings.TrimSpace(path)
+
+			hash, err := transparency.HashFile(path)
+			if err != nil {
+				slog.Error("Hashing file", "err", err)
+				continue
+			}
+
+			receipt, err := client.SubmitHash(logNode, hash)
+			if err != nil {
+				slog.Error("Submitting hash", "err", err)
+				continue
+			}
+
+			content, err := json.MarshalIndent(receipt, "", "  ")
+			if err != nil {
+				slog.Error("Encoding receipt", "err", err)
+				continue
+			}
+			if err := os.WriteFile(path+".receipt.json", content, 0644); err != nil {
+				slog.Error("Saving receipt", "err", err)
+				continue
+			}
+			fmt.Printf("Entry %d of log %d at %s, receipt saved to %s.receipt.json\n", receipt.Index, logNode, receipt.Timestamp.Format(time.RFC3339), path)
+		case 5:
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print("Enter file path: ")
+			path, _ := reader.ReadString('\n')
+
+			data, err := os.ReadFile(strings.TrimSpace(path))
+			if err != nil {
+				slog.Error("Reading file", "err", err)
+				continue
+			}
+
+			fmt.Print("Public = 0, private = 1: ")
+			var private int
+			if _, err := fmt.Scanf("%d\n", &private); err != nil {
+				slog.Error("Reading visibility", "err", err)
+				continue
+			}
+
+			var hash []byte
+			if private == 1 {
+				hash, err = client.PublishPrivate(data)
+			} else {
+				hash, err = client.Publish(data)
+			}
+			if err != nil {
+				slog.Error("Publishing file", "err", err)
+				continue
+			}
+			fmt.Printf("Published %d bytes, content hash %x\n", len(data), hash)
+		case 6:
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print("Enter content hash: ")
+			line, _ := reader.ReadString('\n')
+			hash, err := hex.DecodeString(strings.TrimSpace(line))
+			if err != nil {
+				slog.Error("Decoding content hash", "err", err)
+				continue
+			}
+
+			fmt.Print("Enter capability token path (empty for none): ")
+			tokenPath, _ := reader.ReadString('\n')
+			token, err := readToken(strings.TrimSpace(tokenPath))
+			if err != nil {
+				slog.Error("Reading token", "err", err)
+				continue
+			}
+
+			fmt.Print("Enter output path: ")
+			path, _ := reader.ReadString('\n')
+
+			data, err := client.FetchShared(hash, token)
+			if err != nil {
+				slog.Error("Fetching file", "err", err)
+				continue
+			}
+			if err := os.WriteFile(strings.TrimSpace(path), data, 0644); err != nil {
+				slog.Error("Saving file", "err", err)
+				continue
+			}
+			fmt.Printf("Fetched %d bytes\n", len(data))
+		case 7:
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print("Enter content hash (empty to reshare a token): ")
+			line, _ := reader.ReadString('\n')
+			hash, err := hex.DecodeString(strings.TrimSpace(line))
+			if err != nil {
+				slog.Error("Decoding content hash", "err", err)
+				continue
+			}
+
+			var parent *capability.Token
+			if len(hash) == 0 {
+				fmt.Print("Enter capability token path: ")
+				tokenPath, _ := reader.ReadString('\n')
+				parent, err = readToken(strings.TrimSpace(tokenPath))
+				if err != nil || parent == nil {
+					slog.Error("A content hash or a token to reshare is required", "err", err)
 					continue
 				}
-				fmt.Println(string(block.Data))
 			}
+
+			fmt.Print("Enter holder name: ")
+			holder, _ := reader.ReadString('\n')
+			holder = strings.TrimSpace(holder)
+
+			fmt.Print("Enter validity (e.g. 24h): ")
+			line, _ = reader.ReadString('\n')
+			validFor, err := time.ParseDuration(strings.TrimSpace(line))
+			if err != nil {
+				slog.Error("Parsing validity", "err", err)
+				continue
+			}
+
+			fmt.Print("Fetch only = 0, fetch and forward = 1: ")
+			var forward int
+			if _, err := fmt.Scanf("%d\n", &forward); err != nil {
+				slog.Error("Reading rights", "err", err)
+				continue
+			}
+			rights := capability.Fetch
+			if forward == 1 {
+				rights |= capability.Forward
+			}
+
+			token, err := client.Share(hash, holder, rights, validFor, parent)
+			if err != nil {
+				slog.Error("Sharing file", "err", err)
+				continue
+			}
+
+			content, err := token.Encode()
+			if err != nil {
+				slog.Error("Encoding token", "err", err)
+				continue
+			}
+			path := fmt.Sprintf("%s-%x.cap.json", holder, token.ID[:4])
+			if err := os.WriteFile(path, content, 0600); err != nil {
+				slog.Error("Saving token", "err", err)
+				continue
+			}
+			fmt.Printf("Granted %s %s until %s, token saved to %s\n", holder, token.Rights, token.NotAfter.Format(time.RFC3339), path)
+		case 8:
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print("Enter capability token path: ")
+			tokenPath, _ := reader.ReadString('\n')
+			token, err := readToken(strings.TrimSpace(tokenPath))
+			if err != nil || token == nil {
+				slog.Error("Reading token", "err", err)
+				continue
+			}
+
+			if err := client.RevokeCapability(token); err != nil {
+				slog.Error("Revoking token", "err", err)
+				continue
+			}
+			fmt.Printf("Revoked token %x\n", token.ID)
+		case 9, 10:
+			fmt.Println("Blocked senders:", client.Blocklist())
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print("Enter sender name: ")
+			name, _ := reader.ReadString('\n')
+			name = strings.TrimSpace(name)
+
+			if msg == 9 {
+				err = client.Block(name)
+			} else {
+				err = client.Unblock(name)
+			}
+			if err != nil {
+				slog.Error("Updating blocklist", "err", err)
+				continue
+			}
+			fmt.Println("Blocked senders:", client.Blocklist())
 		}
 	}
 }
+
+func readToken(path string) (*capability.Token, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return capability.Decode(content)
+}
+
+func pinDestination(client *app.TrustClient, dest uint64) error {
+	fmt.Print("Enter destination certificate (path, env:<var>): ")
+	var source string
+	if _, err := fmt.Scanf("%s\n", &source); err != nil {
+		return err
+	}
+
+	certPem, err := crypto.LoadSecret(source)
+	if err != nil {
+		return err
+	}
+	cert, err := crypto.DecodeCertificate(certPem)
+	if err != nil {
+		return err
+	}
+	return client.PinPeer(dest, cert)
+}
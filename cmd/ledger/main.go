@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/ledger"
+)
+
+func usage() {
+	fmt.Println("Usage: ledger <verify|export|prove|check> [flags] <ledger dir>...")
+	os.Exit(2)
+}
+
+func peerDirs(dirs []string) []string {
+	result := make([]string, 0)
+	for _, dir := range dirs {
+		segments, err := ledger.Segments(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(segments) > 0 {
+			result = append(result, dir)
+			continue
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				result = append(result, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return result
+}
+
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+	}
+
+	failed := false
+	for _, dir := range peerDirs(fs.Args()) {
+		streams, err := ledger.Verify(dir)
+		if err != nil {
+			fmt.Println("FAIL", dir, err)
+			failed = true
+			continue
+		}
+
+		for _, stream := range streams {
+			head := stream.Head()
+			fmt.Printf("OK   %s %s session %d: %d blocks, root %x\n", dir, stream.Direction, stream.Session, head.Size, head.Root)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func export(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	cert := fs.String("cert", "", "Signer certificate source (path, file:<path>, env:<var> or stdin)")
+	key := fs.String("key", "", "Signer key source (path, file:<path>, env:<var>, stdin or exec:<command>)")
+	fs.Parse(args)
+	if fs.NArg() == 0 || *cert == "" || *key == "" {
+		usage()
+	}
+
+	pair, err := crypto.LoadKeyPair(*cert, *key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, dir := range peerDirs(fs.Args()) {
+		streams, err := ledger.Verify(dir)
+		if err != nil {
+			log.Fatal(dir, ": ", err)
+		}
+
+		for _, stream := range streams {
+			head := stream.Head()
+			head.Peer = filepath.Base(dir)
+			if err := head.Sign(pair.Certificate, pair.PrivateKey); err != nil {
+				log.Fatal(err)
+			}
+			if err := enc.Encode(head); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+func prove(args []string) {
+	fs := flag.NewFlagSet("prove", flag.ExitOnError)
+	direction := fs.String("direction", ledger.Sent, "Stream direction (sent or received)")
+	session := fs.Uint64("session", 1, "Session number")
+	block := fs.Int("block", 1, "Block ID to prove")
+	entry := fs.Int("entry", -1, "Entry of the block to prove without revealing the others (-1 proves the whole block)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	streams, err := ledger.Verify(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, stream := range streams {
+		if stream.Direction != *direction || stream.Session != *session {
+			continue
+		}
+
+		var evidence *ledger.Evidence
+		if *entry < 0 {
+			evidence, err = stream.Prove(*block)
+		} else {
+			evidence, err = stream.ProveEntry(*block, *entry)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(evidence); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	log.Fatalf("no %s stream with session %d in %s", *direction, *session, fs.Arg(0))
+}
+
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	ca := fs.String("ca", "certs/ca.crt", "CA certificate source (path, file:<path>, env:<var> or stdin)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	caPem, err := crypto.LoadSecret(*ca)
+	if err != nil {
+		log.Fatal(err)
+	}
+	roots, err := crypto.NewCertPool(caPem)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	content, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	evidence := &ledger.Evidence{}
+	if err := json.Unmarshal(content, evidence); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := evidence.Check(roots); err != nil {
+		fmt.Println("FAIL", err)
+		os.Exit(1)
+	}
+	if evidence.EntryProof != nil {
+		fmt.Printf("OK   entry %d of %d belongs to block %d\n", evidence.EntryProof.Index, evidence.EntryProof.Count, evidence.Block.ID)
+	}
+	fmt.Printf("OK   block %d is in the %s stream of %s (tree size %d, signed %s)\n", evidence.Block.ID, evidence.Head.Direction, evidence.Head.Signer, evidence.Head.Size, evidence.Head.Timestamp.Format(time.RFC3339))
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "verify":
+		verify(os.Args[2:])
+	case "export":
+		export(os.Args[2:])
+	case "prove":
+		prove(os.Args[2:])
+	case "check":
+		check(os.Args[2:])
+	default:
+		usage()
+	}
+}
@@ -1,138 +1,390 @@
 package main
 
 import (
-	"crypto/rsa"
+	"bytes"
+	gocrypto "crypto"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/jenyaftw/trust/internal/app"
 	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/logging"
+	"github.com/jenyaftw/trust/internal/pkg/pki"
 	"github.com/jenyaftw/trust/internal/pkg/structs"
 )
 
-var RSAKeySize = 4096
+var KeyAlgorithm = crypto.ECDSAP256
 var MinPort = 8700
 var NodeCount = 16
 var Timeout = 5000
 
+var LogDir = "logs"
+var LogLevel = "info"
+var LogFormat = "text"
+
+var logger = slog.Default()
+
+var CACertFile = "certs/ca.crt"
+
 var errors = 0
 
-func createAndSaveCertificate(id int, caCert *x509.Certificate, caKey *rsa.PrivateKey) error {
-	key, err := crypto.GenerateRSAKey(RSAKeySize)
+func fatal(msg string, err error) {
+	logger.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+func loadCertificate(certPath string) *x509.Certificate {
+	content, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil
+	}
+
+	cert, err := crypto.DecodeCertificate(content)
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+func loadClientKey(keyPath string) gocrypto.Signer {
+	content, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil
+	}
+
+	key, err := crypto.DecodePrivateKey(content)
+	if err != nil {
+		logger.Warn("Replacing unreadable client key", "path", keyPath, "err", err)
+		return nil
+	}
+	return key
+}
+
+func matchesKey(cert *x509.Certificate, key gocrypto.Signer) bool {
+	publicKey, ok := cert.PublicKey.(interface{ Equal(gocrypto.PublicKey) bool })
+	return ok && publicKey.Equal(key.Public())
+}
+
+func hasValidCertificate(cert *x509.Certificate, key gocrypto.Signer, store *pki.Store, revocations *crypto.RevocationStore) bool {
+	if cert == nil || key == nil || !matchesKey(cert, key) {
+		return false
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(store.RootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(store.Issuer.Cert)
+
+	if time.Now().After(crypto.RenewalTime(cert)) {
+		return false
+	}
+	return crypto.VerifyCertificate(cert, crypto.RoleClient, roots, intermediates, revocations) == nil
+}
+
+func createAndSaveCertificate(id int, store *pki.Store, revocations *crypto.RevocationStore) error {
+	certPath := fmt.Sprintf("certs/client_%d.crt", id)
+	keyPath := fmt.Sprintf("certs/client_%d.key", id)
+
+	cert, key := loadCertificate(certPath), loadClientKey(keyPath)
+	if hasValidCertificate(cert, key, store, revocations) {
+		return nil
+	}
+
+	// Renewal keeps the client's key so its identity survives restarts. A
+	// revoked certificate may mean the key leaked, so that gets a new one.
+	if key != nil && cert != nil && revocations.IsRevoked(cert) {
+		logger.Warn("Client certificate was revoked, generating a new key", "client", id)
+		key = nil
+	}
+	if key == nil {
+		var err error
+		if key, err = crypto.GenerateKey(KeyAlgorithm); err != nil {
+			return err
+		}
+		keyEnc, err := crypto.EncodePrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyPath, keyEnc, 0600); err != nil {
+			return err
+		}
+	}
+
+	serial, err := crypto.GenerateSerialNumber()
 	if err != nil {
 		return err
 	}
-	keyEnc := crypto.EncodeRSAKey(key)
 
-	cert := crypto.GenerateCertificate(int64(id), 127, 0, 0, 1)
-	certEnc, err := crypto.EncodeCertificate(cert, caCert, key, caKey)
+	template := crypto.GenerateClientCertificate(serial, fmt.Sprintf("client-%d", id))
+	certEnc, err := store.Issuer.Issue(template, key.Public())
 	if err != nil {
 		return err
 	}
+	return os.WriteFile(certPath, certEnc, 0644)
+}
 
-	ioutil.WriteFile(fmt.Sprintf("certs/client_%d.key", id), keyEnc, 0644)
-	ioutil.WriteFile(fmt.Sprintf("certs/client_%d.crt", id), certEnc, 0644)
-	return nil
+func peerAddress(node *structs.NetworkNode) string {
+	return fmt.Sprintf("%s@%s:%d", crypto.NodeServerName(node.ID), node.IP, node.Port)
 }
 
-func launchNode(id int, serial int, first *structs.TreeNode, second *structs.TreeNode, caCert *x509.Certificate, caKey *rsa.PrivateKey, caCertStr string, timeout int, debug bool, bufferSize int) {
+func launchNode(id int, first *structs.TreeNode, second *structs.TreeNode, store *pki.Store, issuerAddr string, timeout int, debug bool, bufferSize int) {
 	node := structs.Nodes[id]
 	node.Status = 1
 
-	key, err := crypto.GenerateRSAKey(RSAKeySize)
+	key, err := crypto.GenerateKey(KeyAlgorithm)
 	if err != nil {
-		log.Fatal(err)
-		return
+		fatal("Generating node key", err)
+	}
+	keyEnc, err := crypto.EncodePrivateKey(key)
+	if err != nil {
+		fatal("Encoding node key", err)
 	}
-	keyEnc := crypto.EncodeRSAKey(key)
-	keyStr := base64.StdEncoding.EncodeToString(keyEnc)
 
-	cert := crypto.GenerateCertificate(int64(serial), 127, 0, 0, 1)
+	serial, err := crypto.GenerateSerialNumber()
+	if err != nil {
+		fatal("Generating serial number", err)
+	}
+
+	cert := crypto.GenerateNodeCertificate(serial, id, net.ParseIP(node.IP))
 	node.Cert = cert
 
-	certEnc, err := crypto.EncodeCertificate(cert, caCert, key, caKey)
+	certEnc, err := store.Issuer.Issue(cert, key.Public())
 	if err != nil {
-		log.Fatal(err)
-		return
+		fatal("Issuing node certificate", err)
 	}
-	certStr := base64.StdEncoding.EncodeToString(certEnc)
 
 	peers := make([]string, 0)
 	firstNode := first.FindNode(id)
 	if firstNode.Left != nil {
-		peers = append(peers, fmt.Sprintf("%s:%d", firstNode.Left.Node.IP, firstNode.Left.Node.Port))
+		peers = append(peers, peerAddress(firstNode.Left.Node))
 	}
 	if firstNode.Right != nil {
-		peers = append(peers, fmt.Sprintf("%s:%d", firstNode.Right.Node.IP, firstNode.Right.Node.Port))
+		peers = append(peers, peerAddress(firstNode.Right.Node))
 	}
 
 	secondNode := second.FindNode(id)
 	if secondNode.Left != nil {
-		peers = append(peers, fmt.Sprintf("%s:%d", secondNode.Left.Node.IP, secondNode.Left.Node.Port))
+		peers = append(peers, peerAddress(secondNode.Left.Node))
 	}
 	if secondNode.Right != nil {
-		peers = append(peers, fmt.Sprintf("%s:%d", secondNode.Right.Node.IP, secondNode.Right.Node.Port))
+		peers = append(peers, peerAddress(secondNode.Right.Node))
 	}
 
 	peersString := strings.Join(peers, ",")
 
 	node.Status = 2
-	cmd := exec.Command("go", "run", "cmd/server/main.go", "-cert", certStr, "-key", keyStr, "-ca", caCertStr, "-port", fmt.Sprint(node.Port), "-host", node.IP, "-peers", peersString, "-id", fmt.Sprint(id), "-timeout", fmt.Sprint(timeout), "-buffer", fmt.Sprint(bufferSize), "-nodes", fmt.Sprint(len(structs.Nodes)))
+	cmd := exec.Command("go", "run", "cmd/server/main.go", "-cert", "stdin", "-key", "stdin", "-ca", filepath.Join(store.Dir, pki.RootCertFile), "-crl", store.RevocationListPath(), "-issuer", issuerAddr, "-port", fmt.Sprint(node.Port), "-host", node.IP, "-peers", peersString, "-id", fmt.Sprint(id), "-timeout", fmt.Sprint(timeout), "-buffer", fmt.Sprint(bufferSize), "-nodes", fmt.Sprint(len(structs.Nodes)), "-log-level", LogLevel, "-log-format", LogFormat)
 
+	cmd.Stdin = bytes.NewReader(append(certEnc, keyEnc...))
+
+	logFile, err := os.OpenFile(filepath.Join(LogDir, fmt.Sprintf("node-%d.log", id)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fatal("Opening node log", err)
+	}
+
+	var output io.Writer = logFile
 	if debug {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		output = io.MultiWriter(os.Stderr, logFile)
 	}
+	cmd.Stdout = output
+	cmd.Stderr = output
 
-	if err := cmd.Run(); err != nil {
+	err = cmd.Run()
+	logFile.Close()
+	if err != nil {
+		logger.Warn("Node exited, restarting", "node", id, "err", err)
 		node.Status = 0
 		errors += 1
-		launchNode(id, serial, first, second, caCert, caKey, caCertStr, timeout, debug, bufferSize)
+		launchNode(id, first, second, store, issuerAddr, timeout, debug, bufferSize)
 	}
 }
 
-func startNodes(minPort int, first *structs.TreeNode, second *structs.TreeNode, timeout int, debug bool, bufferSize int) {
-	caKey, err := crypto.GenerateRSAKey(RSAKeySize)
+func issueServiceCertificate(name string, ip net.IP, issuer *crypto.Issuer) (*tls.Certificate, error) {
+	key, err := crypto.GenerateKey(KeyAlgorithm)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, err
+	}
+
+	certEnc, err := issuer.Issue(crypto.GenerateServiceCertificate(nil, name, ip), key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	keyEnc, err := crypto.EncodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certEnc, keyEnc)
+	if err != nil {
+		return nil, err
 	}
 
-	caCert := crypto.GenerateCACertificate()
-	caCertEnc, err := crypto.EncodeCertificate(caCert, caCert, caKey, caKey)
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+func startIssuer(addr string, store *pki.Store, revocations *crypto.RevocationStore) error {
+	issuer := store.Issuer
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	cert, err := issueServiceCertificate("issuer", net.ParseIP(host), issuer)
+	if err != nil {
+		return err
+	}
+
+	var certMutex sync.Mutex
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certMutex.Lock()
+		defer certMutex.Unlock()
+
+		if time.Now().After(crypto.RenewalTime(cert.Leaf)) {
+			renewed, err := issueServiceCertificate("issuer", net.ParseIP(host), issuer)
+			if err != nil {
+				return nil, err
+			}
+			cert = renewed
+		}
+		return cert, nil
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(store.RootCert)
+
+	config := crypto.DefaultTLSProfile.Config()
+	config.GetCertificate = getCertificate
+	config.ClientCAs = roots
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.VerifyConnection = revocations.VerifyConnection
+
+	go app.ListenIssuer(addr, config, issuer)
+	return nil
+}
+
+func refreshRevocationList(store *pki.Store, node string) {
+	refreshed, err := store.RefreshRevocationList()
+	if err != nil {
+		logger.Warn("Refreshing revocation list", "err", err)
+		return
+	}
+	if !refreshed {
 		return
 	}
-	caCertStr := base64.StdEncoding.EncodeToString(caCertEnc)
 
-	createAndSaveCertificate(1, caCert, caKey)
-	createAndSaveCertificate(2, caCert, caKey)
+	logger.Info("Revocation list re-signed")
+	if node == "" {
+		return
+	}
 
-	serial := minPort
-	for i := 0; i < len(structs.Nodes); i++ {
-		go launchNode(i, serial, first, second, caCert, caKey, caCertStr, timeout, debug, bufferSize)
+	crl, err := store.RevocationList()
+	if err == nil {
+		err = publishRevocationList(crl, node, store)
+	}
+	if err != nil {
+		logger.Warn("Publishing revocation list", "node", node, "err", err)
+	}
+}
+
+func startNodes(store *pki.Store, issuerPort int, first *structs.TreeNode, second *structs.TreeNode, timeout int, debug bool, bufferSize int) {
+	ioutil.WriteFile(CACertFile, store.RootCertPem, 0644)
+
+	revocations := crypto.NewRevocationStore(store.RootCert)
+	refreshRevocationList(store, "")
+	go func() {
+		for {
+			refreshRevocationList(store, fmt.Sprintf("%s:%d", structs.Nodes[0].IP, structs.Nodes[0].Port))
+			if crl, err := store.RevocationList(); err == nil {
+				revocations.Update(crl)
+			}
+			time.Sleep(10 * time.Second)
+		}
+	}()
 
-		serial++
+	issuerAddr := fmt.Sprintf("127.0.0.1:%d", issuerPort)
+	if err := startIssuer(issuerAddr, store, revocations); err != nil {
+		fatal("Starting issuer", err)
+	}
+
+	if crl, err := store.RevocationList(); err == nil {
+		revocations.Update(crl)
+	}
+	for id := 1; id <= 2; id++ {
+		if err := createAndSaveCertificate(id, store, revocations); err != nil {
+			fatal("Issuing client certificate", err)
+		}
+	}
+
+	for i := 0; i < len(structs.Nodes); i++ {
+		go launchNode(i, first, second, store, issuerAddr, timeout, debug, bufferSize)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "pki" {
+		pkiCommand(os.Args[2:])
+		return
+	}
+
 	nodes := flag.Int("n", NodeCount, "Кількість вузлів")
 	minPort := flag.Int("p", MinPort, "Мінімальний порт")
 	timeout := flag.Int("t", Timeout, "Таймаут для під'єднання вузлів (у мс)")
 	debug := flag.Bool("d", false, "Режим дебагу")
 	bufferSize := flag.Int("b", 64*1024, "Розмір буфера")
+	issuerPort := flag.Int("i", MinPort-1, "Порт сервісу видачі сертифікатів")
+	pkiDir := flag.String("pki", PKIDir, "Каталог CA")
+	keyAlgorithm := flag.String("k", string(KeyAlgorithm), "Алгоритм ключів (rsa2048, rsa4096, ecdsa-p256, ecdsa-p384, ed25519)")
+	logLevel := flag.String("l", LogLevel, "Рівень журналювання (trace, debug, info, warn, error)")
+	logFormat := flag.String("f", LogFormat, "Формат журналу (text, json)")
+	logDir := flag.String("logs", LogDir, "Каталог журналів вузлів")
 	flag.Parse()
 
+	alg, err := crypto.ParseKeyAlgorithm(*keyAlgorithm)
+	if err != nil {
+		fatal("Parsing key algorithm", err)
+	}
+	KeyAlgorithm = alg
+
+	store := openOrInitStore(*pkiDir)
+
+	LogLevel, LogFormat, LogDir = *logLevel, *logFormat, *logDir
+	if err := os.MkdirAll(LogDir, 0755); err != nil {
+		fatal("Creating log directory", err)
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if !*debug {
+		logFile, err := os.OpenFile(filepath.Join(LogDir, "orchestrator.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatal("Opening orchestrator log", err)
+		}
+		defer logFile.Close()
+		logOutput = logFile
+	}
+	if err := logging.Setup(logOutput, LogLevel, LogFormat); err != nil {
+		fatal("Setting up logging", err)
+	}
+	logger = slog.With("component", "orchestrator")
+
 	for i := 0; i < *nodes; i++ {
 		structs.Nodes = append(structs.Nodes, &structs.NetworkNode{
 			ID:     i,
@@ -148,13 +400,10 @@ func main() {
 	firstTree.FillDeBruijn(*nodes-1, 0)
 	secondTree.FillDeBruijn(*nodes-1, 0)
 
-	go startNodes(*minPort, &firstTree, &secondTree, *timeout, *debug, *bufferSize)
+	go startNodes(store, *issuerPort, &firstTree, &secondTree, *timeout, *debug, *bufferSize)
 
 	if *debug {
-		for {
-		}
-	} else {
-		log.SetOutput(io.Discard)
+		select {}
 	}
 
 	for {
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/pki"
+)
+
+var PKIDir = "pki"
+
+func readPassphrase() []byte {
+	if passphrase := os.Getenv("TRUST_CA_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase)
+	}
+
+	fmt.Print("Пароль ключа CA: ")
+	info, err := os.Stdin.Stat()
+	hidden := err == nil && info.Mode()&os.ModeCharDevice != 0 && stty("-echo") == nil
+
+	reader := bufio.NewReader(os.Stdin)
+	line, err := reader.ReadString('\n')
+	if hidden {
+		stty("echo")
+		fmt.Println()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
+
+func stty(mode string) error {
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+func openStore(dir string) *pki.Store {
+	if !pki.Exists(dir) {
+		log.Fatalf("CA не ініціалізовано в %s, виконайте: orchestrator pki init", dir)
+	}
+
+	store, err := pki.Open(dir, readPassphrase())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return store
+}
+
+func openOrInitStore(dir string) *pki.Store {
+	if pki.Exists(dir) {
+		return openStore(dir)
+	}
+
+	store, err := pki.Init(dir, readPassphrase(), KeyAlgorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return store
+}
+
+func pkiCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Використання: orchestrator pki <init|issue|list|revoke|export> [прапорці]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "init":
+		pkiInit(args[1:])
+	case "issue":
+		pkiIssue(args[1:])
+	case "list":
+		pkiList(args[1:])
+	case "revoke":
+		pkiRevoke(args[1:])
+	case "export":
+		pkiExport(args[1:])
+	default:
+		log.Fatal("невідома команда: ", args[0])
+	}
+}
+
+func pkiInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := fs.String("dir", PKIDir, "Каталог CA")
+	keyAlgorithm := fs.String("k", string(KeyAlgorithm), "Алгоритм ключів CA")
+	fs.Parse(args)
+
+	alg, err := crypto.ParseKeyAlgorithm(*keyAlgorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := pki.Init(*dir, readPassphrase(), alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("CA ініціалізовано в", store.Dir)
+}
+
+func pkiIssue(args []string) {
+	fs := flag.NewFlagSet("issue", flag.ExitOnError)
+	dir := fs.String("dir", PKIDir, "Каталог CA")
+	csrPath := fs.String("csr", "", "Файл запиту на сертифікат (PEM)")
+	role := fs.String("role", "client", "Роль сертифіката (node/client)")
+	name := fs.String("name", "", "Ім'я власника сертифіката")
+	ip := fs.String("ip", "127.0.0.1", "IP-адреса вузла")
+	out := fs.String("out", "", "Файл для збереження сертифіката")
+	fs.Parse(args)
+
+	if *csrPath == "" || *name == "" {
+		log.Fatal("потрібні прапорці -csr та -name")
+	}
+
+	csrContent, err := os.ReadFile(*csrPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	block, _ := pem.Decode(csrContent)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		log.Fatal("файл не містить запиту на сертифікат: ", *csrPath)
+	}
+
+	var template *x509.Certificate
+	switch *role {
+	case "node":
+		template = crypto.GenerateServiceCertificate(nil, *name, net.ParseIP(*ip))
+	case "client":
+		template = crypto.GenerateClientCertificate(nil, *name)
+	default:
+		log.Fatal("невідома роль: ", *role)
+	}
+
+	store := openStore(*dir)
+	certPem, err := store.Issuer.IssueFromRequest(template, block.Bytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(certPem)
+		return
+	}
+	if err := os.WriteFile(*out, certPem, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func pkiList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dir := fs.String("dir", PKIDir, "Каталог CA")
+	fs.Parse(args)
+
+	store := openStore(*dir)
+	entries, err := store.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		status := "дійсний"
+		if entry.Revoked {
+			status = "відкликаний"
+		} else if time.Now().After(entry.NotAfter) {
+			status = "прострочений"
+		}
+		fmt.Printf("%-40s %-7s %-20s %s %s\n", entry.Serial, entry.Role, entry.Subject, entry.NotAfter.Format(time.RFC3339), status)
+	}
+}
+
+func pkiRevoke(args []string) {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	dir := fs.String("dir", PKIDir, "Каталог CA")
+	serialStr := fs.String("serial", "", "Серійний номер сертифіката")
+	node := fs.String("node", fmt.Sprintf("127.0.0.1:%d", MinPort), "Вузол для публікації списку відкликання (порожньо - не публікувати)")
+	fs.Parse(args)
+
+	serial, ok := new(big.Int).SetString(*serialStr, 10)
+	if !ok {
+		log.Fatal("некоректний серійний номер: ", *serialStr)
+	}
+
+	store := openStore(*dir)
+	crl, err := store.Revoke(serial)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Сертифікат %s відкликано\n", serial)
+
+	if *node == "" {
+		return
+	}
+
+	if err := publishRevocationList(crl, *node, store); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Список відкликання опубліковано через", *node)
+}
+
+func pkiExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := fs.String("dir", PKIDir, "Каталог CA")
+	out := fs.String("out", "", "Файл для збереження пакета (CA, проміжний CA, список відкликання)")
+	fs.Parse(args)
+
+	store := openStore(*dir)
+	bundle, err := store.Bundle()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(bundle)
+		return
+	}
+	if err := os.WriteFile(*out, bundle, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func publishRevocationList(crl []byte, node string, store *pki.Store) error {
+	key, err := crypto.GenerateKey(crypto.ECDSAP256)
+	if err != nil {
+		return err
+	}
+
+	// Issued by the intermediate like every other certificate, so it shows up
+	// in the inventory and the root key only signs the intermediate and CRLs.
+	cert := crypto.GenerateClientCertificate(nil, "orchestrator")
+	certEnc, err := store.Issuer.Issue(cert, key.Public())
+	if err != nil {
+		return err
+	}
+
+	keyEnc, err := crypto.EncodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	tlsCert, err := tls.X509KeyPair(certEnc, keyEnc)
+	if err != nil {
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(store.RootCert)
+
+	config := crypto.DefaultTLSProfile.Config()
+	config.Certificates = []tls.Certificate{tlsCert}
+	config.RootCAs = roots
+
+	conn, err := tls.Dial("tcp", node, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg := &message.Message{
+		Type:    message.REVOCATION_LIST,
+		Content: crl,
+	}
+	return msg.Send(conn)
+}
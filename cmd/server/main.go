@@ -2,11 +2,13 @@ package main
 
 import (
 	"crypto/tls"
-	"log"
+	"log/slog"
+	"os"
 
 	"github.com/jenyaftw/trust/internal/app"
 	"github.com/jenyaftw/trust/internal/pkg/crypto"
 	"github.com/jenyaftw/trust/internal/pkg/flags"
+	"github.com/jenyaftw/trust/internal/pkg/logging"
 )
 
 var Clients = make(map[string]*tls.Conn)
@@ -15,11 +17,66 @@ var Peers = make(map[string]*tls.Conn)
 func main() {
 	flags := flags.ParseServerFlags()
 
-	config, err := crypto.GetTLSConfig(flags.Cert, flags.Key, &flags.Ca)
+	if err := logging.Setup(os.Stderr, flags.LogLevel, flags.LogFormat); err != nil {
+		slog.Error("Setting up logging", "err", err)
+		return
+	}
+	logger := slog.With("component", "server", "node", flags.NodeId)
+
+	caPem, err := crypto.LoadSecret(flags.Ca)
+	if err != nil {
+		logger.Error("Loading CA certificate", "err", err)
+		return
+	}
+
+	caCert, err := crypto.DecodeCertificate(caPem)
+	if err != nil {
+		logger.Error("Decoding CA certificate", "err", err)
+		return
+	}
+
+	revocations := crypto.NewRevocationStore(caCert)
+	if flags.Crl != "" {
+		crl, err := crypto.ReadRevocationListFile(flags.Crl)
+		if err != nil {
+			logger.Error("Reading revocation list", "err", err)
+			return
+		}
+
+		if _, err := revocations.Update(crl); err != nil {
+			logger.Error("Loading revocation list", "err", err)
+			return
+		}
+	}
+
+	cert, err := crypto.LoadKeyPair(flags.Cert, flags.Key)
+	if err != nil {
+		logger.Error("Loading key pair", "err", err)
+		return
+	}
+
+	profile, err := crypto.NewTLSProfile(flags.TLSVersion, flags.TicketKeys)
+	if err != nil {
+		logger.Error("Creating TLS profile", "err", err)
+		return
+	}
+
+	config, err := crypto.GetTLSConfig(cert, caPem, revocations, profile)
+	if err != nil {
+		logger.Error("Creating TLS config", "err", err)
+		return
+	}
+	go crypto.RotateSessionTicketKeys(config, profile.TicketKeyRotation)
+
+	renewer, err := app.NewCertificateRenewer(config.Certificates[0], flags.Issuer, config.RootCAs, profile)
 	if err != nil {
-		log.Println(err)
+		logger.Error("Creating certificate renewer", "err", err)
 		return
 	}
+	config.Certificates = nil
+	config.GetCertificate = renewer.GetCertificate
+	config.GetClientCertificate = renewer.GetClientCertificate
+	go renewer.Run()
 
-	app.ListenServer(flags, config)
+	app.ListenServer(flags, config, revocations, renewer)
 }
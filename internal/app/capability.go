@@ -0,0 +1,176 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/capability"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/store"
+	"github.com/jenyaftw/trust/internal/pkg/utils"
+)
+
+var capRevocations = capability.NewRevocationList()
+
+func handleCapabilityRevocation(msg *message.Message) {
+	revoked, err := capability.DecodeRevocations(msg.Content)
+	if err != nil {
+		nodeLog.Warn("Decoding capability revocations", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	fresh := make([]*capability.Revocation, 0, len(revoked))
+	for _, r := range revoked {
+		added, err := capRevocations.Add(r, nodeRoots, revocations)
+		if err != nil {
+			nodeLog.Warn("Rejecting capability revocation", "token", fmt.Sprintf("%x", r.ID), "signer", r.Signer, "err", err)
+			continue
+		}
+		if added {
+			nodeLog.Info("Capability token revoked", "token", fmt.Sprintf("%x", r.ID), "signer", r.Signer)
+			fresh = append(fresh, r)
+		}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	content, err := capability.EncodeRevocations(fresh)
+	if err != nil {
+		nodeLog.Error("Encoding capability revocations", "err", err)
+		return
+	}
+
+	forward := &message.Message{
+		Type:    message.CAP_REVOKE,
+		From:    uint64(serverId),
+		Content: content,
+	}
+	for _, peer := range peers {
+		if err := forward.Send(peer); err != nil {
+			nodeLog.Warn("Forwarding capability revocations", "err", err)
+		}
+	}
+}
+
+func sendCapabilityRevocations(conn *tls.Conn) {
+	revoked := capRevocations.All()
+	if len(revoked) == 0 {
+		return
+	}
+
+	content, err := capability.EncodeRevocations(revoked)
+	if err != nil {
+		nodeLog.Error("Encoding capability revocations", "err", err)
+		return
+	}
+
+	msg := &message.Message{
+		Type:    message.CAP_REVOKE,
+		From:    uint64(serverId),
+		Content: content,
+	}
+	if err := msg.Send(conn); err != nil {
+		nodeLog.Warn("Sending capability revocations", "err", err)
+	}
+}
+
+func checkCapability(token *capability.Token, requester string) error {
+	if err := token.Verify(nodeRoots, revocations); err != nil {
+		return err
+	}
+	if err := capRevocations.Check(token); err != nil {
+		return err
+	}
+	if token.Holder != requester {
+		return fmt.Errorf("capability token %x is held by %s, presented by %s", token.ID, token.Holder, requester)
+	}
+	return nil
+}
+
+func authorizeFetch(req *store.Request, ownership *store.Ownership) error {
+	if ownership.Public || ownership.Owns(req.Requester) {
+		return nil
+	}
+
+	token := req.Capability
+	if token == nil {
+		return capability.ErrDenied
+	}
+	if err := checkCapability(token, req.Requester); err != nil {
+		return err
+	}
+	if !ownership.Granted(token.Owner(), store.ManifestID(token.Hash)) {
+		return capability.ErrDenied
+	}
+	return token.Allows(token.Hash, req.Requester, capability.Fetch)
+}
+
+func handleClientStoreRequest(msg *message.Message, cert *x509.Certificate, nodeCount int) {
+	req, err := store.DecodeRequest(msg.Content)
+	if err != nil {
+		nodeLog.Warn("Decoding store request", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	if req.Placed || msg.ToNode != uint64(serverId) {
+		nodeLog.Warn("Rejecting placed store request from client", append(messageAttrs(msg), "subject", cert.Subject.CommonName)...)
+		return
+	}
+	req.Requester = cert.Subject.CommonName
+	req.Repair = false
+	req.Ownership = nil
+
+	if req.Capability != nil {
+		if err := checkCapability(req.Capability, req.Requester); err != nil {
+			nodeLog.Info("Denying store request", append(messageAttrs(msg), "requester", req.Requester, "err", err)...)
+			sendStoreResponse(message.STORE_DENIED, msg, &store.Response{ID: req.ID}, nodeCount)
+			return
+		}
+	}
+
+	placeStoreRequest(msg, req, nodeCount)
+}
+
+func (c *TrustClient) Share(hash []byte, holder string, rights capability.Right, validFor time.Duration, parent *capability.Token) (*capability.Token, error) {
+	if parent != nil {
+		hash = parent.Hash
+	}
+
+	token, err := capability.New(hash, holder, rights, validFor, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	current := c.renewer.Certificate()
+	if err := token.Sign(current.Certificate, current.PrivateKey); err != nil {
+		return nil, err
+	}
+	if err := token.Verify(c.roots, c.revocations); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (c *TrustClient) RevokeCapability(token *capability.Token) error {
+	current := c.renewer.Certificate()
+	r, err := capability.Revoke(token, current.Certificate, current.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	content, err := capability.EncodeRevocations([]*capability.Revocation{r})
+	if err != nil {
+		return err
+	}
+
+	msg := &message.Message{
+		Type:    message.CAP_REVOKE,
+		From:    c.clientId,
+		ID:      utils.GenerateRandomId(),
+		Content: content,
+	}
+	return msg.Send(c.conn)
+}
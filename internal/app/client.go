@@ -1,55 +1,188 @@
 package app
 
 import (
-	"bytes"
-	"crypto/rsa"
+	"bufio"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jenyaftw/trust/internal/pkg/crypto"
 	"github.com/jenyaftw/trust/internal/pkg/flags"
+	"github.com/jenyaftw/trust/internal/pkg/ledger"
 	"github.com/jenyaftw/trust/internal/pkg/message"
 	"github.com/jenyaftw/trust/internal/pkg/structs"
+	"github.com/jenyaftw/trust/internal/pkg/transparency"
+	"github.com/jenyaftw/trust/internal/pkg/utils"
 )
 
 type TrustClient struct {
 	flags              *flags.ClientFlags
 	config             *tls.Config
+	renewer            *CertificateRenewer
 	conn               *tls.Conn
 	clientId           uint64
 	serverId           uint64
+	roots              *x509.CertPool
+	intermediates      *x509.CertPool
+	revocations        *crypto.RevocationStore
+	sessionsMu         sync.RWMutex
 	certs              map[uint64]*x509.Certificate
+	pinned             map[uint64]*x509.Certificate
 	keys               map[uint64][]byte
-	channels           []chan []byte
+	subsMu             sync.Mutex
+	subscribers        []*subscriber
 	blockchains        map[uint64]*structs.Blockchain
+	received           map[uint64]*structs.Blockchain
+	ledgerDir          string
+	ledgers            map[string]*ledger.Ledger
+	ledgerMu           sync.Mutex
+	ledgerSessions     map[ledgerStream]uint64
+	treeHeadInterval   time.Duration
+	sentHeads          map[ledgerStream]int
+	peerHeads          map[ledgerStream]*ledger.TreeHead
 	validateBlockchain bool
+	onionHops          int
+	coverTraffic       time.Duration
+	nodesMu            sync.RWMutex
+	nodes              map[uint64]*x509.Certificate
+	chainMu            sync.Mutex
+	sendLocks          map[uint64]*sync.Mutex
+	gaps               map[uint64]*gapState
+	events             chan Event
+	pendingMu          sync.Mutex
+	pending            map[uint64]chan *message.Message
+	logMu              sync.Mutex
+	logHeads           map[uint64]*transparency.SignedHead
+	consentMu          sync.Mutex
+	consent            ConsentFunc
+	allowlist          map[string]bool
+	blocklist          map[string]bool
+	throttleMu         sync.Mutex
+	throttledUntil     time.Time
+	creditMu           sync.Mutex
+	creditWake         chan struct{}
+	sendCredits        map[uint64]int
+	owedCredits        map[uint64]int
+	logger             *slog.Logger
+	streamsMu          sync.Mutex
+	streams            map[streamKey]*Stream
+	listener           *StreamListener
 }
 
 func NewTrustClient(flags *flags.ClientFlags) (*TrustClient, error) {
-	certContent, err := os.ReadFile(flags.Cert)
+	cert, err := crypto.LoadKeyPair(flags.Cert, flags.Key)
 	if err != nil {
-		fmt.Print(err)
+		return nil, err
 	}
 
-	keyContent, err := os.ReadFile(flags.Key)
+	caContent, err := crypto.LoadSecret(flags.Ca)
 	if err != nil {
-		fmt.Print(err)
+		return nil, err
+	}
+
+	caCert, err := crypto.DecodeCertificate(caContent)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	revocations := crypto.NewRevocationStore(caCert)
+	if flags.Crl != "" {
+		crl, err := crypto.ReadRevocationListFile(flags.Crl)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := revocations.Update(crl); err != nil {
+			return nil, err
+		}
+	}
+
+	profile, err := crypto.NewTLSProfile(flags.TLSVersion, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := crypto.GetTLSConfig(cert, caContent, revocations, profile)
+	if err != nil {
+		return nil, err
+	}
+	config.ServerName = flags.ServerName
+
+	intermediates := x509.NewCertPool()
+	for _, der := range config.Certificates[0].Certificate[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		intermediates.AddCert(cert)
 	}
 
-	certEnc := base64.StdEncoding.EncodeToString(certContent)
-	keyEnc := base64.StdEncoding.EncodeToString(keyContent)
+	renewer, err := NewCertificateRenewer(config.Certificates[0], flags.Issuer, roots, profile)
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = nil
+	config.GetClientCertificate = renewer.GetClientCertificate
+
+	blocklist, err := loadBlocklist(flags.Blocklist)
+	if err != nil {
+		return nil, err
+	}
+
+	allowlist := make(map[string]bool)
+	for _, name := range strings.Split(flags.Allow, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowlist[name] = true
+		}
+	}
+
+	if flags.Ledger != "" && !flags.ValidateBlockchain {
+		return nil, fmt.Errorf("the message ledger requires blockchain validation (-validate)")
+	}
+
+	client := &TrustClient{config: config, renewer: renewer, flags: flags, validateBlockchain: flags.ValidateBlockchain, roots: roots, intermediates: intermediates, revocations: revocations, certs: make(map[uint64]*x509.Certificate), pinned: make(map[uint64]*x509.Certificate), keys: make(map[uint64][]byte), blockchains: make(map[uint64]*structs.Blockchain), received: make(map[uint64]*structs.Blockchain), ledgerDir: flags.Ledger, ledgers: make(map[string]*ledger.Ledger), ledgerSessions: make(map[ledgerStream]uint64), treeHeadInterval: flags.TreeHeads, sentHeads: make(map[ledgerStream]int), peerHeads: make(map[ledgerStream]*ledger.TreeHead), onionHops: flags.OnionHops, coverTraffic: flags.CoverTraffic, nodes: make(map[uint64]*x509.Certificate), sendLocks: make(map[uint64]*sync.Mutex), gaps: make(map[uint64]*gapState), events: make(chan Event, EventBufferSize), pending: make(map[uint64]chan *message.Message), logHeads: make(map[uint64]*transparency.SignedHead), allowlist: allowlist, blocklist: blocklist, creditWake: make(chan struct{}), sendCredits: make(map[uint64]int), owedCredits: make(map[uint64]int), streams: make(map[streamKey]*Stream), logger: slog.With("component", "client")}
+	renewer.OnRenew = client.announceCertificate
+	go renewer.Run()
+
+	return client, nil
+}
+
+func (c *TrustClient) announceCertificate(cert *tls.Certificate) {
+	if c.conn == nil {
+		return
+	}
+
+	for id, peerCert := range c.peerCerts() {
+		msg, err := c.newEnvelope(message.GET_CLIENT_CERT_RESP, id, cert.Certificate[0])
+		if err != nil {
+			c.logger.Error("Signing certificate announcement", "err", err)
+			continue
+		}
+		if err := c.dispatch(msg, peerCert); err != nil {
+			c.logger.Warn("Announcing renewed certificate", "peer", id, "err", err)
+		}
+	}
+}
 
-	config, err := crypto.GetTLSConfig(certEnc, keyEnc, nil)
+func (c *TrustClient) parsePeerCertificate(content []byte) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(content)
 	if err != nil {
 		return nil, err
 	}
 
-	return &TrustClient{config: config, flags: flags, validateBlockchain: flags.ValidateBlockchain, certs: make(map[uint64]*x509.Certificate), keys: make(map[uint64][]byte), blockchains: make(map[uint64]*structs.Blockchain)}, nil
+	if err := crypto.VerifyCertificate(cert, crypto.RoleClient, c.roots, c.intermediates, c.revocations); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
 }
 
 func (c *TrustClient) Connect(bufferSize int) error {
@@ -58,222 +191,472 @@ func (c *TrustClient) Connect(bufferSize int) error {
 		return err
 	}
 
+	if err := crypto.CheckALPN(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	serverCerts := conn.ConnectionState().PeerCertificates
+	if role := crypto.GetCertificateRole(serverCerts[0]); role != crypto.RoleNode {
+		conn.Close()
+		return fmt.Errorf("server presented %s certificate %s", role, serverCerts[0].Subject.CommonName)
+	}
+
 	c.conn = conn
 
 	v := make(chan uint64)
 	go c.handleConnection(v, bufferSize)
 	<-v
 
+	if len(c.blocklist) > 0 {
+		if err := c.announceBlocklist(); err != nil {
+			return err
+		}
+	}
+
+	if c.onionHops > 0 {
+		if err := c.startOnion(); err != nil {
+			return err
+		}
+	}
+
+	if c.validateBlockchain && c.treeHeadInterval > 0 {
+		go c.exchangeTreeHeads()
+	}
+
+	go c.replenishCredits()
 	return nil
 }
 
-func (c *TrustClient) Read() chan []byte {
-	ch := make(chan []byte)
-	c.channels = append(c.channels, ch)
-	return ch
+func (c *TrustClient) Read(senders ...uint64) chan *Received {
+	return c.Subscribe(SubscriberQueueSize, DropOldest, senders...)
 }
 
 func (c *TrustClient) Send(bytes []byte, dest uint64) error {
-	cert := c.certs[dest]
-	key := c.keys[dest]
-	blockchain := c.blockchains[dest]
+	return c.SendBatch([][]byte{bytes}, dest)
+}
 
+func (c *TrustClient) SendBatch(entries [][]byte, dest uint64) error {
+	c.chainMu.Lock()
+	blockchain := c.blockchains[dest]
 	if blockchain == nil {
 		blockchain = structs.NewBlockchain()
 		c.blockchains[dest] = blockchain
 	}
+	sendMu := c.sendLocks[dest]
+	if sendMu == nil {
+		sendMu = &sync.Mutex{}
+		c.sendLocks[dest] = sendMu
+	}
+	c.chainMu.Unlock()
 
+	cert, key, err := c.session(dest)
+	if err != nil {
+		return err
+	}
+
+	if !c.validateBlockchain {
+		for _, entry := range entries {
+			if err := c.takeCredit(dest, time.Time{}); err != nil {
+				return err
+			}
+			if err := c.sendData(entry, dest, key, cert); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := c.takeCredit(dest, time.Time{}); err != nil {
+		return err
+	}
+	sendMu.Lock()
+	defer sendMu.Unlock()
+
+	c.chainMu.Lock()
+	block := blockchain.AddBatch(entries)
+	block.ChainRoot = blockchain.Tree().Root()
+	c.record(dest, ledger.Sent, block)
+	c.chainMu.Unlock()
+	c.logger.Debug("Sending block", "peer", dest, "block", block.ID, "merkle_root", fmt.Sprintf("%x", block.MerkleRoot))
+
+	bytes, err := block.Bytes()
+	if err != nil {
+		return err
+	}
+	return c.sendData(bytes, dest, key, cert)
+}
+
+func (c *TrustClient) session(dest uint64) (*x509.Certificate, []byte, error) {
+	cert, key := c.peerCert(dest), c.peerKey(dest)
 	if cert == nil {
-		msg := &message.Message{
-			Type:         message.GET_CLIENT_CERT,
-			Content:      c.config.Certificates[0].Certificate[0],
-			From:         c.clientId,
-			To:           dest,
-			Intermediate: -1,
+		msg, err := c.newEnvelope(message.GET_CLIENT_CERT, dest, c.renewer.Certificate().Certificate[0])
+		if err != nil {
+			return nil, nil, err
 		}
 
-		fmt.Println("Requesting client cert from", dest)
-		err := msg.Send(c.conn)
+		c.logger.Debug("Requesting client certificate", "peer", dest)
+		err = c.dispatch(msg, c.pinnedCert(dest))
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		i := 0
 		for {
-			if c.certs[dest] != nil {
+			if c.peerCert(dest) != nil {
 				break
 			}
 			if i > 30 {
-				return fmt.Errorf("request for client cert timed out")
+				return nil, nil, fmt.Errorf("request for client cert timed out")
 			}
 			i++
 			time.Sleep(1000 * time.Millisecond)
 		}
-		cert = c.certs[dest]
+		cert = c.peerCert(dest)
 
 		key = crypto.GenerateAESKey()
-		c.keys[dest] = key
+		c.setPeerKey(dest, key)
 		aesKeyEncrypted, err := crypto.EncryptMessage(key, cert)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		msg = &message.Message{
-			Type:         message.AES_KEY,
-			Content:      aesKeyEncrypted,
-			From:         c.clientId,
-			To:           dest,
-			Intermediate: -1,
+		msg, err = c.newEnvelope(message.AES_KEY, dest, aesKeyEncrypted)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		fmt.Println("Sending AES key to", dest)
-		err = msg.Send(c.conn)
+		c.logger.Debug("Sending session key", "peer", dest)
+		c.openCredit(dest)
+		err = c.dispatch(msg, cert)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
-	bytesToSend := bytes
-
-	if c.validateBlockchain {
-		block := blockchain.AddBlockFromBytes(bytes)
-		tree := structs.BuildTreeFromBlockchain(blockchain)
-		block.MerkleRoot = tree.Root.Value
-		fmt.Println("Merkle root:", block.MerkleRoot)
+	return cert, key, nil
+}
 
-		bytes, err := block.Bytes()
-		if err != nil {
-			return err
-		}
-		bytesToSend = bytes
+func (c *TrustClient) sendData(content []byte, dest uint64, key []byte, cert *x509.Certificate) error {
+	encrypted, err := crypto.EncryptMessageAES(content, key)
+	if err != nil {
+		return err
 	}
 
-	encrypted, err := crypto.EncryptMessageAES(bytesToSend, key)
+	msg, err := c.newEnvelope(message.DATA, dest, encrypted)
 	if err != nil {
 		return err
 	}
 
+	return c.dispatch(msg, cert)
+}
+
+func (c *TrustClient) newEnvelope(msgType uint8, dest uint64, content []byte) (*message.Message, error) {
 	msg := &message.Message{
-		Type:         message.DATA,
-		Content:      encrypted,
+		Type:         msgType,
+		Content:      content,
 		From:         c.clientId,
 		To:           dest,
+		ID:           utils.GenerateRandomId(),
 		Intermediate: -1,
 	}
 
-	return msg.Send(c.conn)
+	if err := msg.Sign(c.renewer.Certificate().PrivateKey); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *TrustClient) request(msg *message.Message, timeout time.Duration) (*message.Message, error) {
+	response := make(chan *message.Message, 1)
+	c.pendingMu.Lock()
+	c.pending[msg.ID] = response
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, msg.ID)
+		c.pendingMu.Unlock()
+	}()
+
+	if err := c.waitThrottle(); err != nil {
+		return nil, err
+	}
+	if err := msg.Send(c.conn); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-response:
+		if reply.Type == message.THROTTLE {
+			return nil, fmt.Errorf("%w: request %d was dropped", ErrThrottled, msg.ID)
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("request %d timed out", msg.ID)
+	}
+}
+
+func (c *TrustClient) handleResponse(msg *message.Message) {
+	c.pendingMu.Lock()
+	response, ok := c.pending[msg.ID]
+	c.pendingMu.Unlock()
+	if !ok {
+		c.logger.Info("Dropping unexpected response", messageAttrs(msg)...)
+		return
+	}
+
+	select {
+	case response <- msg:
+	default:
+	}
+}
+
+func (c *TrustClient) verifyEnvelope(msg *message.Message, cert *x509.Certificate) bool {
+	if cert == nil {
+		c.logger.Info("Dropping message from peer with unknown certificate", messageAttrs(msg)...)
+		return false
+	}
+
+	if err := msg.Verify(cert); err != nil {
+		c.logger.Warn("Dropping forged message", append(messageAttrs(msg), "err", err)...)
+		return false
+	}
+	return true
+}
+
+func (c *TrustClient) cachePeerCertificate(id uint64, cert *x509.Certificate) bool {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+
+	if cached := c.certs[id]; cached != nil && cached.Subject.CommonName != cert.Subject.CommonName {
+		c.logger.Warn("Ignoring certificate for a client bound to another subject", "peer", id, "subject", cached.Subject.CommonName, "presented", cert.Subject.CommonName)
+		return false
+	}
+	if pinned := c.pinned[id]; pinned != nil && pinned.Subject.CommonName != cert.Subject.CommonName {
+		c.logger.Warn("Ignoring certificate for a client pinned to another subject", "peer", id, "subject", pinned.Subject.CommonName, "presented", cert.Subject.CommonName)
+		return false
+	}
+
+	c.certs[id] = cert
+	return true
+}
+
+func (c *TrustClient) PinPeer(id uint64, cert *x509.Certificate) error {
+	if err := crypto.VerifyCertificate(cert, crypto.RoleClient, c.roots, c.intermediates, c.revocations); err != nil {
+		return err
+	}
+
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	c.pinned[id] = cert
+	return nil
+}
+
+func (c *TrustClient) pinnedCert(id uint64) *x509.Certificate {
+	c.sessionsMu.RLock()
+	defer c.sessionsMu.RUnlock()
+	return c.pinned[id]
+}
+
+func (c *TrustClient) peerCert(id uint64) *x509.Certificate {
+	c.sessionsMu.RLock()
+	defer c.sessionsMu.RUnlock()
+	return c.certs[id]
+}
+
+func (c *TrustClient) peerKey(id uint64) []byte {
+	c.sessionsMu.RLock()
+	defer c.sessionsMu.RUnlock()
+	return c.keys[id]
+}
+
+func (c *TrustClient) peerCerts() map[uint64]*x509.Certificate {
+	c.sessionsMu.RLock()
+	defer c.sessionsMu.RUnlock()
+	return maps.Clone(c.certs)
+}
+
+func (c *TrustClient) setPeerKey(id uint64, key []byte) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	c.keys[id] = key
+}
+
+func (c *TrustClient) forgetPeer(id uint64) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	delete(c.certs, id)
+	delete(c.pinned, id)
+	delete(c.keys, id)
 }
 
 func (c *TrustClient) Close() {
 	c.conn.Close()
+	c.closeLedgers()
 }
 
 func (c *TrustClient) handleConnection(v chan uint64, bufferSize int) {
 	defer c.Close()
 
+	reader := bufio.NewReaderSize(c.conn, bufferSize)
 	for {
-		size := 0
-		n := 0
-		buf := make([]byte, 0, bufferSize)
-		for {
-			if size != 0 && n >= size {
-				break
-			}
+		msg, err := message.ReadMessage(reader)
+		if err != nil {
+			c.logger.Info("Disconnected", "err", err)
+			return
+		}
 
-			newBuf := make([]byte, bufferSize)
-			bytesRead, err := c.conn.Read(newBuf)
-			if err != nil {
-				log.Println(n, err)
-				return
-			}
+		traceMessage(c.logger, "Received message", msg)
+		c.handleMessage(msg, v)
+	}
+}
 
-			if size == 0 {
-				size = int(message.ReadSize(newBuf[:4]))
-			}
+func (c *TrustClient) handleMessage(msg *message.Message, v chan uint64) {
+	switch msg.Type {
+	case message.PEER_ID:
+		c.logger.Info("Connected to node", "server_node", msg.From)
+		c.serverId = msg.From
+		msg := &message.Message{
+			Type: message.REGISTER_CLIENT,
+		}
+		msg.Send(c.conn)
+	case message.REGISTER_CLIENT_RESP:
+		c.clientId = msg.To
+		c.logger = c.logger.With("client", c.clientId)
+		c.logger.Info("Registered")
+		v <- c.clientId
+	case message.REVOCATION_LIST:
+		updated, err := c.revocations.Update(msg.Content)
+		if err != nil {
+			c.logger.Warn("Rejecting revocation list", "err", err)
+			return
+		}
+		if !updated {
+			return
+		}
 
-			buf = append(buf, newBuf...)
-			n += bytesRead
+		for id, cert := range c.peerCerts() {
+			if c.revocations.IsRevoked(cert) {
+				c.logger.Info("Peer certificate was revoked", "peer", id, "subject", cert.Subject.CommonName)
+				c.forgetPeer(id)
+			}
+		}
+	case message.GET_CLIENT_CERT:
+		cert, err := c.parsePeerCertificate(msg.Content)
+		if err != nil {
+			c.logger.Warn("Rejecting peer certificate", append(messageAttrs(msg), "err", err)...)
+			return
+		}
+		if !c.verifyEnvelope(msg, cert) || !c.approve(msg.From, cert) || !c.cachePeerCertificate(msg.From, cert) {
+			return
 		}
 
-		msg, err := message.MessageFromBytes(buf[4:n])
+		msg, err := c.newEnvelope(message.GET_CLIENT_CERT_RESP, msg.From, c.renewer.Certificate().Certificate[0])
 		if err != nil {
-			log.Println(err)
-			continue
+			c.logger.Error("Signing certificate response", "err", err)
+			return
+		}
+		if err := c.dispatch(msg, cert); err != nil {
+			c.logger.Warn("Sending certificate response", append(messageAttrs(msg), "err", err)...)
+		}
+	case message.GET_CLIENT_CERT_RESP:
+		cert, err := c.parsePeerCertificate(msg.Content)
+		if err != nil {
+			c.logger.Warn("Rejecting peer certificate", append(messageAttrs(msg), "err", err)...)
+			return
+		}
+		if !c.verifyEnvelope(msg, cert) {
+			return
 		}
 
-		switch msg.Type {
-		case message.PEER_ID:
-			fmt.Println("Received peer ID:", msg.From)
-			c.serverId = msg.From
-			msg := &message.Message{
-				Type: message.REGISTER_CLIENT,
-			}
-			msg.Send(c.conn)
-		case message.REGISTER_CLIENT_RESP:
-			fmt.Println("Received client ID:", msg.To)
-			c.clientId = msg.To
-			v <- c.clientId
-		case message.GET_CLIENT_CERT:
-			cert, err := x509.ParseCertificate(msg.Content)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-			c.certs[msg.From] = cert
-
-			msg := &message.Message{
-				Type:         message.GET_CLIENT_CERT_RESP,
-				Content:      c.config.Certificates[0].Certificate[0],
-				From:         c.clientId,
-				To:           msg.From,
-				Intermediate: -1,
-			}
-			msg.Send(c.conn)
-		case message.GET_CLIENT_CERT_RESP:
-			cert, err := x509.ParseCertificate(msg.Content)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
+		c.chainMu.Lock()
+		_, initiated := c.blockchains[msg.From]
+		c.chainMu.Unlock()
+		if c.isBlocked(cert) || !initiated && !c.approve(msg.From, cert) {
+			c.logger.Info("Ignoring peer certificate", "peer", msg.From, "subject", cert.Subject.CommonName)
+			return
+		}
 
-			c.certs[msg.From] = cert
-		case message.AES_KEY:
-			key := c.config.Certificates[0].PrivateKey.(*rsa.PrivateKey)
-			key.Precompute()
-			aesKey, err := crypto.DecryptMessage(msg.Content, key)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-			c.keys[msg.From] = aesKey
-			c.blockchains[msg.From] = structs.NewBlockchain()
-		case message.DATA:
-			decrypted, err := crypto.DecryptMessageAES(msg.Content, c.keys[msg.From])
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
+		c.cachePeerCertificate(msg.From, cert)
+	case message.AES_KEY:
+		if !c.verifyEnvelope(msg, c.peerCert(msg.From)) {
+			return
+		}
 
-			if c.validateBlockchain {
-				block, err := structs.DecodeBlock(decrypted)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-
-				blockchain := c.blockchains[msg.From]
-				blockchain.AddBlock(block)
-
-				tree := structs.BuildTreeFromBlockchain(blockchain)
-				if !bytes.Equal(tree.Root.Value, block.MerkleRoot) {
-					fmt.Println("Merkle root mismatch")
-					continue
-				}
+		var aesKey []byte
+		var err error
+		for _, key := range c.renewer.PrivateKeys() {
+			aesKey, err = crypto.DecryptMessage(msg.Content, key)
+			if err == nil {
+				break
 			}
+		}
+		if err != nil {
+			c.logger.Warn("Decrypting session key", append(messageAttrs(msg), "err", err)...)
+			return
+		}
+		c.setPeerKey(msg.From, aesKey)
+		c.chainMu.Lock()
+		c.received[msg.From] = structs.NewBlockchain()
+		delete(c.gaps, msg.From)
+		c.chainMu.Unlock()
+		c.endLedgerSession(msg.From, ledger.Received)
+		c.openCredit(msg.From)
+	case message.DATA:
+		if !c.verifyEnvelope(msg, c.peerCert(msg.From)) {
+			return
+		}
+
+		decrypted, err := crypto.DecryptMessageAES(msg.Content, c.peerKey(msg.From))
+		if err != nil {
+			c.logger.Warn("Decrypting message", append(messageAttrs(msg), "err", err)...)
+			return
+		}
 
-			for _, ch := range c.channels {
-				ch <- decrypted
+		defer c.consumeCredit(msg.From)
+		if !c.validateBlockchain {
+			c.deliver(c.newReceived(msg, Unvalidated, nil, decrypted))
+			return
+		}
+
+		block, err := structs.DecodeBlock(decrypted)
+		if err != nil {
+			c.logger.Warn("Decoding block", append(messageAttrs(msg), "err", err)...)
+			return
+		}
+
+		for i, accepted := range c.receiveBlock(msg.From, block) {
+			status := Validated
+			if i > 0 {
+				status = Recovered
+			}
+			for entry, content := range accepted.Entries {
+				received := c.newReceived(msg, status, accepted, content)
+				received.Entry = entry
+				c.deliver(received)
 			}
 		}
+	case message.TREE_HEAD:
+		c.handleTreeHead(msg)
+	case message.NODE_DIRECTORY_RESP:
+		c.updateDirectory(msg.Content)
+	case message.ONION_DELIVER:
+		c.handleDelivery(msg, v)
+	case message.BLOCK_REQUEST:
+		c.handleRetransmitRequest(msg)
+	case message.RESYNC_REQUEST:
+		c.handleResyncRequest(msg)
+	case message.RESYNC:
+		c.handleResync(msg)
+	case message.LOG_RECEIPT, message.LOG_HEAD, message.STORE_ACK, message.STORE_DATA, message.STORE_MISSING, message.STORE_DENIED:
+		c.handleResponse(msg)
+	case message.THROTTLE:
+		c.handleThrottle(msg)
+	case message.CREDIT:
+		c.handleCredit(msg)
+	case message.STREAM:
+		c.handleStream(msg)
+	case message.LOG_GOSSIP:
+		c.handleLogGossip(msg)
 	}
 }
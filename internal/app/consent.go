@@ -0,0 +1,279 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/message"
+)
+
+type ConsentFunc func(cert *x509.Certificate) bool
+
+type BlockList struct {
+	Version int64
+	Names   []string
+}
+
+var blockedMu sync.Mutex
+var blockedBy = make(map[uint64]*BlockList)
+
+func (b *BlockList) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeBlockList(data []byte) (*BlockList, error) {
+	list := &BlockList{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(list); err != nil {
+		return nil, fmt.Errorf("error decoding block list: %v", err)
+	}
+	return list, nil
+}
+
+func handleBlockList(msg *message.Message, conn *tls.Conn, fromClient bool) {
+	if fromClient {
+		if clients[msg.From] != conn {
+			nodeLog.Warn("Rejecting block list from another connection", "client", msg.From)
+			return
+		}
+		msg = &message.Message{
+			Type:        message.BLOCK,
+			From:        uint64(serverId),
+			To:          msg.From,
+			Content:     msg.Content,
+			AlreadyBeen: []uint64{},
+		}
+	}
+
+	list, err := decodeBlockList(msg.Content)
+	if err != nil {
+		nodeLog.Warn("Rejecting block list", "client", msg.To, "err", err)
+		return
+	}
+
+	blockedMu.Lock()
+	current, ok := blockedBy[msg.To]
+	if ok && current.Version >= list.Version {
+		blockedMu.Unlock()
+		return
+	}
+	blockedBy[msg.To] = list
+	blockedMu.Unlock()
+	nodeLog.Info("Block list updated", "client", msg.To, "blocked", len(list.Names))
+
+	msg.AlreadyBeen = append(msg.AlreadyBeen, uint64(serverId))
+	bytes, err := msg.Bytes()
+	if err != nil {
+		nodeLog.Error("Encoding block list", "err", err)
+		return
+	}
+
+	for id, peer := range peers {
+		if !slices.Contains(msg.AlreadyBeen, id) {
+			peer.Write(bytes)
+		}
+	}
+}
+
+func sendBlockLists(conn *tls.Conn) {
+	blockedMu.Lock()
+	lists := maps.Clone(blockedBy)
+	blockedMu.Unlock()
+
+	for client, list := range lists {
+		content, err := list.Bytes()
+		if err != nil {
+			nodeLog.Error("Encoding block list", "client", client, "err", err)
+			continue
+		}
+
+		msg := &message.Message{
+			Type:        message.BLOCK,
+			From:        uint64(serverId),
+			To:          client,
+			Content:     content,
+			AlreadyBeen: []uint64{uint64(serverId)},
+		}
+		if err := msg.Send(conn); err != nil {
+			nodeLog.Warn("Sending block list", "client", client, "err", err)
+		}
+	}
+}
+
+func senderBlocked(msg *message.Message, cert *x509.Certificate) bool {
+	switch msg.Type {
+	case message.GET_CLIENT_CERT, message.GET_CLIENT_CERT_RESP, message.AES_KEY, message.DATA, message.TREE_HEAD, message.BLOCK_REQUEST, message.RESYNC_REQUEST, message.RESYNC, message.CREDIT, message.STREAM, message.LOG_GOSSIP:
+	default:
+		return false
+	}
+
+	blockedMu.Lock()
+	defer blockedMu.Unlock()
+	list, ok := blockedBy[msg.To]
+	return ok && slices.Contains(list.Names, cert.Subject.CommonName)
+}
+
+func loadBlocklist(path string) (map[string]bool, error) {
+	blocked := make(map[string]bool)
+	if path == "" {
+		return blocked, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return blocked, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			blocked[name] = true
+		}
+	}
+	return blocked, scanner.Err()
+}
+
+func (c *TrustClient) saveBlocklist() error {
+	if c.flags.Blocklist == "" {
+		return nil
+	}
+
+	content := strings.Join(c.Blocklist(), "\n") + "\n"
+	tmp, err := os.CreateTemp(filepath.Dir(c.flags.Blocklist), ".blocklist-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.flags.Blocklist)
+}
+
+func (c *TrustClient) SetConsent(fn ConsentFunc) {
+	c.consentMu.Lock()
+	defer c.consentMu.Unlock()
+	c.consent = fn
+}
+
+func (c *TrustClient) Allow(name string) {
+	c.consentMu.Lock()
+	defer c.consentMu.Unlock()
+	c.allowlist[name] = true
+}
+
+func (c *TrustClient) Blocklist() []string {
+	c.consentMu.Lock()
+	defer c.consentMu.Unlock()
+
+	names := make([]string, 0, len(c.blocklist))
+	for name := range c.blocklist {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *TrustClient) Block(name string) error {
+	c.consentMu.Lock()
+	c.blocklist[name] = true
+	c.consentMu.Unlock()
+
+	for id, cert := range c.peerCerts() {
+		if cert.Subject.CommonName == name {
+			c.logger.Info("Closing session with blocked sender", "peer", id, "subject", name)
+			c.forgetPeer(id)
+		}
+	}
+
+	if err := c.saveBlocklist(); err != nil {
+		return err
+	}
+	return c.announceBlocklist()
+}
+
+func (c *TrustClient) Unblock(name string) error {
+	c.consentMu.Lock()
+	delete(c.blocklist, name)
+	c.consentMu.Unlock()
+
+	if err := c.saveBlocklist(); err != nil {
+		return err
+	}
+	return c.announceBlocklist()
+}
+
+func (c *TrustClient) announceBlocklist() error {
+	list := &BlockList{Version: time.Now().UnixNano(), Names: c.Blocklist()}
+	content, err := list.Bytes()
+	if err != nil {
+		return err
+	}
+
+	msg := &message.Message{
+		Type:    message.BLOCK,
+		From:    c.clientId,
+		Content: content,
+	}
+	return msg.Send(c.conn)
+}
+
+func (c *TrustClient) isBlocked(cert *x509.Certificate) bool {
+	c.consentMu.Lock()
+	defer c.consentMu.Unlock()
+	return c.blocklist[cert.Subject.CommonName]
+}
+
+func (c *TrustClient) approve(id uint64, cert *x509.Certificate) bool {
+	name := cert.Subject.CommonName
+	if c.isBlocked(cert) {
+		c.logger.Info("Denying session from blocked sender", "peer", id, "subject", name)
+		return false
+	}
+	if cached := c.peerCert(id); cached != nil && cached.Subject.CommonName == name {
+		return true
+	}
+
+	c.consentMu.Lock()
+	allowed, consent, restricted := c.allowlist[name], c.consent, len(c.allowlist) > 0
+	c.consentMu.Unlock()
+
+	switch {
+	case allowed:
+		return true
+	case consent != nil:
+		if !consent(cert) {
+			c.logger.Info("Session was not approved", "peer", id, "subject", name)
+			return false
+		}
+		return true
+	case restricted:
+		c.logger.Info("Denying session from sender not on the allowlist", "peer", id, "subject", name)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventGap EventType = iota
+	EventReplay
+	EventFork
+	EventBadBlock
+	EventRetransmitRequest
+	EventRetransmit
+	EventRecovered
+	EventResync
+	EventThrottled
+	EventOverflow
+	EventSplitView
+)
+
+var EventBufferSize = 256
+
+type Event struct {
+	Type  EventType
+	Peer  uint64
+	First int
+	Last  int
+	Err   error
+	Time  time.Time
+}
+
+func (t EventType) String() string {
+	switch t {
+	case EventGap:
+		return "gap"
+	case EventReplay:
+		return "replay"
+	case EventFork:
+		return "fork"
+	case EventBadBlock:
+		return "bad block"
+	case EventRetransmitRequest:
+		return "retransmit request"
+	case EventRetransmit:
+		return "retransmit"
+	case EventRecovered:
+		return "recovered"
+	case EventResync:
+		return "resync"
+	case EventThrottled:
+		return "throttled"
+	case EventOverflow:
+		return "overflow"
+	case EventSplitView:
+		return "split view"
+	}
+	return "unknown"
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s with %d, blocks %d..%d", e.Type, e.Peer, e.First, e.Last)
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (c *TrustClient) Events() <-chan Event {
+	return c.events
+}
+
+func (c *TrustClient) emit(event Event) {
+	event.Time = time.Now()
+	select {
+	case c.events <- event:
+	default:
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"crypto/tls"
+	"slices"
+	"sync"
+)
+
+var MaxQueuedPerDestination = 256
+
+var writersMu sync.Mutex
+var peerWriters = make(map[uint64]*peerWriter)
+
+type peerWriter struct {
+	conn   *tls.Conn
+	mu     sync.Mutex
+	queues map[uint64][][]byte
+	ring   []uint64
+	next   int
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+func startPeerWriter(id uint64, conn *tls.Conn) {
+	w := &peerWriter{
+		conn:   conn,
+		queues: make(map[uint64][][]byte),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	writersMu.Lock()
+	if old, ok := peerWriters[id]; ok {
+		close(old.done)
+	}
+	peerWriters[id] = w
+	writersMu.Unlock()
+
+	go w.run()
+}
+
+func stopPeerWriters(conn *tls.Conn) {
+	writersMu.Lock()
+	defer writersMu.Unlock()
+
+	for id, w := range peerWriters {
+		if w.conn == conn {
+			close(w.done)
+			delete(peerWriters, id)
+		}
+	}
+}
+
+func queueToPeer(next uint64, dest uint64, data []byte) (bool, bool) {
+	writersMu.Lock()
+	w, ok := peerWriters[next]
+	writersMu.Unlock()
+	if !ok {
+		return false, false
+	}
+	return w.enqueue(dest, data), true
+}
+
+func (w *peerWriter) enqueue(dest uint64, data []byte) bool {
+	w.mu.Lock()
+	queue, ok := w.queues[dest]
+	if len(queue) >= MaxQueuedPerDestination {
+		w.mu.Unlock()
+		return false
+	}
+	if !ok {
+		w.ring = append(w.ring, dest)
+	}
+	w.queues[dest] = append(queue, data)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (w *peerWriter) pop() ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.ring) == 0 {
+		return nil, false
+	}
+
+	w.next %= len(w.ring)
+	dest := w.ring[w.next]
+	queue := w.queues[dest]
+	data := queue[0]
+	if len(queue) == 1 {
+		delete(w.queues, dest)
+		w.ring = slices.Delete(w.ring, w.next, w.next+1)
+	} else {
+		w.queues[dest] = queue[1:]
+		w.next++
+	}
+	return data, true
+}
+
+func (w *peerWriter) run() {
+	for {
+		data, ok := w.pop()
+		if !ok {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+
+		if _, err := w.conn.Write(data); err != nil {
+			nodeLog.Warn("Writing to peer", "err", err)
+			w.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/message"
+)
+
+type OverflowPolicy int
+
+const (
+	DropOldest OverflowPolicy = iota
+	DropNewest
+	Disconnect
+)
+
+var SubscriberQueueSize = 256
+var InitialCredit = 64
+var CreditTimeout = 30 * time.Second
+var CreditInterval = 100 * time.Millisecond
+
+type Credit struct {
+	Grant int
+}
+
+type subscriber struct {
+	ch      chan *Received
+	policy  OverflowPolicy
+	senders map[uint64]bool
+	dropped int
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop oldest"
+	case DropNewest:
+		return "drop newest"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+func (c *TrustClient) Subscribe(size int, policy OverflowPolicy, senders ...uint64) chan *Received {
+	sub := &subscriber{ch: make(chan *Received, max(1, size)), policy: policy}
+	if len(senders) > 0 {
+		sub.senders = make(map[uint64]bool)
+		for _, sender := range senders {
+			sub.senders[sender] = true
+		}
+	}
+
+	c.subsMu.Lock()
+	c.subscribers = append(c.subscribers, sub)
+	c.subsMu.Unlock()
+	return sub.ch
+}
+
+func (c *TrustClient) Unsubscribe(ch chan *Received) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for _, sub := range c.subscribers {
+		if sub.ch == ch {
+			close(sub.ch)
+			c.subscribers = slices.DeleteFunc(c.subscribers, func(s *subscriber) bool { return s == sub })
+			return
+		}
+	}
+}
+
+func (c *TrustClient) deliver(received *Received) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for _, sub := range slices.Clone(c.subscribers) {
+		if sub.senders != nil && !sub.senders[received.From] {
+			continue
+		}
+
+		select {
+		case sub.ch <- received:
+			continue
+		default:
+		}
+
+		sub.dropped++
+		c.emit(Event{Type: EventOverflow, Peer: received.From, Err: fmt.Errorf("subscriber queue of %d is full (%s, %d dropped)", cap(sub.ch), sub.policy, sub.dropped)})
+
+		switch sub.policy {
+		case DropOldest:
+			select {
+			case <-sub.ch:
+			default:
+			}
+			select {
+			case sub.ch <- received:
+			default:
+			}
+		case Disconnect:
+			close(sub.ch)
+			c.subscribers = slices.DeleteFunc(c.subscribers, func(s *subscriber) bool { return s == sub })
+		}
+	}
+}
+
+func (c *TrustClient) queuesHaveRoom(peer uint64) bool {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for _, sub := range c.subscribers {
+		if sub.senders != nil && !sub.senders[peer] {
+			continue
+		}
+		if len(sub.ch) > cap(sub.ch)/2 {
+			return false
+		}
+	}
+	return true
+}
+
+// Credit flows both ways once either side sends the session key.
+func (c *TrustClient) openCredit(peer uint64) {
+	c.creditMu.Lock()
+	c.sendCredits[peer] = InitialCredit
+	c.owedCredits[peer] = 0
+	c.creditMu.Unlock()
+}
+
+func (c *TrustClient) consumeCredit(peer uint64) {
+	c.creditMu.Lock()
+	owed, ok := c.owedCredits[peer]
+	if ok {
+		c.owedCredits[peer] = owed + 1
+	}
+	c.creditMu.Unlock()
+
+	if ok && owed+1 >= InitialCredit/2 {
+		c.grantCredits()
+	}
+}
+
+func (c *TrustClient) grantCredits() {
+	c.creditMu.Lock()
+	grants := make(map[uint64]int)
+	for peer, owed := range c.owedCredits {
+		if owed > 0 && c.queuesHaveRoom(peer) {
+			grants[peer] = owed
+			c.owedCredits[peer] = 0
+		}
+	}
+	c.creditMu.Unlock()
+
+	for peer, grant := range grants {
+		if err := c.sendControl(message.CREDIT, peer, &Credit{Grant: grant}); err != nil {
+			c.logger.Warn("Granting credit", "peer", peer, "err", err)
+		}
+	}
+}
+
+func (c *TrustClient) replenishCredits() {
+	for {
+		time.Sleep(CreditInterval)
+		c.grantCredits()
+	}
+}
+
+func (c *TrustClient) handleCredit(msg *message.Message) {
+	credit := &Credit{}
+	if !c.openControl(msg, credit) || credit.Grant <= 0 {
+		return
+	}
+
+	c.addCredit(msg.From, credit.Grant)
+}
+
+func (c *TrustClient) addCredit(peer uint64, grant int) {
+	c.creditMu.Lock()
+	c.sendCredits[peer] += grant
+	close(c.creditWake)
+	c.creditWake = make(chan struct{})
+	c.creditMu.Unlock()
+}
+
+func (c *TrustClient) takeCredit(peer uint64, deadline time.Time) error {
+	timeout := time.After(CreditTimeout)
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		expired = time.After(time.Until(deadline))
+	}
+
+	for {
+		c.creditMu.Lock()
+		available, limited := c.sendCredits[peer]
+		if !limited || available > 0 {
+			if limited {
+				c.sendCredits[peer]--
+			}
+			c.creditMu.Unlock()
+			return nil
+		}
+		wake := c.creditWake
+		c.creditMu.Unlock()
+
+		select {
+		case <-wake:
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		case <-timeout:
+			return fmt.Errorf("no credit granted by %d within %s", peer, CreditTimeout)
+		}
+	}
+}
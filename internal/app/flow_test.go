@@ -0,0 +1,81 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func testFlowClient() *TrustClient {
+	return &TrustClient{
+		sendCredits: make(map[uint64]int),
+		owedCredits: make(map[uint64]int),
+		creditWake:  make(chan struct{}),
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestTakeCredit(t *testing.T) {
+	c := testFlowClient()
+	if err := c.takeCredit(1, time.Now().Add(10*time.Millisecond)); err != nil {
+		t.Errorf("peer without a session: %v", err)
+	}
+
+	c.openCredit(2)
+	for i := 0; i < InitialCredit; i++ {
+		if err := c.takeCredit(2, time.Now().Add(10*time.Millisecond)); err != nil {
+			t.Fatalf("take %d of the initial credit: %v", i, err)
+		}
+	}
+	if err := c.takeCredit(2, time.Now().Add(10*time.Millisecond)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("take without credit: error = %v, want deadline exceeded", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.addCredit(2, 1)
+	}()
+	if err := c.takeCredit(2, time.Now().Add(time.Second)); err != nil {
+		t.Errorf("take after a grant: %v", err)
+	}
+	if err := c.takeCredit(2, time.Now().Add(10*time.Millisecond)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("grant of 1 allowed two takes: error = %v", err)
+	}
+}
+
+func TestGrantCredits(t *testing.T) {
+	c := testFlowClient()
+	c.Subscribe(4, DropNewest, 1)
+	c.Subscribe(4, DropNewest, 2)
+	c.Subscribe(4, DropNewest, 2, 3)
+
+	for _, peer := range []uint64{1, 2, 3, 4} {
+		c.openCredit(peer)
+		c.consumeCredit(peer)
+	}
+	for i := 0; i < 3; i++ {
+		c.deliver(&Received{From: 2})
+	}
+
+	// Only peers 2 and 3 feed the queue that is filling up. The other grants
+	// are cleared even though there is no session to send them on.
+	c.grantCredits()
+	want := map[uint64]int{1: 0, 2: 1, 3: 1, 4: 0}
+	for peer, owed := range want {
+		if c.owedCredits[peer] != owed {
+			t.Errorf("peer %d: owed %d, want %d", peer, c.owedCredits[peer], owed)
+		}
+	}
+
+	if !c.queuesHaveRoom(5) {
+		t.Error("peer without subscribers has no room")
+	}
+	c.Subscribe(1, DropNewest)
+	c.deliver(&Received{From: 5})
+	if c.queuesHaveRoom(1) {
+		t.Error("full subscriber to every peer left room for peer 1")
+	}
+}
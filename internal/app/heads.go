@@ -0,0 +1,186 @@
+package app
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/ledger"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+func (c *TrustClient) chainFor(peer uint64, direction string) *structs.Blockchain {
+	if direction == ledger.Sent {
+		return c.blockchains[peer]
+	}
+	return c.received[peer]
+}
+
+func (c *TrustClient) PeerTreeHeads(peer uint64) []*ledger.TreeHead {
+	c.chainMu.Lock()
+	defer c.chainMu.Unlock()
+
+	heads := make([]*ledger.TreeHead, 0, 2)
+	for _, direction := range []string{ledger.Sent, ledger.Received} {
+		if head, ok := c.peerHeads[ledgerStream{peer: peer, direction: direction}]; ok {
+			heads = append(heads, head)
+		}
+	}
+	return heads
+}
+
+func (c *TrustClient) exchangeTreeHeads() {
+	for {
+		time.Sleep(c.treeHeadInterval)
+		c.sendTreeHeads()
+	}
+}
+
+func (c *TrustClient) sendTreeHeads() {
+	type pendingHead struct {
+		stream ledgerStream
+		head   *ledger.TreeHead
+	}
+
+	c.chainMu.Lock()
+	var heads []pendingHead
+	for peer, cert := range c.peerCerts() {
+		if c.peerKey(peer) == nil {
+			continue
+		}
+
+		for _, direction := range []string{ledger.Sent, ledger.Received} {
+			chain := c.chainFor(peer, direction)
+			if chain == nil {
+				continue
+			}
+
+			stream := ledgerStream{peer: peer, direction: direction}
+			tree := chain.Tree()
+			if tree.Size() == c.sentHeads[stream] {
+				continue
+			}
+
+			heads = append(heads, pendingHead{stream: stream, head: &ledger.TreeHead{
+				Peer:      cert.Subject.CommonName,
+				Direction: direction,
+				Session:   c.ledgerSession(peer, direction),
+				Size:      tree.Size(),
+				Root:      tree.Root(),
+				Timestamp: time.Now(),
+			}})
+		}
+	}
+	c.chainMu.Unlock()
+
+	for _, pending := range heads {
+		if err := c.sendTreeHead(pending.stream.peer, pending.head); err != nil {
+			c.logger.Warn("Sending tree head", "peer", pending.stream.peer, "err", err)
+			continue
+		}
+
+		c.chainMu.Lock()
+		c.sentHeads[pending.stream] = pending.head.Size
+		c.chainMu.Unlock()
+	}
+}
+
+func (c *TrustClient) sendTreeHead(peer uint64, head *ledger.TreeHead) error {
+	current := c.renewer.Certificate()
+	if err := head.Sign(current.Certificate, current.PrivateKey); err != nil {
+		return err
+	}
+
+	content, err := head.Bytes()
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := crypto.EncryptMessageAES(content, c.peerKey(peer))
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.newEnvelope(message.TREE_HEAD, peer, encrypted)
+	if err != nil {
+		return err
+	}
+	return c.dispatch(msg, c.peerCert(peer))
+}
+
+func (c *TrustClient) handleTreeHead(msg *message.Message) {
+	peerCert := c.peerCert(msg.From)
+	if !c.verifyEnvelope(msg, peerCert) || c.peerKey(msg.From) == nil {
+		return
+	}
+
+	content, err := crypto.DecryptMessageAES(msg.Content, c.peerKey(msg.From))
+	if err != nil {
+		c.logger.Warn("Decrypting tree head", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	head, err := ledger.DecodeTreeHead(content)
+	if err != nil {
+		c.logger.Warn("Decoding tree head", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	if len(head.Chain) == 0 {
+		c.logger.Warn("Dropping tree head without certificate", messageAttrs(msg)...)
+		return
+	}
+
+	cert, err := c.parsePeerCertificate(head.Chain[0])
+	if err != nil {
+		c.logger.Warn("Dropping tree head", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+	if cert.Subject.CommonName != peerCert.Subject.CommonName {
+		c.logger.Warn("Dropping tree head signed by another subject", append(messageAttrs(msg), "subject", cert.Subject.CommonName)...)
+		return
+	}
+	if err := head.Verify(cert); err != nil {
+		c.logger.Warn("Dropping tree head", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	direction := ledger.Opposite(head.Direction)
+	if c.acceptTreeHead(msg, direction, head) {
+		c.recordHead(msg.From, direction, head)
+	}
+}
+
+func (c *TrustClient) acceptTreeHead(msg *message.Message, direction string, head *ledger.TreeHead) bool {
+	c.chainMu.Lock()
+	chain := c.chainFor(msg.From, direction)
+	if chain == nil {
+		c.chainMu.Unlock()
+		c.logger.Info("Dropping tree head for unknown stream", append(messageAttrs(msg), "direction", direction)...)
+		return false
+	}
+
+	if direction == ledger.Received && head.Size > len(chain.Blocks) {
+		send := c.requestRetransmit(msg.From, len(chain.Blocks), head.Size-1)
+		c.chainMu.Unlock()
+		runSends([]func(){send})
+		return false
+	}
+
+	root, err := chain.Tree().RootAt(head.Size)
+	if err == nil && bytes.Equal(root, head.Root) {
+		c.peerHeads[ledgerStream{peer: msg.From, direction: direction}] = head
+	}
+	c.chainMu.Unlock()
+
+	if err != nil {
+		c.logger.Warn("Dropping tree head", append(messageAttrs(msg), "err", err)...)
+		return false
+	}
+	if !bytes.Equal(root, head.Root) {
+		c.logger.Warn("Tree head does not match the stream", append(messageAttrs(msg), "direction", direction, "size", head.Size)...)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"crypto/tls"
+	"log/slog"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+)
+
+func ListenIssuer(addr string, config *tls.Config, issuer *crypto.Issuer) {
+	logger := slog.With("component", "issuer")
+
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		logger.Error("Listening", "addr", addr, "err", err)
+		return
+	}
+	defer ln.Close()
+
+	logger.Info("Issuing certificates", "addr", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Warn("Accepting connection", "err", err)
+			continue
+		}
+		go handleIssuerConnection(conn.(*tls.Conn), issuer, logger)
+	}
+}
+
+func handleIssuerConnection(conn *tls.Conn, issuer *crypto.Issuer, logger *slog.Logger) {
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		logger.Warn("TLS handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	peerCerts := conn.ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		return
+	}
+	logger = logger.With("peer", peerCerts[0].Subject.CommonName)
+
+	msg, err := message.ReadMessage(conn)
+	if err != nil {
+		logger.Warn("Reading request", "err", err)
+		return
+	}
+
+	if msg.Type != message.CERT_REQUEST {
+		logger.Warn("Unexpected message on issuer connection", messageAttrs(msg)...)
+		return
+	}
+
+	resp := &message.Message{Type: message.CERT_RESPONSE}
+	chain, err := issuer.Renew(peerCerts[0], msg.Content)
+	if err != nil {
+		logger.Warn("Rejecting renewal", "err", err)
+		resp = &message.Message{Type: message.CERT_REJECTED, Content: []byte(err.Error())}
+	} else {
+		logger.Info("Renewed certificate")
+		resp.Content = chain
+	}
+
+	if err := resp.Send(conn); err != nil {
+		logger.Warn("Sending renewal response", "err", err)
+	}
+}
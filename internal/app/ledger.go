@@ -0,0 +1,107 @@
+package app
+
+import (
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/ledger"
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+type ledgerStream struct {
+	peer      uint64
+	direction string
+}
+
+func (c *TrustClient) ledgerFor(peer uint64) *ledger.Ledger {
+	cert := c.peerCert(peer)
+	if cert == nil {
+		return nil
+	}
+
+	name := cert.Subject.CommonName
+	if l, ok := c.ledgers[name]; ok {
+		return l
+	}
+
+	l, err := ledger.Open(ledger.PeerDir(c.ledgerDir, name))
+	if err != nil {
+		c.logger.Error("Opening ledger", "subject", name, "err", err)
+		return nil
+	}
+	c.ledgers[name] = l
+	return l
+}
+
+func (c *TrustClient) appendRecord(peer uint64, direction string, rec *ledger.Record) {
+	if c.ledgerDir == "" {
+		return
+	}
+
+	c.ledgerMu.Lock()
+	defer c.ledgerMu.Unlock()
+
+	l := c.ledgerFor(peer)
+	if l == nil {
+		return
+	}
+
+	stream := ledgerStream{peer: peer, direction: direction}
+	session, ok := c.ledgerSessions[stream]
+	if !ok {
+		session = l.NewSession(direction)
+		c.ledgerSessions[stream] = session
+	}
+
+	rec.Direction = direction
+	rec.Session = session
+	rec.Peer = peer
+	rec.Recorded = time.Now()
+	if err := l.Append(rec); err != nil {
+		c.logger.Error("Writing ledger", "peer", peer, "direction", direction, "err", err)
+	}
+}
+
+func (c *TrustClient) record(peer uint64, direction string, block *structs.Block) {
+	c.appendRecord(peer, direction, &ledger.Record{Block: *block})
+}
+
+func (c *TrustClient) forgetHeads(peer uint64, direction string) {
+	stream := ledgerStream{peer: peer, direction: direction}
+	delete(c.sentHeads, stream)
+	delete(c.peerHeads, stream)
+}
+
+func (c *TrustClient) ledgerSession(peer uint64, direction string) uint64 {
+	c.ledgerMu.Lock()
+	defer c.ledgerMu.Unlock()
+	return c.ledgerSessions[ledgerStream{peer: peer, direction: direction}]
+}
+
+func (c *TrustClient) endLedgerSession(peer uint64, direction string) {
+	c.ledgerMu.Lock()
+	defer c.ledgerMu.Unlock()
+	delete(c.ledgerSessions, ledgerStream{peer: peer, direction: direction})
+}
+
+func (c *TrustClient) restartLedgerSession(peer uint64, direction string, blocks []*structs.Block) {
+	c.endLedgerSession(peer, direction)
+	for _, block := range blocks {
+		c.record(peer, direction, block)
+	}
+}
+
+func (c *TrustClient) recordHead(peer uint64, direction string, head *ledger.TreeHead) {
+	c.appendRecord(peer, direction, &ledger.Record{Head: head})
+}
+
+func (c *TrustClient) closeLedgers() {
+	c.ledgerMu.Lock()
+	defer c.ledgerMu.Unlock()
+
+	for name, l := range c.ledgers {
+		if err := l.Close(); err != nil {
+			c.logger.Error("Closing ledger", "subject", name, "err", err)
+		}
+		delete(c.ledgers, name)
+	}
+}
@@ -0,0 +1,26 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jenyaftw/trust/internal/pkg/logging"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+)
+
+var nodeLog = slog.Default()
+
+func messageAttrs(msg *message.Message) []any {
+	return []any{"msg_type", message.TypeName(msg.Type), "msg_id", msg.ID, "from", msg.From, "to", msg.To}
+}
+
+func tracing(logger *slog.Logger) bool {
+	return logger.Enabled(context.Background(), logging.LevelTrace)
+}
+
+func traceMessage(logger *slog.Logger, text string, msg *message.Message, args ...any) {
+	if !tracing(logger) {
+		return
+	}
+	logger.Log(context.Background(), logging.LevelTrace, text, append(messageAttrs(msg), args...)...)
+}
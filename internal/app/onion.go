@@ -0,0 +1,404 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/onion"
+)
+
+var ErrUnknownRecipient = errors.New("onion routing needs the pinned certificate of client")
+
+var nodeCertsMu sync.Mutex
+var nodeCerts = make(map[uint64][][]byte)
+
+func nodeCertificateMessage(id uint64, chain [][]byte) (*message.Message, error) {
+	content, err := onion.EncodeDirectory(map[uint64][][]byte{id: chain})
+	if err != nil {
+		return nil, err
+	}
+
+	return &message.Message{
+		Type:    message.NODE_CERT,
+		From:    id,
+		Content: content,
+	}, nil
+}
+
+func setNodeCertificate(id uint64, chain [][]byte) {
+	nodeCertsMu.Lock()
+	defer nodeCertsMu.Unlock()
+	nodeCerts[id] = chain
+}
+
+func nodeCertificates() map[uint64][][]byte {
+	nodeCertsMu.Lock()
+	defer nodeCertsMu.Unlock()
+	return maps.Clone(nodeCerts)
+}
+
+func sendNodeCertificates(conn *tls.Conn) {
+	for id, chain := range nodeCertificates() {
+		msg, err := nodeCertificateMessage(id, chain)
+		if err != nil {
+			nodeLog.Error("Encoding node certificate", "cert_node", id, "err", err)
+			continue
+		}
+		if err := msg.Send(conn); err != nil {
+			nodeLog.Warn("Sending node certificate", "cert_node", id, "err", err)
+		}
+	}
+}
+
+func announceNodeCertificate(cert *tls.Certificate) {
+	setNodeCertificate(uint64(serverId), cert.Certificate)
+	for _, peer := range peers {
+		msg, err := nodeCertificateMessage(uint64(serverId), cert.Certificate)
+		if err != nil {
+			nodeLog.Error("Encoding node certificate", "err", err)
+			return
+		}
+		if err := msg.Send(peer); err != nil {
+			nodeLog.Warn("Announcing node certificate", "err", err)
+		}
+	}
+}
+
+func handleNodeCertificate(msg *message.Message) {
+	directory, err := onion.DecodeDirectory(msg.Content)
+	if err != nil {
+		nodeLog.Warn("Decoding node certificate", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	chain, ok := directory[msg.From]
+	if !ok || len(chain) == 0 || msg.From == uint64(serverId) {
+		return
+	}
+
+	nodeCertsMu.Lock()
+	known, ok := nodeCerts[msg.From]
+	nodeCertsMu.Unlock()
+	if ok && bytes.Equal(known[0], chain[0]) {
+		return
+	}
+
+	cert, err := crypto.VerifyNodeCertificate(chain, msg.From, nodeRoots, revocations)
+	if err != nil {
+		nodeLog.Warn("Rejecting node certificate", "cert_node", msg.From, "err", err)
+		return
+	}
+
+	nodeLog.Info("Learned node certificate", "cert_node", msg.From, "not_after", cert.NotAfter)
+	setNodeCertificate(msg.From, chain)
+	for _, peer := range peers {
+		if err := msg.Send(peer); err != nil {
+			nodeLog.Warn("Forwarding node certificate", "cert_node", msg.From, "err", err)
+		}
+	}
+}
+
+func sendNodeDirectory(conn *tls.Conn) {
+	content, err := onion.EncodeDirectory(nodeCertificates())
+	if err != nil {
+		nodeLog.Error("Encoding node directory", "err", err)
+		return
+	}
+
+	msg := &message.Message{
+		Type:    message.NODE_DIRECTORY_RESP,
+		From:    uint64(serverId),
+		Content: content,
+	}
+	if err := msg.Send(conn); err != nil {
+		nodeLog.Warn("Sending node directory", "err", err)
+	}
+}
+
+func peelOnion(msg *message.Message, nodeCount int) {
+	layer, err := onion.Peel(msg.Content, nodeRenewer.PrivateKeys())
+	if err != nil {
+		nodeLog.Info("Dropping onion", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	if layer.Drop {
+		return
+	}
+
+	if layer.Exit {
+		content, err := onion.EncodeDelivery(layer)
+		if err != nil {
+			nodeLog.Error("Encoding onion delivery", "err", err)
+			return
+		}
+
+		deliver := &message.Message{
+			Type:         message.ONION_DELIVER,
+			From:         uint64(serverId),
+			To:           layer.Client,
+			Intermediate: -1,
+			Content:      content,
+		}
+
+		deliverToClient(deliver, nodeCount)
+		return
+	}
+
+	content, err := onion.Pad(layer.Payload)
+	if err != nil {
+		nodeLog.Error("Padding onion", "err", err)
+		return
+	}
+
+	next := &message.Message{
+		Type:         message.ONION,
+		From:         uint64(serverId),
+		ToNode:       layer.Next,
+		Intermediate: -1,
+		Content:      content,
+	}
+
+	if layer.Next == uint64(serverId) {
+		peelOnion(next, nodeCount)
+		return
+	}
+
+	relayToNode(next, processNodeRelay(next, nodeCount), nodeCount)
+}
+
+func relayToNode(msg *message.Message, nextNode uint64, nodeCount int) {
+	data, err := msg.Bytes()
+	if err != nil {
+		nodeLog.Error("Encoding message", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	dest := msg.To
+	if dest == 0 {
+		dest = msg.ToNode
+	}
+
+	traceMessage(nodeLog, "Relaying message", msg, "next_node", nextNode)
+	queued, ok := queueToPeer(nextNode, dest, data)
+	if !ok {
+		nodeLog.Warn("No connection to node", append(messageAttrs(msg), "next_node", nextNode)...)
+		return
+	}
+	if queued {
+		return
+	}
+
+	nodeLog.Warn("Dropping message: relay queue is full", append(messageAttrs(msg), "next_node", nextNode, "destination", dest)...)
+	if msg.Type == message.THROTTLE || !knownClient(msg.From) {
+		return
+	}
+
+	reply, err := throttleNotice(msg.From, msg, &Throttle{Type: msg.Type, Reason: "relay queue is full", RetryAfter: MaxThrottleDelay, Dropped: true})
+	if err != nil {
+		nodeLog.Error("Encoding throttle notice", "err", err)
+		return
+	}
+	deliverToClient(reply, nodeCount)
+}
+
+var DirectoryRefreshInterval = 10 * time.Minute
+var CoverTrafficSize = 1024
+
+func (c *TrustClient) requestDirectory() error {
+	msg := &message.Message{
+		Type: message.NODE_DIRECTORY,
+		From: c.clientId,
+	}
+	return msg.Send(c.conn)
+}
+
+func (c *TrustClient) updateDirectory(content []byte) {
+	directory, err := onion.DecodeDirectory(content)
+	if err != nil {
+		c.logger.Warn("Decoding node directory", "err", err)
+		return
+	}
+
+	nodes := make(map[uint64]*x509.Certificate)
+	for id, chain := range directory {
+		cert, err := crypto.VerifyNodeCertificate(chain, id, c.roots, c.revocations)
+		if err != nil {
+			c.logger.Warn("Ignoring node certificate", "cert_node", id, "err", err)
+			continue
+		}
+		nodes[id] = cert
+	}
+
+	c.nodesMu.Lock()
+	c.nodes = nodes
+	c.nodesMu.Unlock()
+	c.logger.Info("Node directory updated", "nodes", len(nodes))
+}
+
+func (c *TrustClient) startOnion() error {
+	if err := c.requestDirectory(); err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		c.nodesMu.RLock()
+		count := len(c.nodes)
+		c.nodesMu.RUnlock()
+		if count > 0 {
+			break
+		}
+		if i > 30 {
+			return fmt.Errorf("request for node directory timed out")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	go func() {
+		for {
+			time.Sleep(DirectoryRefreshInterval)
+			if err := c.requestDirectory(); err != nil {
+				c.logger.Warn("Requesting node directory", "err", err)
+				return
+			}
+		}
+	}()
+
+	if c.coverTraffic > 0 {
+		go c.sendCoverTraffic()
+	}
+	return nil
+}
+
+func (c *TrustClient) selectPath() ([]onion.Hop, error) {
+	c.nodesMu.RLock()
+	defer c.nodesMu.RUnlock()
+
+	if len(c.nodes) == 0 {
+		return nil, fmt.Errorf("node directory is empty")
+	}
+
+	hops := make([]onion.Hop, 0, len(c.nodes))
+	for id, cert := range c.nodes {
+		if time.Now().After(cert.NotAfter) {
+			continue
+		}
+		hops = append(hops, onion.Hop{Node: id, Cert: cert})
+	}
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("all node certificates in the directory have expired")
+	}
+
+	rand.Shuffle(len(hops), func(i, j int) {
+		hops[i], hops[j] = hops[j], hops[i]
+	})
+	return hops[:min(c.onionHops, len(hops))], nil
+}
+
+func (c *TrustClient) sendOnion(exit *onion.Layer) error {
+	path, err := c.selectPath()
+	if err != nil {
+		return err
+	}
+
+	content, err := onion.Wrap(path, exit)
+	if err != nil {
+		return err
+	}
+
+	msg := &message.Message{
+		Type:         message.ONION,
+		ToNode:       path[0].Node,
+		Intermediate: -1,
+		Content:      content,
+	}
+	return msg.Send(c.conn)
+}
+
+func (c *TrustClient) dispatch(msg *message.Message, destCert *x509.Certificate) error {
+	if err := c.waitThrottle(); err != nil {
+		return err
+	}
+
+	if c.onionHops == 0 {
+		return msg.Send(c.conn)
+	}
+
+	envelope, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// An unsealed envelope would show the exit node both From and To.
+	if destCert == nil {
+		return fmt.Errorf("%w %d", ErrUnknownRecipient, msg.To)
+	}
+	sealed, err := crypto.SealMessage(envelope, destCert)
+	if err != nil {
+		return err
+	}
+
+	return c.sendOnion(&onion.Layer{Exit: true, Client: msg.To, Payload: sealed, Sealed: true})
+}
+
+func (c *TrustClient) sendCoverTraffic() {
+	for {
+		time.Sleep(time.Duration(rand.ExpFloat64() * float64(c.coverTraffic)))
+
+		payload := make([]byte, rand.IntN(CoverTrafficSize))
+		if err := c.sendOnion(&onion.Layer{Drop: true, Payload: payload}); err != nil {
+			c.logger.Warn("Sending cover traffic", "err", err)
+			return
+		}
+	}
+}
+
+func (c *TrustClient) handleDelivery(msg *message.Message, v chan uint64) {
+	sealed, payload, err := onion.DecodeDelivery(msg.Content)
+	if err != nil {
+		c.logger.Warn("Decoding onion delivery", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	if sealed {
+		var envelope []byte
+		for _, key := range c.renewer.PrivateKeys() {
+			envelope, err = crypto.OpenMessage(payload, key)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			c.logger.Warn("Dropping onion delivery", append(messageAttrs(msg), "err", err)...)
+			return
+		}
+		payload = envelope
+	}
+
+	inner, err := message.ReadMessage(bytes.NewReader(payload))
+	if err != nil {
+		c.logger.Warn("Decoding onion delivery", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	if inner.To != c.clientId {
+		c.logger.Warn("Dropping onion delivery addressed to another client", messageAttrs(inner)...)
+		return
+	}
+
+	switch inner.Type {
+	case message.GET_CLIENT_CERT, message.GET_CLIENT_CERT_RESP, message.AES_KEY, message.DATA, message.TREE_HEAD, message.BLOCK_REQUEST, message.RESYNC_REQUEST, message.RESYNC, message.CREDIT, message.STREAM, message.LOG_GOSSIP:
+		c.handleMessage(inner, v)
+	default:
+		c.logger.Warn("Dropping onion delivery of unexpected type", messageAttrs(inner)...)
+	}
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+type ValidationStatus int
+
+const (
+	Unvalidated ValidationStatus = iota
+	Validated
+	Recovered
+)
+
+type Received struct {
+	From    uint64
+	Subject string
+	ID      uint64
+	Time    time.Time
+	Status  ValidationStatus
+	Block   *structs.Block
+	Entry   int
+	Payload []byte
+}
+
+func (s ValidationStatus) String() string {
+	switch s {
+	case Unvalidated:
+		return "unvalidated"
+	case Validated:
+		return "validated"
+	case Recovered:
+		return "validated after recovery"
+	}
+	return "unknown"
+}
+
+func (c *TrustClient) newReceived(msg *message.Message, status ValidationStatus, block *structs.Block, payload []byte) *Received {
+	received := &Received{
+		From:    msg.From,
+		ID:      msg.ID,
+		Time:    time.Now(),
+		Status:  status,
+		Block:   block,
+		Payload: payload,
+	}
+
+	if cert := c.peerCert(msg.From); cert != nil {
+		received.Subject = cert.Subject.CommonName
+	}
+	if status == Recovered {
+		received.ID = 0
+	}
+	return received
+}
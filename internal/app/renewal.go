@@ -0,0 +1,153 @@
+package app
+
+import (
+	gocrypto "crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+)
+
+var RenewalRetryInterval = time.Minute
+
+type CertificateRenewer struct {
+	mu       sync.RWMutex
+	current  *tls.Certificate
+	previous *tls.Certificate
+	issuer   string
+	roots    *x509.CertPool
+	profile  crypto.TLSProfile
+	OnRenew  func(*tls.Certificate)
+}
+
+func NewCertificateRenewer(cert tls.Certificate, issuer string, roots *x509.CertPool, profile crypto.TLSProfile) (*CertificateRenewer, error) {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf = leaf
+	}
+
+	return &CertificateRenewer{current: &cert, issuer: issuer, roots: roots, profile: profile}, nil
+}
+
+func (r *CertificateRenewer) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.current
+}
+
+func (r *CertificateRenewer) PrivateKeys() []gocrypto.PrivateKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := []gocrypto.PrivateKey{r.current.PrivateKey}
+	if r.previous != nil {
+		keys = append(keys, r.previous.PrivateKey)
+	}
+	return keys
+}
+
+func (r *CertificateRenewer) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+func (r *CertificateRenewer) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+func (r *CertificateRenewer) Run() {
+	if r.issuer == "" {
+		return
+	}
+
+	for {
+		renewAt := crypto.RenewalTime(r.Certificate().Leaf)
+		time.Sleep(time.Until(renewAt))
+
+		if err := r.Renew(); err != nil {
+			slog.Warn("Certificate renewal failed", "component", "renewal", "subject", r.Certificate().Leaf.Subject.CommonName, "err", err)
+			time.Sleep(RenewalRetryInterval)
+		}
+	}
+}
+
+func (r *CertificateRenewer) Renew() error {
+	current := r.Certificate()
+
+	key, ok := current.PrivateKey.(gocrypto.Signer)
+	if !ok {
+		return fmt.Errorf("private key %T cannot sign a certificate request", current.PrivateKey)
+	}
+	// Keys held by an external signer cannot be replaced from here, so they
+	// sign the request for their own renewal.
+	if alg, err := crypto.GetKeyAlgorithm(current.PrivateKey); err == nil {
+		if key, err = crypto.GenerateKey(alg); err != nil {
+			return err
+		}
+	}
+
+	csr, err := crypto.CreateCertificateRequest(current.Leaf, key)
+	if err != nil {
+		return err
+	}
+
+	config := r.profile.Config()
+	config.RootCAs = r.roots
+	config.GetClientCertificate = r.GetClientCertificate
+
+	conn, err := tls.Dial("tcp", r.issuer, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := crypto.CheckALPN(conn); err != nil {
+		return err
+	}
+
+	msg := &message.Message{
+		Type:    message.CERT_REQUEST,
+		Content: csr,
+	}
+	if err := msg.Send(conn); err != nil {
+		return err
+	}
+
+	resp, err := message.ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+
+	switch resp.Type {
+	case message.CERT_RESPONSE:
+	case message.CERT_REJECTED:
+		return fmt.Errorf("renewal rejected: %s", resp.Content)
+	default:
+		return fmt.Errorf("unexpected issuer response %d", resp.Type)
+	}
+
+	cert, err := crypto.SignerKeyPair(resp.Content, key)
+	if err != nil {
+		return err
+	}
+	leaf := cert.Leaf
+
+	r.mu.Lock()
+	r.previous = r.current
+	r.current = &cert
+	r.mu.Unlock()
+
+	slog.Info("Certificate renewed", "component", "renewal", "subject", leaf.Subject.CommonName, "not_after", leaf.NotAfter)
+	if r.OnRenew != nil {
+		r.OnRenew(&cert)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/store"
+	"github.com/jenyaftw/trust/internal/pkg/utils"
+)
+
+var RepairInterval = 30 * time.Second
+var LivenessTimeout = 90 * time.Second
+var ShardRequestTimeout = 10 * time.Second
+
+var livenessMu sync.Mutex
+var lastSeen = make(map[uint64]time.Time)
+var firstPing = make(map[uint64]time.Time)
+
+var nodePendingMu sync.Mutex
+var nodePending = make(map[uint64]chan *message.Message)
+
+func routeToNode(msg *message.Message, nodeCount int) {
+	msg.Intermediate = -1
+	relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+}
+
+func pingNode(id uint64, nodeCount int) {
+	livenessMu.Lock()
+	if _, ok := firstPing[id]; !ok {
+		firstPing[id] = time.Now()
+	}
+	livenessMu.Unlock()
+
+	routeToNode(&message.Message{
+		Type:   message.PING,
+		From:   uint64(serverId),
+		ToNode: id,
+		ID:     utils.GenerateRandomId(),
+	}, nodeCount)
+}
+
+func handlePing(msg *message.Message, nodeCount int) {
+	if msg.ToNode != uint64(serverId) {
+		relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+		return
+	}
+
+	routeToNode(&message.Message{
+		Type:   message.PONG,
+		From:   uint64(serverId),
+		ToNode: msg.From,
+		ID:     msg.ID,
+	}, nodeCount)
+}
+
+func handlePong(msg *message.Message, nodeCount int) {
+	if msg.ToNode != uint64(serverId) {
+		relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+		return
+	}
+
+	livenessMu.Lock()
+	lastSeen[msg.From] = time.Now()
+	livenessMu.Unlock()
+}
+
+func nodeAlive(id uint64) bool {
+	if id == uint64(serverId) {
+		return true
+	}
+
+	livenessMu.Lock()
+	defer livenessMu.Unlock()
+
+	first, pinged := firstPing[id]
+	if !pinged || time.Since(first) < LivenessTimeout {
+		return true
+	}
+	return time.Since(lastSeen[id]) < LivenessTimeout
+}
+
+func handleShardRequest(msg *message.Message, nodeCount int) {
+	if msg.ToNode != uint64(serverId) {
+		relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+		return
+	}
+
+	reply := &message.Message{
+		Type:   message.SHARD_DATA,
+		From:   uint64(serverId),
+		ToNode: msg.From,
+		ID:     msg.ID,
+	}
+	if chunkStore != nil {
+		if data, err := chunkStore.Get(msg.Content); err == nil {
+			reply.Content = data
+		}
+	}
+	routeToNode(reply, nodeCount)
+}
+
+func handleShardData(msg *message.Message, nodeCount int) {
+	if msg.ToNode != uint64(serverId) {
+		relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+		return
+	}
+
+	nodePendingMu.Lock()
+	response, ok := nodePending[msg.ID]
+	nodePendingMu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case response <- msg:
+	default:
+	}
+}
+
+func fetchShard(node uint64, id []byte, nodeCount int) ([]byte, error) {
+	if node == uint64(serverId) {
+		return chunkStore.Get(id)
+	}
+
+	msg := &message.Message{
+		Type:    message.SHARD_GET,
+		From:    uint64(serverId),
+		ToNode:  node,
+		ID:      utils.GenerateRandomId(),
+		Content: id,
+	}
+
+	response := make(chan *message.Message, 1)
+	nodePendingMu.Lock()
+	nodePending[msg.ID] = response
+	nodePendingMu.Unlock()
+	defer func() {
+		nodePendingMu.Lock()
+		delete(nodePending, msg.ID)
+		nodePendingMu.Unlock()
+	}()
+
+	routeToNode(msg, nodeCount)
+
+	select {
+	case reply := <-response:
+		if !bytes.Equal(store.ChunkID(reply.Content), id) {
+			return nil, fmt.Errorf("node %d does not have shard %x", node, id)
+		}
+		return reply.Content, nil
+	case <-time.After(ShardRequestTimeout):
+		return nil, fmt.Errorf("request for shard %x to node %d timed out", id, node)
+	}
+}
+
+func repairStripes(nodeCount int) {
+	for {
+		time.Sleep(RepairInterval)
+
+		stripes, err := chunkStore.Stripes()
+		if err != nil {
+			nodeLog.Error("Listing stripes", "err", err)
+			continue
+		}
+
+		members := make(map[uint64]bool)
+		for _, stripe := range stripes {
+			if len(stripe.Index(uint64(serverId))) == 0 {
+				continue
+			}
+			for _, node := range stripe.Nodes {
+				if node != uint64(serverId) {
+					members[node] = true
+				}
+			}
+		}
+		for node := range members {
+			pingNode(node, nodeCount)
+		}
+
+		for _, stripe := range stripes {
+			if len(stripe.Index(uint64(serverId))) == 0 {
+				continue
+			}
+
+			lost := make([]int, 0)
+			repairer := -1
+			for i, node := range stripe.Nodes {
+				if !nodeAlive(node) {
+					lost = append(lost, i)
+				} else if repairer == -1 {
+					repairer = i
+				}
+			}
+
+			if len(lost) == 0 || repairer == -1 || stripe.Nodes[repairer] != uint64(serverId) {
+				continue
+			}
+			if err := repairStripe(stripe, lost, nodeCount); err != nil {
+				nodeLog.Warn("Repairing stripe", "stripe", fmt.Sprintf("%x", stripe.ID()), "err", err)
+			}
+		}
+	}
+}
+
+func repairStripe(stripe *store.Stripe, lost []int, nodeCount int) error {
+	shards := make([][]byte, stripe.N)
+	have := 0
+	for i, node := range stripe.Nodes {
+		if have == stripe.K {
+			break
+		}
+		if slices.Contains(lost, i) {
+			continue
+		}
+
+		shard, err := fetchShard(node, stripe.Shards[i], nodeCount)
+		if err != nil {
+			nodeLog.Warn("Fetching shard for repair", "stripe", fmt.Sprintf("%x", stripe.ID()), "shard", i, "shard_node", node, "err", err)
+			continue
+		}
+		shards[i] = shard
+		have++
+	}
+
+	if _, err := store.DecodeStripe(stripe, shards); err != nil {
+		return err
+	}
+
+	updated := *stripe
+	updated.Nodes = slices.Clone(stripe.Nodes)
+	updated.Version++
+
+	used := make(map[uint64]bool)
+	for i, node := range stripe.Nodes {
+		if !slices.Contains(lost, i) {
+			used[node] = true
+		}
+	}
+
+	var ownership *store.Ownership
+	if own := stripe.Index(uint64(serverId)); len(own) > 0 {
+		ownership, _ = chunkStore.Ownership(stripe.Shards[own[0]])
+	}
+
+	candidates := store.Placement(stripe.ID(), nodeCount, nodeCount)
+	for _, i := range lost {
+		replacement := uint64(serverId)
+		for _, candidate := range candidates {
+			if !used[candidate] && nodeAlive(candidate) {
+				replacement = candidate
+				break
+			}
+		}
+		used[replacement] = true
+		updated.Nodes[i] = replacement
+
+		nodeLog.Info("Moving shard", "stripe", fmt.Sprintf("%x", stripe.ID()), "shard", i, "lost_node", stripe.Nodes[i], "shard_node", replacement)
+		sendRepair(replacement, &store.Request{ID: stripe.Shards[i], Data: shards[i], Stripe: &updated, Shard: i, Repair: true, Ownership: ownership}, nodeCount)
+	}
+
+	for node := range used {
+		sendRepair(node, &store.Request{ID: stripe.ID(), Stripe: &updated, Repair: true}, nodeCount)
+	}
+	return nil
+}
+
+func sendRepair(node uint64, req *store.Request, nodeCount int) {
+	req.Placed = true
+	content, err := req.Bytes()
+	if err != nil {
+		nodeLog.Error("Encoding repair request", "err", err)
+		return
+	}
+
+	msg := &message.Message{
+		Type:         message.STORE_PUT,
+		From:         uint64(serverId),
+		ToNode:       node,
+		ID:           utils.GenerateRandomId(),
+		Intermediate: -1,
+		Content:      content,
+	}
+
+	if node == uint64(serverId) {
+		handleStoreRequest(msg, nodeCount)
+		return
+	}
+	relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+}
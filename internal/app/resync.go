@@ -0,0 +1,346 @@
+package app
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/ledger"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+var RetransmitTimeout = 2 * time.Second
+var RetransmitAttempts = 3
+var MaxPendingBlocks = 256
+
+type RetransmitRequest struct {
+	First, Last int
+}
+
+type ResyncRequest struct {
+	Locator []structs.BlockRef
+}
+
+type ResyncResponse struct {
+	Point, Last int
+}
+
+type gapState struct {
+	pending   map[int]*structs.Block
+	requested time.Time
+	attempts  int
+	resyncing time.Time
+}
+
+func (c *TrustClient) gapFor(peer uint64) *gapState {
+	gap, ok := c.gaps[peer]
+	if !ok {
+		gap = &gapState{pending: make(map[int]*structs.Block)}
+		c.gaps[peer] = gap
+	}
+	return gap
+}
+
+func (g *gapState) firstPending() int {
+	first := -1
+	for id := range g.pending {
+		if first < 0 || id < first {
+			first = id
+		}
+	}
+	return first
+}
+
+func (c *TrustClient) sendControl(msgType uint8, peer uint64, v any) error {
+	key, cert := c.peerKey(peer), c.peerCert(peer)
+	if key == nil || cert == nil {
+		return fmt.Errorf("no session with %d", peer)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+
+	encrypted, err := crypto.EncryptMessageAES(buf.Bytes(), key)
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.newEnvelope(msgType, peer, encrypted)
+	if err != nil {
+		return err
+	}
+	return c.dispatch(msg, cert)
+}
+
+func (c *TrustClient) openControl(msg *message.Message, v any) bool {
+	if !c.verifyEnvelope(msg, c.peerCert(msg.From)) || c.peerKey(msg.From) == nil {
+		return false
+	}
+
+	content, err := crypto.DecryptMessageAES(msg.Content, c.peerKey(msg.From))
+	if err != nil {
+		c.logger.Warn("Decrypting control message", append(messageAttrs(msg), "err", err)...)
+		return false
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(v); err != nil {
+		c.logger.Warn("Decoding control message", append(messageAttrs(msg), "err", err)...)
+		return false
+	}
+	return true
+}
+
+func appendReceived(chain *structs.Blockchain, block *structs.Block) error {
+	if err := chain.AddBlock(block); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(chain.Tree().Root(), block.ChainRoot) {
+		chain.Truncate(block.ID - 1)
+		return &structs.ChainError{Err: structs.ErrBadRoot, ID: block.ID, Expected: block.ID}
+	}
+	return nil
+}
+
+func runSends(sends []func()) {
+	for _, send := range sends {
+		if send != nil {
+			send()
+		}
+	}
+}
+
+func (c *TrustClient) receiveBlock(peer uint64, block *structs.Block) []*structs.Block {
+	c.chainMu.Lock()
+	accepted, sends := c.acceptBlock(peer, block)
+	c.chainMu.Unlock()
+
+	for _, b := range accepted {
+		c.record(peer, ledger.Received, b)
+	}
+	runSends(sends)
+	return accepted
+}
+
+func (c *TrustClient) acceptBlock(peer uint64, block *structs.Block) ([]*structs.Block, []func()) {
+	chain := c.received[peer]
+	if chain == nil {
+		chain = structs.NewBlockchain()
+		c.received[peer] = chain
+	}
+
+	err := appendReceived(chain, block)
+	if err == nil {
+		return c.drainPending(peer, chain, []*structs.Block{block})
+	}
+
+	expected := chain.Last().ID + 1
+	switch {
+	case errors.Is(err, structs.ErrGap):
+		return nil, []func(){c.bufferBlock(peer, chain, block, err)}
+	case errors.Is(err, structs.ErrReorder):
+		c.emit(Event{Type: EventReplay, Peer: peer, First: block.ID, Last: block.ID, Err: err})
+		return nil, nil
+	case errors.Is(err, structs.ErrFork):
+		c.emit(Event{Type: EventFork, Peer: peer, First: block.ID, Last: expected, Err: err})
+	default:
+		c.emit(Event{Type: EventBadBlock, Peer: peer, First: block.ID, Last: block.ID, Err: err})
+	}
+	return nil, []func(){c.requestResync(peer)}
+}
+
+func (c *TrustClient) drainPending(peer uint64, chain *structs.Blockchain, accepted []*structs.Block) ([]*structs.Block, []func()) {
+	gap, ok := c.gaps[peer]
+	if !ok {
+		return accepted, nil
+	}
+
+	for {
+		next, ok := gap.pending[chain.Last().ID+1]
+		if !ok {
+			break
+		}
+		delete(gap.pending, next.ID)
+
+		if err := appendReceived(chain, next); err != nil {
+			c.emit(Event{Type: EventBadBlock, Peer: peer, First: next.ID, Last: next.ID, Err: err})
+			return accepted, []func(){c.requestResync(peer)}
+		}
+		accepted = append(accepted, next)
+	}
+
+	for id := range gap.pending {
+		if id <= chain.Last().ID {
+			delete(gap.pending, id)
+		}
+	}
+
+	if len(gap.pending) == 0 {
+		if gap.attempts > 0 {
+			c.emit(Event{Type: EventRecovered, Peer: peer, First: chain.Last().ID, Last: chain.Last().ID})
+		}
+		delete(c.gaps, peer)
+		return accepted, nil
+	}
+
+	return accepted, []func(){c.requestRetransmit(peer, chain.Last().ID+1, gap.firstPending()-1)}
+}
+
+func (c *TrustClient) bufferBlock(peer uint64, chain *structs.Blockchain, block *structs.Block, err error) func() {
+	gap := c.gapFor(peer)
+	if len(gap.pending) >= MaxPendingBlocks {
+		return c.requestResync(peer)
+	}
+
+	expected := chain.Last().ID + 1
+	gap.pending[block.ID] = block
+	c.emit(Event{Type: EventGap, Peer: peer, First: expected, Last: block.ID - 1, Err: err})
+	return c.requestRetransmit(peer, expected, gap.firstPending()-1)
+}
+
+// requestRetransmit and requestResync update the gap state and return the
+// send, which callers run after releasing chainMu.
+func (c *TrustClient) requestRetransmit(peer uint64, first, last int) func() {
+	gap := c.gapFor(peer)
+	if time.Since(gap.requested) < RetransmitTimeout {
+		return nil
+	}
+	if gap.attempts >= RetransmitAttempts {
+		return c.requestResync(peer)
+	}
+
+	gap.requested = time.Now()
+	gap.attempts++
+	return func() {
+		err := c.sendControl(message.BLOCK_REQUEST, peer, &RetransmitRequest{First: first, Last: last})
+		c.emit(Event{Type: EventRetransmitRequest, Peer: peer, First: first, Last: last, Err: err})
+	}
+}
+
+func (c *TrustClient) requestResync(peer uint64) func() {
+	gap := c.gapFor(peer)
+	if time.Since(gap.resyncing) < RetransmitTimeout {
+		return nil
+	}
+	gap.resyncing = time.Now()
+
+	chain := c.received[peer]
+	if chain == nil {
+		chain = structs.NewBlockchain()
+	}
+	req := &ResyncRequest{Locator: chain.Locator()}
+	last := chain.Last().ID
+
+	return func() {
+		if err := c.sendControl(message.RESYNC_REQUEST, peer, req); err != nil {
+			c.emit(Event{Type: EventResync, Peer: peer, First: last, Last: last, Err: err})
+		}
+	}
+}
+
+func (c *TrustClient) sentBlocks(peer uint64, first, last int) []*structs.Block {
+	c.chainMu.Lock()
+	defer c.chainMu.Unlock()
+
+	chain := c.blockchains[peer]
+	if chain == nil {
+		return nil
+	}
+
+	first = max(first, 1)
+	last = min(last, chain.Last().ID)
+	if first > last {
+		return nil
+	}
+	return append([]*structs.Block{}, chain.Blocks[first:last+1]...)
+}
+
+func (c *TrustClient) retransmit(peer uint64, first, last int) {
+	blocks := c.sentBlocks(peer, first, last)
+	if len(blocks) == 0 {
+		c.emit(Event{Type: EventRetransmit, Peer: peer, First: first, Last: last, Err: fmt.Errorf("blocks %d..%d were never sent", first, last)})
+		return
+	}
+
+	for _, block := range blocks {
+		content, err := block.Bytes()
+		if err == nil {
+			err = c.sendData(content, peer, c.peerKey(peer), c.peerCert(peer))
+		}
+		if err != nil {
+			c.emit(Event{Type: EventRetransmit, Peer: peer, First: block.ID, Last: last, Err: err})
+			return
+		}
+	}
+	c.emit(Event{Type: EventRetransmit, Peer: peer, First: blocks[0].ID, Last: blocks[len(blocks)-1].ID})
+}
+
+func (c *TrustClient) handleRetransmitRequest(msg *message.Message) {
+	var req RetransmitRequest
+	if !c.openControl(msg, &req) {
+		return
+	}
+	c.retransmit(msg.From, req.First, req.Last)
+}
+
+func (c *TrustClient) handleResyncRequest(msg *message.Message) {
+	var req ResyncRequest
+	if !c.openControl(msg, &req) {
+		return
+	}
+
+	c.chainMu.Lock()
+	chain := c.blockchains[msg.From]
+	point, last := 0, 0
+	if chain != nil {
+		point = max(chain.FindFork(req.Locator), 0)
+		last = chain.Last().ID
+	}
+	c.chainMu.Unlock()
+
+	resp := &ResyncResponse{Point: point, Last: last}
+	if err := c.sendControl(message.RESYNC, msg.From, resp); err != nil {
+		c.emit(Event{Type: EventResync, Peer: msg.From, First: point, Last: last, Err: err})
+		return
+	}
+	c.emit(Event{Type: EventResync, Peer: msg.From, First: point, Last: last})
+
+	if point < last {
+		c.retransmit(msg.From, point+1, last)
+	}
+}
+
+func (c *TrustClient) handleResync(msg *message.Message) {
+	var resp ResyncResponse
+	if !c.openControl(msg, &resp) {
+		return
+	}
+
+	c.chainMu.Lock()
+	chain := c.received[msg.From]
+	if chain == nil {
+		c.chainMu.Unlock()
+		return
+	}
+
+	var kept []*structs.Block
+	truncated := resp.Point < chain.Last().ID
+	if truncated {
+		chain.Truncate(resp.Point)
+		kept = append(kept, chain.Blocks[1:]...)
+		c.forgetHeads(msg.From, ledger.Received)
+	}
+	delete(c.gaps, msg.From)
+	c.chainMu.Unlock()
+
+	if truncated {
+		c.restartLedgerSession(msg.From, ledger.Received, kept)
+	}
+	c.emit(Event{Type: EventResync, Peer: msg.From, First: resp.Point, Last: resp.Last})
+}
@@ -1,16 +1,25 @@
 package app
 
 import (
+	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jenyaftw/trust/internal/pkg/capability"
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
 	"github.com/jenyaftw/trust/internal/pkg/flags"
 	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/ratelimit"
+	"github.com/jenyaftw/trust/internal/pkg/store"
+	"github.com/jenyaftw/trust/internal/pkg/transparency"
 	"github.com/jenyaftw/trust/internal/pkg/utils"
 )
 
@@ -18,14 +27,55 @@ var serverId int
 var clients = make(map[uint64]*tls.Conn)
 var peers = make(map[uint64]*tls.Conn)
 var clientNode = make(map[uint64]uint64)
+var revocations *crypto.RevocationStore
+var nodeRenewer *CertificateRenewer
+var nodeRoots *x509.CertPool
 
-func ListenServer(flags *flags.ServerFlags, config *tls.Config) {
+func ListenServer(flags *flags.ServerFlags, config *tls.Config, revocationStore *crypto.RevocationStore, renewer *CertificateRenewer) {
 	serverId = flags.NodeId
-	fmt.Println("Current server ID:", serverId)
+	revocations = revocationStore
+	nodeRenewer = renewer
+	nodeRoots = config.RootCAs
+	setNodeCertificate(uint64(serverId), renewer.Certificate().Certificate)
+	renewer.OnRenew = announceNodeCertificate
+	nodeLog = slog.With("component", "server", "node", serverId)
+	nodeLog.Info("Server starting", "host", flags.Host, "port", flags.Port)
+
+	if flags.Log != "" {
+		var err error
+		transparencyLog, err = transparency.Open(flags.Log, uint64(serverId))
+		if err != nil {
+			nodeLog.Error("Opening transparency log", "dir", flags.Log, "err", err)
+			return
+		}
+		defer transparencyLog.Close()
+		nodeLog.Info("Serving transparency log", "dir", flags.Log)
+	}
+
+	clientLimiter = ratelimit.NewLimiter(flags.ClientRate, flags.ClientBurst)
+	peerLimiter = ratelimit.NewLimiter(flags.PeerRate, flags.PeerBurst)
+	dailyQuota = ratelimit.NewQuota(flags.Quota)
+
+	storeReplicas = flags.Replicas
+	if flags.Store != "" {
+		var err error
+		chunkStore, err = store.Open(flags.Store)
+		if err != nil {
+			nodeLog.Error("Opening chunk store", "dir", flags.Store, "err", err)
+			return
+		}
+		capRevocations, err = capability.OpenRevocationList(filepath.Join(flags.Store, capability.RevocationFile))
+		if err != nil {
+			nodeLog.Error("Opening capability revocations", "dir", flags.Store, "err", err)
+			return
+		}
+		nodeLog.Info("Storing chunks", "dir", flags.Store)
+		go repairStripes(flags.NodeCount)
+	}
 
 	ln, err := tls.Listen("tcp", fmt.Sprintf("%s:%s", flags.Host, flags.Port), config)
 	if err != nil {
-		log.Println(err)
+		nodeLog.Error("Listening", "err", err)
 		return
 	}
 	defer ln.Close()
@@ -42,7 +92,7 @@ func ListenServer(flags *flags.ServerFlags, config *tls.Config) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println(err)
+			nodeLog.Warn("Accepting connection", "err", err)
 			continue
 		}
 		go handleConnection(conn.(*tls.Conn), flags.NodeCount, flags.BufferSize)
@@ -50,9 +100,22 @@ func ListenServer(flags *flags.ServerFlags, config *tls.Config) {
 }
 
 func joinPeer(peer string, config *tls.Config, nodeCount int, bufferSize int) {
+	config = config.Clone()
+	if serverName, addr, ok := strings.Cut(peer, "@"); ok {
+		config.ServerName = serverName
+		peer = addr
+	}
+
 	conn, err := tls.Dial("tcp", peer, config)
 	if err != nil {
-		log.Fatal(err)
+		nodeLog.Error("Joining peer", "peer", peer, "err", err)
+		os.Exit(1)
+	}
+
+	peerCerts := conn.ConnectionState().PeerCertificates
+	if role := crypto.GetCertificateRole(peerCerts[0]); role != crypto.RoleNode {
+		nodeLog.Warn("Peer presented a certificate of another role", "peer", peer, "role", role.String(), "subject", peerCerts[0].Subject.CommonName)
+		conn.Close()
 		return
 	}
 
@@ -60,109 +123,200 @@ func joinPeer(peer string, config *tls.Config, nodeCount int, bufferSize int) {
 }
 
 func processMessageRelay(msg *message.Message, nodeCount int) uint64 {
-	node := clientNode[msg.To]
+	msg.ToNode = clientNode[msg.To]
+	return processNodeRelay(msg, nodeCount)
+}
+
+func processNodeRelay(msg *message.Message, nodeCount int) uint64 {
 	msg.FromNode = uint64(serverId)
-	msg.ToNode = node
 
 	bitCount := utils.GetBitCount(nodeCount - 1)
 	allMask, _, _ := utils.GetMasks(bitCount)
-	fmt.Println("All mask:", strconv.FormatInt(int64(allMask), 2))
-	fmt.Println("From node:", strconv.FormatInt(int64(msg.FromNode), 2), "=", msg.FromNode)
-	fmt.Println("To node:", strconv.FormatInt(int64(msg.ToNode), 2), "=", msg.ToNode)
-	fmt.Println("Intermediate:", strconv.FormatInt(int64(msg.Intermediate), 2), "=", msg.Intermediate)
 	if msg.Intermediate == -1 {
 		msg.Intermediate = int64(msg.ToNode)
 	}
-	fmt.Println("Intermediate:", strconv.FormatInt(int64(msg.Intermediate), 2), "=", msg.Intermediate)
+	intermediate := msg.Intermediate
 
 	shiftFrom := (uint64(serverId) << 1) & uint64(allMask)
-	fmt.Println("Shift from:", strconv.FormatInt(int64(shiftFrom), 2), "=", shiftFrom)
-
 	if msg.Intermediate != 0 {
 		firstBit := utils.GetFirstBit(int(msg.Intermediate), nodeCount-1)
-		fmt.Println("First bit:", strconv.FormatInt(int64(firstBit), 2), "=", firstBit)
-
 		if firstBit == 1 {
 			shiftFrom |= 1
 		}
-		fmt.Println("New shift from (next node):", strconv.FormatInt(int64(shiftFrom), 2), "=", shiftFrom)
 
 		newIntermediate := (uint64(msg.Intermediate) << 1) & uint64(allMask)
 		msg.Intermediate = int64(newIntermediate)
-		fmt.Println("New intermediate:", strconv.FormatInt(int64(newIntermediate), 2), "=", newIntermediate)
-		fmt.Println()
+	}
+
+	if tracing(nodeLog) {
+		traceMessage(nodeLog, "Route step", msg,
+			"mask", strconv.FormatInt(int64(allMask), 2),
+			"to_node", strconv.FormatInt(int64(msg.ToNode), 2),
+			"intermediate", strconv.FormatInt(intermediate, 2),
+			"next_intermediate", strconv.FormatInt(msg.Intermediate, 2),
+			"next_node", strconv.FormatInt(int64(shiftFrom), 2))
 	}
 
 	if shiftFrom == uint64(serverId) {
-		return processMessageRelay(msg, nodeCount)
+		return processNodeRelay(msg, nodeCount)
 	}
 
 	return shiftFrom
 }
 
+func sendRevocationList(conn *tls.Conn) {
+	crl := revocations.Bytes()
+	if crl == nil {
+		return
+	}
+
+	msg := &message.Message{
+		Type:    message.REVOCATION_LIST,
+		From:    uint64(serverId),
+		Content: crl,
+	}
+	if err := msg.Send(conn); err != nil {
+		nodeLog.Warn("Sending revocation list", "err", err)
+	}
+}
+
+func disconnectRevoked(conns map[uint64]*tls.Conn) {
+	for id, conn := range conns {
+		if err := revocations.Check(conn.ConnectionState().PeerCertificates); err != nil {
+			nodeLog.Info("Disconnecting revoked peer", "id", id, "err", err)
+			conn.Close()
+		}
+	}
+}
+
+func isAllowedForRole(msgType uint8, role crypto.Role) bool {
+	switch msgType {
+	case message.PEER_ID, message.I_HAVE_CLIENT, message.NODE_CERT, message.ONION_DELIVER, message.SHARD_GET, message.SHARD_DATA, message.THROTTLE:
+		return role == crypto.RoleNode
+	case message.REGISTER_CLIENT, message.NODE_DIRECTORY:
+		return role == crypto.RoleClient
+	}
+	return true
+}
+
+func isAnonymousMessage(msgType uint8) bool {
+	switch msgType {
+	case message.REGISTER_CLIENT, message.REVOCATION_LIST, message.PING, message.ONION:
+		return true
+	}
+	return false
+}
+
 func handleConnection(conn *tls.Conn, nodeCount int, bufferSize int) {
 	defer conn.Close()
 
+	if err := conn.Handshake(); err != nil {
+		nodeLog.Warn("TLS handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	if err := crypto.CheckALPN(conn); err != nil {
+		nodeLog.Warn("Rejecting connection", "remote", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	peerCerts := conn.ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		nodeLog.Warn("Connection without peer certificate", "remote", conn.RemoteAddr().String())
+		return
+	}
+
+	role := crypto.GetCertificateRole(peerCerts[0])
+	logger := nodeLog.With("peer", peerCerts[0].Subject.CommonName, "role", role.String())
+	switch role {
+	case crypto.RoleNode, crypto.RoleClient:
+		logger.Info("Connected", "remote", conn.RemoteAddr().String())
+	default:
+		logger.Warn("Rejecting connection with certificate of another role", "remote", conn.RemoteAddr().String())
+		return
+	}
+
 	msg := &message.Message{
 		Type: message.PEER_ID,
 		From: uint64(serverId),
 	}
 	msg.Send(conn)
 
+	limits := &linkLimits{conn: conn, role: role, cert: peerCerts[0]}
+	defer limits.close()
+	defer stopPeerWriters(conn)
+
+	reader := bufio.NewReaderSize(conn, bufferSize)
 	for {
-		size := 0
-		n := 0
-		buf := make([]byte, 0, bufferSize)
-		for {
-			if size != 0 && n >= size {
-				break
-			}
+		msg, err := message.ReadMessage(reader)
+		if err != nil {
+			logger.Info("Disconnected", "err", err)
+			return
+		}
 
-			newBuf := make([]byte, bufferSize)
-			bytesRead, err := conn.Read(newBuf)
-			if err != nil {
-				log.Println(n, err)
-				return
-			}
+		traceMessage(logger, "Received message", msg)
+		if !isAllowedForRole(msg.Type, role) {
+			logger.Warn("Rejecting message not allowed for role", messageAttrs(msg)...)
+			return
+		}
 
-			if size == 0 {
-				size = int(message.ReadSize(newBuf[:4]))
-			}
+		if role == crypto.RoleClient && !isAnonymousMessage(msg.Type) && (!limits.linked || msg.From != limits.id) {
+			logger.Warn("Rejecting message from a sender other than the registered client", append(messageAttrs(msg), "client", limits.id)...)
+			continue
+		}
 
-			buf = append(buf, newBuf...)
-			n += bytesRead
+		if role == crypto.RoleClient && senderBlocked(msg, peerCerts[0]) {
+			logger.Info("Dropping message from blocked sender", messageAttrs(msg)...)
+			continue
 		}
 
-		msg, err := message.MessageFromBytes(buf[4:n])
-		if err != nil {
-			log.Println(err)
+		if !limits.admit(msg, nodeCount) {
 			continue
 		}
 
-		fmt.Println("Received message:", msg.Type, "from", msg.From, "to", msg.To)
 		switch msg.Type {
 		case message.PEER_ID:
-			fmt.Println("Peer ID:", msg.From)
+			logger.Info("Peer linked", "peer_node", msg.From)
 			peers[msg.From] = conn
+			startPeerWriter(msg.From, conn)
+			limits.id, limits.linked = msg.From, true
+			sendRevocationList(conn)
+			sendNodeCertificates(conn)
+			sendCapabilityRevocations(conn)
+			sendBlockLists(conn)
 		case message.PING:
-			fmt.Println("Received ping")
+			if role == crypto.RoleNode {
+				handlePing(msg, nodeCount)
+				continue
+			}
+
+			logger.Debug("Received ping")
 			msg := &message.Message{
 				Type: message.PONG,
 				From: uint64(serverId),
 			}
 			msg.Send(conn)
 		case message.PONG:
-			fmt.Println("Received pong")
+			if role == crypto.RoleNode {
+				handlePong(msg, nodeCount)
+			}
 		case message.REGISTER_CLIENT:
-			fmt.Println("Registering new client")
+			if limits.linked {
+				logger.Warn("Rejecting repeated registration", "client", limits.id)
+				continue
+			}
+
 			clientId := utils.GenerateRandomId()
+			logger.Info("Registered client", "client", clientId)
 			clients[clientId] = conn
+			limits.id, limits.linked = clientId, true
 			msg := &message.Message{
 				Type: message.REGISTER_CLIENT_RESP,
 				From: uint64(serverId),
 				To:   clientId,
 			}
 			msg.Send(conn)
+			sendRevocationList(conn)
 
 			msg = &message.Message{
 				Type:        message.I_HAVE_CLIENT,
@@ -172,7 +326,7 @@ func handleConnection(conn *tls.Conn, nodeCount int, bufferSize int) {
 			}
 			bytes, err := msg.Bytes()
 			if err != nil {
-				log.Println(err)
+				logger.Error("Encoding client announcement", "err", err)
 			}
 
 			for id, peer := range peers {
@@ -185,13 +339,13 @@ func handleConnection(conn *tls.Conn, nodeCount int, bufferSize int) {
 				continue
 			}
 
-			fmt.Printf("I'm %d, I know that %d has client %d\n", serverId, msg.From, msg.To)
+			nodeLog.Debug("Learned client location", "client", msg.To, "client_node", msg.From)
 			clientNode[msg.To] = msg.From
 
 			msg.AlreadyBeen = append(msg.AlreadyBeen, uint64(serverId))
 			bytes, err := msg.Bytes()
 			if err != nil {
-				log.Println(err)
+				logger.Error("Encoding client announcement", "err", err)
 			}
 
 			for id, peer := range peers {
@@ -200,66 +354,67 @@ func handleConnection(conn *tls.Conn, nodeCount int, bufferSize int) {
 				}
 			}
 			continue
-		case message.GET_CLIENT_CERT:
-			fmt.Println("Received request for client certificate")
-			clientConn, ok := clients[msg.To]
-			if !ok {
-				nextNode := processMessageRelay(msg, nodeCount)
-
-				peer := peers[nextNode]
-				fmt.Println("Relaying to:", nextNode)
-				if err := msg.Send(peer); err != nil {
-					log.Println(err)
-				}
-
+		case message.REVOCATION_LIST:
+			updated, err := revocations.Update(msg.Content)
+			if err != nil {
+				logger.Warn("Rejecting revocation list", "err", err)
 				continue
 			}
-			clientConn.Write(buf[:n])
-		case message.DATA:
-			fmt.Println("Received message data")
-			clientConn, ok := clients[msg.To]
-			if !ok {
-				nextNode := processMessageRelay(msg, nodeCount)
-
-				peer := peers[nextNode]
-				fmt.Println("Relaying to:", nextNode)
-				if err := msg.Send(peer); err != nil {
-					log.Println(err)
-				}
-
+			if !updated {
 				continue
 			}
-			clientConn.Write(buf[:n])
-		case message.AES_KEY:
-			fmt.Println("Received AES key")
-			clientConn, ok := clients[msg.To]
-			if !ok {
-				nextNode := processMessageRelay(msg, nodeCount)
 
-				peer := peers[nextNode]
-				fmt.Println("Relaying to:", nextNode)
-				if err := msg.Send(peer); err != nil {
-					log.Println(err)
-				}
+			nodeLog.Info("Revocation list updated")
+			disconnectRevoked(clients)
+			disconnectRevoked(peers)
 
-				continue
+			for _, peer := range peers {
+				sendRevocationList(peer)
+			}
+			for _, client := range clients {
+				sendRevocationList(client)
 			}
-			clientConn.Write(buf[:n])
-		case message.GET_CLIENT_CERT_RESP:
-			fmt.Println("Received request for client certificate response")
+		case message.GET_CLIENT_CERT, message.GET_CLIENT_CERT_RESP, message.AES_KEY, message.DATA, message.TREE_HEAD, message.ONION_DELIVER,
+			message.BLOCK_REQUEST, message.RESYNC_REQUEST, message.RESYNC, message.CREDIT, message.STREAM, message.LOG_GOSSIP:
 			clientConn, ok := clients[msg.To]
 			if !ok {
-				nextNode := processMessageRelay(msg, nodeCount)
-
-				peer := peers[nextNode]
-				fmt.Println("Relaying to:", nextNode)
-				if err := msg.Send(peer); err != nil {
-					log.Println(err)
-				}
+				relayToNode(msg, processMessageRelay(msg, nodeCount), nodeCount)
+				continue
+			}
+			msg.Send(clientConn)
+		case message.NODE_CERT:
+			handleNodeCertificate(msg)
+		case message.NODE_DIRECTORY:
+			sendNodeDirectory(conn)
+		case message.ONION:
+			if msg.ToNode == uint64(serverId) {
+				peelOnion(msg, nodeCount)
+				continue
+			}
 
+			relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+		case message.LOG_SUBMIT, message.LOG_HEAD_REQUEST:
+			handleLogRequest(msg, nodeCount)
+		case message.LOG_RECEIPT, message.LOG_HEAD:
+			deliverToClient(msg, nodeCount)
+		case message.STORE_PUT, message.STORE_GET:
+			if role == crypto.RoleClient {
+				handleClientStoreRequest(msg, peerCerts[0], nodeCount)
 				continue
 			}
-			clientConn.Write(buf[:n])
+			handleStoreRequest(msg, nodeCount)
+		case message.STORE_ACK, message.STORE_DATA, message.STORE_MISSING, message.STORE_DENIED:
+			deliverToClient(msg, nodeCount)
+		case message.CAP_REVOKE:
+			handleCapabilityRevocation(msg)
+		case message.BLOCK:
+			handleBlockList(msg, conn, role == crypto.RoleClient)
+		case message.THROTTLE:
+			deliverToClient(msg, nodeCount)
+		case message.SHARD_GET:
+			handleShardRequest(msg, nodeCount)
+		case message.SHARD_DATA:
+			handleShardData(msg, nodeCount)
 		}
 	}
 }
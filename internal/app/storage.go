@@ -0,0 +1,455 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/capability"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/store"
+	"github.com/jenyaftw/trust/internal/pkg/utils"
+)
+
+var chunkStore *store.Store
+var storeReplicas int
+
+var StoreRequestTimeout = 10 * time.Second
+var StoreAttempts = 3
+var StoreParallelism = 8
+
+func handleStoreRequest(msg *message.Message, nodeCount int) {
+	if msg.ToNode != uint64(serverId) {
+		relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+		return
+	}
+
+	req, err := store.DecodeRequest(msg.Content)
+	if err != nil {
+		nodeLog.Warn("Decoding store request", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	if !req.Placed {
+		placeStoreRequest(msg, req, nodeCount)
+		return
+	}
+
+	resp := &store.Response{ID: req.ID, Replicas: storeReplicas}
+	replyType := message.STORE_MISSING
+	switch {
+	case chunkStore == nil:
+		nodeLog.Info("Dropping store request: this node does not store chunks", messageAttrs(msg)...)
+	case msg.Type == message.STORE_PUT:
+		if err := claimChunk(req); err != nil {
+			nodeLog.Warn("Recording owner", append(messageAttrs(msg), "requester", req.Requester, "chunk", fmt.Sprintf("%x", req.ID), "err", err)...)
+			if errors.Is(err, store.ErrOwned) {
+				replyType = message.STORE_DENIED
+			}
+			break
+		}
+
+		if req.Stripe != nil {
+			if err := putShard(req); err != nil {
+				nodeLog.Warn("Storing shard", append(messageAttrs(msg), "shard", req.Shard, "err", err)...)
+				break
+			}
+		} else if err := chunkStore.Put(req.ID, req.Data, req.Manifest); err != nil {
+			nodeLog.Warn("Storing chunk", append(messageAttrs(msg), "chunk", fmt.Sprintf("%x", req.ID), "err", err)...)
+			break
+		}
+		replyType = message.STORE_ACK
+	case msg.Type == message.STORE_GET:
+		if ownership, err := chunkStore.Ownership(req.ID); err == nil {
+			if err := authorizeFetch(req, ownership); err != nil {
+				nodeLog.Info("Denying chunk access", append(messageAttrs(msg), "requester", req.Requester, "chunk", fmt.Sprintf("%x", req.ID), "err", err)...)
+				replyType = message.STORE_DENIED
+				break
+			}
+		}
+
+		if req.Stripe != nil {
+			if stripe, err := chunkStore.GetStripe(req.Stripe.ID()); err == nil {
+				resp.Stripe = stripe
+			}
+		}
+
+		data, err := chunkStore.Get(req.ID)
+		if err != nil {
+			break
+		}
+		resp.Data = data
+		replyType = message.STORE_DATA
+	}
+
+	if req.Repair {
+		return
+	}
+	sendStoreResponse(replyType, msg, resp, nodeCount)
+}
+
+func claimChunk(req *store.Request) error {
+	switch {
+	case req.Repair && req.Ownership != nil:
+		return chunkStore.AddOwnership(req.ID, req.Ownership)
+	case req.Requester == "" || req.Data == nil:
+		return nil
+	case req.Manifest:
+		return chunkStore.Claim(req.ID, store.Grant{Owner: req.Requester, File: req.ID}, req.Private, true)
+	}
+	return chunkStore.Claim(req.ID, store.Grant{Owner: req.Requester, File: req.File}, req.Private, false)
+}
+
+func putShard(req *store.Request) error {
+	if _, err := req.Stripe.Code(); err != nil {
+		return err
+	}
+
+	if req.Data != nil {
+		if req.Shard < 0 || req.Shard >= req.Stripe.N || !bytes.Equal(req.Stripe.Shards[req.Shard], req.ID) {
+			return fmt.Errorf("shard %x is not part of stripe %x", req.ID, req.Stripe.ID())
+		}
+		if err := chunkStore.Put(req.ID, req.Data, false); err != nil {
+			return err
+		}
+	}
+	return chunkStore.PutStripe(req.Stripe)
+}
+
+func placeStoreRequest(msg *message.Message, req *store.Request, nodeCount int) {
+	var targets []uint64
+	if req.Stripe != nil {
+		targets = placeShard(msg, req, nodeCount)
+	} else {
+		targets = store.Placement(req.ID, nodeCount, storeReplicas)
+		if msg.Type == message.STORE_GET {
+			if req.Replica >= len(targets) {
+				targets = nil
+			} else {
+				targets = targets[req.Replica : req.Replica+1]
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		sendStoreResponse(message.STORE_MISSING, msg, &store.Response{ID: req.ID, Replicas: storeReplicas, Nodes: nodeCount}, nodeCount)
+		return
+	}
+
+	req.Placed = true
+	req.Repair = false
+	content, err := req.Bytes()
+	if err != nil {
+		nodeLog.Error("Encoding store request", "err", err)
+		return
+	}
+
+	for _, target := range targets {
+		forward := &message.Message{
+			Type:         msg.Type,
+			From:         msg.From,
+			ID:           msg.ID,
+			ToNode:       target,
+			Intermediate: -1,
+			Content:      content,
+		}
+
+		if target == uint64(serverId) {
+			handleStoreRequest(forward, nodeCount)
+			continue
+		}
+		relayToNode(forward, processNodeRelay(forward, nodeCount), nodeCount)
+	}
+}
+
+func placeShard(msg *message.Message, req *store.Request, nodeCount int) []uint64 {
+	if _, err := req.Stripe.Code(); err != nil || req.Shard < 0 || req.Shard >= req.Stripe.N || req.Stripe.N > nodeCount {
+		return nil
+	}
+
+	placement := store.StripePlacement(req.Stripe, nodeCount)
+	if msg.Type == message.STORE_PUT {
+		req.Stripe.Nodes = placement
+		req.Stripe.Version = 0
+	}
+
+	if msg.Type == message.STORE_GET && req.Redirect {
+		if req.Node >= uint64(nodeCount) {
+			return nil
+		}
+		return []uint64{req.Node}
+	}
+	return []uint64{placement[req.Shard]}
+}
+
+func sendStoreResponse(msgType uint8, req *message.Message, resp *store.Response, nodeCount int) {
+	content, err := resp.Bytes()
+	if err != nil {
+		nodeLog.Error("Encoding store response", "err", err)
+		return
+	}
+
+	deliverToClient(&message.Message{
+		Type:         msgType,
+		From:         uint64(serverId),
+		To:           req.From,
+		ID:           req.ID,
+		Intermediate: -1,
+		Content:      content,
+	}, nodeCount)
+}
+
+func (c *TrustClient) storeRequest(msgType uint8, req *store.Request) (*message.Message, *store.Response, error) {
+	content, err := req.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := &message.Message{
+		Type:         msgType,
+		From:         c.clientId,
+		ToNode:       c.serverId,
+		ID:           utils.GenerateRandomId(),
+		Intermediate: -1,
+		Content:      content,
+	}
+
+	reply, err := c.request(msg, StoreRequestTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := store.DecodeResponse(reply.Content)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(resp.ID, req.ID) {
+		return nil, nil, fmt.Errorf("store response for chunk %x, expected %x", resp.ID, req.ID)
+	}
+	return reply, resp, nil
+}
+
+func (c *TrustClient) putChunk(req *store.Request) error {
+	reply, _, err := c.storeRequest(message.STORE_PUT, req)
+	if err != nil {
+		return err
+	}
+	if reply.Type == message.STORE_DENIED {
+		return fmt.Errorf("node %d refused chunk %x: %w", reply.From, req.ID, store.ErrOwned)
+	}
+	if reply.Type != message.STORE_ACK {
+		return fmt.Errorf("node %d did not store chunk %x", reply.From, req.ID)
+	}
+	return nil
+}
+
+func (c *TrustClient) getChunk(id []byte, token *capability.Token, check func([]byte) error) ([]byte, error) {
+	err := store.ErrNotFound
+	for replica, replicas := 0, StoreAttempts; replica < replicas; replica++ {
+		reply, resp, requestErr := c.storeRequest(message.STORE_GET, &store.Request{ID: id, Replica: replica, Capability: token})
+		if requestErr != nil {
+			err = requestErr
+			continue
+		}
+		if reply.Type == message.STORE_DENIED {
+			return nil, capability.ErrDenied
+		}
+		if resp.Replicas > 0 {
+			replicas = resp.Replicas
+		}
+		if reply.Type != message.STORE_DATA {
+			continue
+		}
+
+		if checkErr := check(resp.Data); checkErr != nil {
+			err = fmt.Errorf("node %d returned a bad copy of chunk %x: %v", reply.From, id, checkErr)
+			continue
+		}
+		return resp.Data, nil
+	}
+	return nil, err
+}
+
+func parallel(n int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	slots := make(chan struct{}, StoreParallelism)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if err := fn(i); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+func (c *TrustClient) putStripe(chunk *store.Chunk, file []byte, private bool) (*store.Stripe, error) {
+	stripe, shards, err := store.EncodeStripe(chunk.Data, c.flags.Shards, c.flags.Shards+c.flags.Parity)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, shard := range shards {
+		req := &store.Request{ID: stripe.Shards[i], Data: shard, Stripe: stripe, Shard: i, File: file, Private: private}
+		reply, resp, err := c.storeRequest(message.STORE_PUT, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Nodes > 0 && stripe.N > resp.Nodes {
+			return nil, fmt.Errorf("stripe of %d shards needs %d nodes, the network has %d", stripe.N, stripe.N, resp.Nodes)
+		}
+		if reply.Type == message.STORE_DENIED {
+			return nil, fmt.Errorf("node %d refused shard %d of chunk %x: %w", reply.From, i, chunk.ID, store.ErrOwned)
+		}
+		if reply.Type != message.STORE_ACK {
+			return nil, fmt.Errorf("node %d did not store shard %d of chunk %x", reply.From, i, chunk.ID)
+		}
+	}
+	return stripe, nil
+}
+
+func (c *TrustClient) getStripe(stripe *store.Stripe, id []byte, token *capability.Token) ([]byte, error) {
+	if _, err := stripe.Code(); err != nil {
+		return nil, err
+	}
+
+	shards := make([][]byte, stripe.N)
+	have := 0
+	latest := stripe
+	fetch := func(req *store.Request) {
+		reply, resp, err := c.storeRequest(message.STORE_GET, req)
+		if err != nil {
+			c.logger.Warn("Fetching shard", "chunk", fmt.Sprintf("%x", id), "shard", req.Shard, "err", err)
+			return
+		}
+		if resp.Stripe != nil && resp.Stripe.Version > latest.Version && bytes.Equal(resp.Stripe.ID(), stripe.ID()) {
+			latest = resp.Stripe
+		}
+		if reply.Type == message.STORE_DATA && bytes.Equal(store.ChunkID(resp.Data), req.ID) {
+			shards[req.Shard] = resp.Data
+			have++
+		}
+	}
+
+	for i := 0; i < stripe.N && have < stripe.K; i++ {
+		fetch(&store.Request{ID: stripe.Shards[i], Stripe: stripe, Shard: i, Capability: token})
+	}
+	for i := 0; i < stripe.N && have < stripe.K && latest.Version > 0; i++ {
+		if shards[i] == nil && i < len(latest.Nodes) {
+			fetch(&store.Request{ID: stripe.Shards[i], Stripe: stripe, Shard: i, Redirect: true, Node: latest.Nodes[i], Capability: token})
+		}
+	}
+
+	if have < stripe.K {
+		return nil, fmt.Errorf("only %d of %d shards of chunk %x are available", have, stripe.K, id)
+	}
+
+	chunk, err := store.DecodeStripe(stripe, shards)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(store.ChunkID(chunk), id) {
+		return nil, store.ErrBadChunk
+	}
+	return chunk, nil
+}
+
+func (c *TrustClient) Publish(data []byte) ([]byte, error) {
+	return c.publish(data, false)
+}
+
+func (c *TrustClient) PublishPrivate(data []byte) ([]byte, error) {
+	return c.publish(data, true)
+}
+
+func (c *TrustClient) publish(data []byte, private bool) ([]byte, error) {
+	hash, manifest, chunks, err := store.Split(data)
+	if err != nil {
+		return nil, err
+	}
+
+	file := store.ManifestID(hash)
+	if c.flags.Parity > 0 {
+		manifest.Stripes = make([]*store.Stripe, len(chunks))
+		err = parallel(len(chunks), func(i int) error {
+			stripe, err := c.putStripe(chunks[i], file, private)
+			manifest.Stripes[i] = stripe
+			return err
+		})
+	} else {
+		err = parallel(len(chunks), func(i int) error {
+			return c.putChunk(&store.Request{ID: chunks[i].ID, Data: chunks[i].Data, File: file, Private: private})
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifestChunk, err := store.SealManifest(hash, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.putChunk(&store.Request{ID: manifestChunk.ID, Data: manifestChunk.Data, Manifest: true, Private: private}); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+func (c *TrustClient) Fetch(hash []byte) ([]byte, error) {
+	return c.FetchShared(hash, nil)
+}
+
+func (c *TrustClient) FetchShared(hash []byte, token *capability.Token) ([]byte, error) {
+	var manifest *store.Manifest
+	_, err := c.getChunk(store.ManifestID(hash), token, func(data []byte) error {
+		var err error
+		manifest, err = store.OpenManifest(hash, data)
+		if err == nil && manifest.Stripes != nil && len(manifest.Stripes) != len(manifest.Chunks) {
+			err = fmt.Errorf("manifest lists %d stripes for %d chunks", len(manifest.Stripes), len(manifest.Chunks))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest: %v", err)
+	}
+
+	chunks := make([][]byte, len(manifest.Chunks))
+	err = parallel(len(chunks), func(i int) error {
+		id := manifest.Chunks[i]
+		if manifest.Stripes != nil {
+			chunk, err := c.getStripe(manifest.Stripes[i], id, token)
+			chunks[i] = chunk
+			return err
+		}
+
+		chunk, err := c.getChunk(id, token, func(data []byte) error {
+			if !bytes.Equal(store.ChunkID(data), id) {
+				return store.ErrBadChunk
+			}
+			return nil
+		})
+		chunks[i] = chunk
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Join(hash, manifest, chunks)
+}
@@ -0,0 +1,494 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/utils"
+)
+
+var StreamFrameSize = 16 * 1024
+var StreamBacklog = 16
+var StreamGapTimeout = 10 * time.Second
+
+var ErrStreamReset = errors.New("stream reset by peer")
+
+const (
+	streamOpen uint8 = iota
+	streamData
+	streamFin
+	streamReset
+)
+
+type StreamFrame struct {
+	Stream uint64
+	Seq    uint64
+	Kind   uint8
+	Data   []byte
+}
+
+type streamKey struct {
+	peer uint64
+	id   uint64
+}
+
+type StreamAddr uint64
+
+func (a StreamAddr) Network() string {
+	return "trust"
+}
+
+func (a StreamAddr) String() string {
+	return fmt.Sprint(uint64(a))
+}
+
+type Stream struct {
+	client        *TrustClient
+	peer          uint64
+	id            uint64
+	writeMu       sync.Mutex
+	sendSeq       uint64
+	mu            sync.Mutex
+	wake          chan struct{}
+	chunks        [][]byte
+	nextSeq       uint64
+	pending       map[uint64]*StreamFrame
+	gapSince      time.Time
+	remoteFin     bool
+	writeClosed   bool
+	closed        bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type StreamListener struct {
+	client *TrustClient
+	accept chan *Stream
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *TrustClient) OpenStream(dest uint64) (*Stream, error) {
+	if _, _, err := c.session(dest); err != nil {
+		return nil, err
+	}
+
+	c.streamsMu.Lock()
+	s := c.newStream(dest, utils.GenerateRandomId())
+	c.streamsMu.Unlock()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.send(streamOpen, nil); err != nil {
+		c.removeStream(s)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *TrustClient) Listen() (*StreamListener, error) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+
+	if c.listener != nil {
+		return nil, fmt.Errorf("client %d is already listening for streams", c.clientId)
+	}
+
+	c.listener = &StreamListener{
+		client: c,
+		accept: make(chan *Stream, StreamBacklog),
+		done:   make(chan struct{}),
+	}
+	return c.listener, nil
+}
+
+func (c *TrustClient) newStream(peer uint64, id uint64) *Stream {
+	s := &Stream{
+		client:  c,
+		peer:    peer,
+		id:      id,
+		wake:    make(chan struct{}),
+		pending: make(map[uint64]*StreamFrame),
+	}
+	c.streams[streamKey{peer: peer, id: id}] = s
+	return s
+}
+
+func (c *TrustClient) removeStream(s *Stream) {
+	c.streamsMu.Lock()
+	delete(c.streams, streamKey{peer: s.peer, id: s.id})
+	c.streamsMu.Unlock()
+}
+
+func (c *TrustClient) handleStream(msg *message.Message) {
+	frame := &StreamFrame{}
+	if !c.openControl(msg, frame) {
+		return
+	}
+
+	c.streamsMu.Lock()
+	s, ok := c.streams[streamKey{peer: msg.From, id: frame.Stream}]
+	if !ok && frame.Kind == streamOpen && frame.Seq == 0 && c.listener != nil {
+		s = c.newStream(msg.From, frame.Stream)
+		select {
+		case c.listener.accept <- s:
+			ok = true
+		default:
+			c.logger.Warn("Rejecting stream: backlog is full", "peer", msg.From, "stream", frame.Stream)
+			delete(c.streams, streamKey{peer: msg.From, id: frame.Stream})
+		}
+	}
+	c.streamsMu.Unlock()
+
+	if !ok {
+		if frame.Kind == streamData {
+			c.consumeCredit(msg.From)
+		}
+		if frame.Kind != streamReset {
+			c.resetStream(msg.From, frame.Stream)
+		}
+		return
+	}
+
+	s.receive(frame)
+}
+
+func (c *TrustClient) resetStream(peer uint64, id uint64) {
+	frame := &StreamFrame{Stream: id, Kind: streamReset}
+	if err := c.sendControl(message.STREAM, peer, frame); err != nil {
+		c.logger.Warn("Resetting stream", "peer", peer, "stream", id, "err", err)
+	}
+}
+
+func (c *TrustClient) releaseCredit(peer uint64, frames int) {
+	for range frames {
+		c.consumeCredit(peer)
+	}
+}
+
+func (s *Stream) ID() uint64 {
+	return s.id
+}
+
+func (s *Stream) send(kind uint8, data []byte) error {
+	frame := &StreamFrame{Stream: s.id, Kind: kind, Data: data}
+	if kind != streamReset {
+		frame.Seq = s.sendSeq
+		s.sendSeq++
+	}
+	return s.client.sendControl(message.STREAM, s.peer, frame)
+}
+
+func (s *Stream) receive(frame *StreamFrame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if frame.Kind == streamReset {
+		s.fail(ErrStreamReset)
+		s.client.removeStream(s)
+		return
+	}
+
+	if s.err != nil || frame.Seq < s.nextSeq {
+		if frame.Kind == streamData {
+			go s.client.releaseCredit(s.peer, 1)
+		}
+		return
+	}
+
+	s.pending[frame.Seq] = frame
+	for {
+		next, ok := s.pending[s.nextSeq]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.nextSeq)
+		s.nextSeq++
+
+		switch next.Kind {
+		case streamData:
+			if len(next.Data) == 0 {
+				go s.client.releaseCredit(s.peer, 1)
+				continue
+			}
+			s.chunks = append(s.chunks, next.Data)
+		case streamFin:
+			s.remoteFin = true
+		}
+	}
+
+	if len(s.pending) == 0 {
+		s.gapSince = time.Time{}
+	} else if s.gapSince.IsZero() {
+		s.gapSince = time.Now()
+	}
+	s.signal()
+}
+
+func (s *Stream) signal() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+func (s *Stream) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+
+	frames := len(s.chunks)
+	for _, frame := range s.pending {
+		if frame.Kind == streamData {
+			frames++
+		}
+	}
+	s.chunks = nil
+	s.pending = make(map[uint64]*StreamFrame)
+	s.gapSince = time.Time{}
+	s.signal()
+
+	if frames > 0 {
+		go s.client.releaseCredit(s.peer, frames)
+	}
+}
+
+func (s *Stream) readErr() error {
+	if s.closed {
+		return net.ErrClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if !s.gapSince.IsZero() && time.Since(s.gapSince) >= StreamGapTimeout {
+		s.fail(fmt.Errorf("stream %d: frame %d from %d was lost", s.id, s.nextSeq, s.peer))
+		s.client.removeStream(s)
+		go s.client.resetStream(s.peer, s.id)
+		return s.err
+	}
+	if s.remoteFin {
+		return io.EOF
+	}
+	return nil
+}
+
+func (s *Stream) wait() error {
+	wait := time.Duration(-1)
+	if !s.readDeadline.IsZero() {
+		wait = time.Until(s.readDeadline)
+		if wait <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+	}
+	if !s.gapSince.IsZero() {
+		gap := time.Until(s.gapSince.Add(StreamGapTimeout))
+		if wait < 0 || gap < wait {
+			wait = gap
+		}
+	}
+
+	var timeout <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	wake := s.wake
+	s.mu.Unlock()
+	select {
+	case <-wake:
+	case <-timeout:
+	}
+	s.mu.Lock()
+	return nil
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.chunks) == 0 {
+		if err := s.readErr(); err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		if err := s.wait(); err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.chunks[0])
+	consumed := n == len(s.chunks[0])
+	if consumed {
+		s.chunks = s.chunks[1:]
+	} else {
+		s.chunks[0] = s.chunks[0][n:]
+	}
+	s.mu.Unlock()
+
+	if consumed {
+		s.client.consumeCredit(s.peer)
+	}
+	return n, nil
+}
+
+func (s *Stream) writeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.writeClosed {
+		return net.ErrClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if !s.writeDeadline.IsZero() && !time.Now().Before(s.writeDeadline) {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	n := 0
+	for len(p) > 0 {
+		if err := s.writeErr(); err != nil {
+			return n, err
+		}
+
+		s.mu.Lock()
+		deadline := s.writeDeadline
+		s.mu.Unlock()
+
+		size := min(len(p), StreamFrameSize)
+		if err := s.client.takeCredit(s.peer, deadline); err != nil {
+			return n, err
+		}
+		if err := s.send(streamData, p[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+func (s *Stream) CloseWrite() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	done := s.writeClosed || s.err != nil
+	s.writeClosed = true
+	s.mu.Unlock()
+
+	if done {
+		return nil
+	}
+	return s.send(streamFin, nil)
+}
+
+func (s *Stream) Close() error {
+	err := s.CloseWrite()
+
+	s.mu.Lock()
+	if !s.closed {
+		s.fail(net.ErrClosed)
+		s.closed = true
+	}
+	s.mu.Unlock()
+	s.client.removeStream(s)
+	return err
+}
+
+func (s *Stream) Reset() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	failed := s.err != nil
+	s.fail(net.ErrClosed)
+	s.closed = true
+	s.mu.Unlock()
+	s.client.removeStream(s)
+
+	if failed {
+		return nil
+	}
+	return s.send(streamReset, nil)
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return StreamAddr(s.client.clientId)
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return StreamAddr(s.peer)
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.signal()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.signal()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	return nil
+}
+
+func (l *StreamListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accept:
+		return s, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *StreamListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+
+		l.client.streamsMu.Lock()
+		if l.client.listener == l {
+			l.client.listener = nil
+		}
+		l.client.streamsMu.Unlock()
+
+		for {
+			select {
+			case s := <-l.accept:
+				s.Reset()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *StreamListener) Addr() net.Addr {
+	return StreamAddr(l.client.clientId)
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func testStream() *Stream {
+	client := &TrustClient{
+		streams:     make(map[streamKey]*Stream),
+		owedCredits: make(map[uint64]int),
+		creditWake:  make(chan struct{}),
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	return client.newStream(2, 1)
+}
+
+func dataFrame(seq uint64, data string) *StreamFrame {
+	return &StreamFrame{Stream: 1, Seq: seq, Kind: streamData, Data: []byte(data)}
+}
+
+func finFrame(seq uint64) *StreamFrame {
+	return &StreamFrame{Stream: 1, Seq: seq, Kind: streamFin}
+}
+
+func TestStreamOrdering(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []*StreamFrame
+		want   string
+		err    error
+	}{
+		{"in order", []*StreamFrame{
+			{Stream: 1, Kind: streamOpen}, dataFrame(1, "a"), dataFrame(2, "b"), dataFrame(3, "c"), finFrame(4),
+		}, "abc", io.EOF},
+		{"reversed", []*StreamFrame{
+			finFrame(4), dataFrame(3, "c"), dataFrame(2, "b"), dataFrame(1, "a"), {Stream: 1, Kind: streamOpen},
+		}, "abc", io.EOF},
+		{"shuffled", []*StreamFrame{
+			dataFrame(2, "b"), {Stream: 1, Kind: streamOpen}, finFrame(4), dataFrame(1, "a"), dataFrame(3, "c"),
+		}, "abc", io.EOF},
+		{"duplicates", []*StreamFrame{
+			{Stream: 1, Kind: streamOpen}, dataFrame(1, "a"), dataFrame(1, "a"), dataFrame(2, "b"), dataFrame(1, "x"), finFrame(3),
+		}, "ab", io.EOF},
+		{"empty data frame", []*StreamFrame{
+			{Stream: 1, Kind: streamOpen}, dataFrame(1, ""), dataFrame(2, "a"), finFrame(3),
+		}, "a", io.EOF},
+		{"reset discards buffered data", []*StreamFrame{
+			{Stream: 1, Kind: streamOpen}, dataFrame(1, "a"), {Stream: 1, Kind: streamReset},
+		}, "", ErrStreamReset},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStream()
+			for _, frame := range tt.frames {
+				s.receive(frame)
+			}
+			s.SetReadDeadline(time.Now().Add(time.Second))
+
+			got, err := io.ReadAll(s)
+			if tt.err == io.EOF {
+				if err != nil {
+					t.Fatalf("ReadAll: %v", err)
+				}
+			} else if !errors.Is(err, tt.err) {
+				t.Fatalf("ReadAll error = %v, want %v", err, tt.err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamGap(t *testing.T) {
+	defer func(timeout time.Duration) { StreamGapTimeout = timeout }(StreamGapTimeout)
+	StreamGapTimeout = 50 * time.Millisecond
+
+	s := testStream()
+	s.receive(&StreamFrame{Stream: 1, Kind: streamOpen})
+	s.receive(dataFrame(1, "a"))
+	s.receive(dataFrame(3, "c"))
+
+	buf := make([]byte, 8)
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "a" {
+		t.Fatalf("Read = %q, %v, want a", buf[:n], err)
+	}
+
+	start := time.Now()
+	if _, err := s.Read(buf); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("Read across a lost frame: error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < StreamGapTimeout {
+		t.Errorf("gap reported after %s, before the %s timeout", elapsed, StreamGapTimeout)
+	}
+	if _, ok := s.client.streams[streamKey{peer: 2, id: 1}]; ok {
+		t.Error("stream with a lost frame was not removed")
+	}
+
+	s.receive(dataFrame(2, "b"))
+	if n, _ := s.Read(buf); n != 0 {
+		t.Errorf("late frame was delivered after the gap failed the stream")
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	s := testStream()
+	s.receive(&StreamFrame{Stream: 1, Kind: streamOpen})
+	s.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	buf := make([]byte, 8)
+	if _, err := s.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read error = %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,195 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/ratelimit"
+)
+
+var clientLimiter *ratelimit.Limiter
+var peerLimiter *ratelimit.Limiter
+var dailyQuota *ratelimit.Quota
+
+var MaxThrottleDelay = time.Second
+var MaxThrottleWait = 5 * time.Second
+var ThrottleNoticeInterval = time.Second
+var MessageOverhead = 64
+
+var ErrThrottled = errors.New("throttled by node")
+
+type Throttle struct {
+	Type       uint8
+	Reason     string
+	RetryAfter time.Duration
+	Dropped    bool
+}
+
+type linkLimits struct {
+	conn    *tls.Conn
+	role    crypto.Role
+	cert    *x509.Certificate
+	id      uint64
+	linked  bool
+	noticed time.Time
+}
+
+func isControlMessage(msgType uint8, role crypto.Role) bool {
+	switch msgType {
+	case message.REGISTER_CLIENT, message.CAP_REVOKE, message.BLOCK:
+		return role != crypto.RoleClient
+	case message.PEER_ID, message.PING, message.PONG, message.I_HAVE_CLIENT,
+		message.REVOCATION_LIST, message.NODE_CERT, message.NODE_DIRECTORY, message.THROTTLE:
+		return true
+	}
+	return false
+}
+
+func (l *linkLimits) admit(msg *message.Message, nodeCount int) bool {
+	if !l.linked || isControlMessage(msg.Type, l.role) {
+		return true
+	}
+
+	size := MessageOverhead + len(msg.Content) + len(msg.Signature)
+	limiter, reason := peerLimiter, "link rate limit reached"
+	if l.role == crypto.RoleClient {
+		limiter, reason = clientLimiter, "client rate limit reached"
+	}
+
+	wait, ok := limiter.Take(l.id, size, MaxThrottleDelay)
+	if ok && l.role == crypto.RoleClient {
+		if quotaWait, quotaOk := dailyQuota.Use(l.cert.Subject.CommonName, size); !quotaOk {
+			limiter.Refund(l.id, size)
+			wait, ok, reason = quotaWait, false, "daily quota exhausted"
+		}
+	}
+
+	if !ok {
+		l.throttle(msg, &Throttle{Type: msg.Type, Reason: reason, RetryAfter: wait, Dropped: true}, nodeCount)
+		return false
+	}
+	if wait > 0 {
+		if time.Since(l.noticed) > ThrottleNoticeInterval {
+			l.noticed = time.Now()
+			l.throttle(msg, &Throttle{Type: msg.Type, Reason: reason, RetryAfter: wait}, nodeCount)
+		}
+		time.Sleep(wait)
+	}
+	return true
+}
+
+func knownClient(id uint64) bool {
+	if _, ok := clients[id]; ok {
+		return true
+	}
+	_, ok := clientNode[id]
+	return ok
+}
+
+func throttleNotice(origin uint64, msg *message.Message, throttle *Throttle) (*message.Message, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(throttle); err != nil {
+		return nil, err
+	}
+
+	return &message.Message{
+		Type:         message.THROTTLE,
+		From:         uint64(serverId),
+		To:           origin,
+		ID:           msg.ID,
+		Intermediate: -1,
+		Content:      buf.Bytes(),
+	}, nil
+}
+
+func (l *linkLimits) throttle(msg *message.Message, throttle *Throttle, nodeCount int) {
+	origin := msg.From
+	if l.role == crypto.RoleClient {
+		origin = l.id
+	}
+
+	reply, err := throttleNotice(origin, msg, throttle)
+	if err != nil {
+		nodeLog.Error("Encoding throttle notice", "err", err)
+		return
+	}
+
+	if l.role == crypto.RoleClient {
+		nodeLog.Info("Throttling client", append(messageAttrs(msg), "client", origin, "reason", throttle.Reason, "dropped", throttle.Dropped)...)
+		if err := reply.Send(l.conn); err != nil {
+			nodeLog.Warn("Sending throttle notice", "client", origin, "err", err)
+		}
+		return
+	}
+
+	if !knownClient(origin) {
+		if throttle.Dropped {
+			nodeLog.Info("Dropping throttled message", append(messageAttrs(msg), "reason", throttle.Reason)...)
+		}
+		return
+	}
+	nodeLog.Info("Throttling client", append(messageAttrs(msg), "client", origin, "link_node", l.id, "reason", throttle.Reason, "dropped", throttle.Dropped)...)
+	deliverToClient(reply, nodeCount)
+}
+
+func (l *linkLimits) close() {
+	if !l.linked {
+		return
+	}
+	if l.role == crypto.RoleClient {
+		clientLimiter.Forget(l.id)
+	} else {
+		peerLimiter.Forget(l.id)
+	}
+}
+
+func (c *TrustClient) handleThrottle(msg *message.Message) {
+	throttle := &Throttle{}
+	if err := gob.NewDecoder(bytes.NewReader(msg.Content)).Decode(throttle); err != nil {
+		c.logger.Warn("Decoding throttle notice", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	c.emit(Event{Type: EventThrottled, Peer: msg.From, Err: fmt.Errorf("message %d %s, retry after %s", throttle.Type, throttle.Reason, throttle.RetryAfter)})
+	if !throttle.Dropped {
+		return
+	}
+
+	until := time.Now().Add(throttle.RetryAfter)
+	c.throttleMu.Lock()
+	if until.After(c.throttledUntil) {
+		c.throttledUntil = until
+	}
+	c.throttleMu.Unlock()
+
+	c.pendingMu.Lock()
+	response, ok := c.pending[msg.ID]
+	c.pendingMu.Unlock()
+	if ok {
+		select {
+		case response <- msg:
+		default:
+		}
+	}
+}
+
+func (c *TrustClient) waitThrottle() error {
+	c.throttleMu.Lock()
+	wait := time.Until(c.throttledUntil)
+	c.throttleMu.Unlock()
+
+	if wait > MaxThrottleWait {
+		return fmt.Errorf("%w for another %s", ErrThrottled, wait.Round(time.Second))
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
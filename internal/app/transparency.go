@@ -0,0 +1,243 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/message"
+	"github.com/jenyaftw/trust/internal/pkg/transparency"
+	"github.com/jenyaftw/trust/internal/pkg/utils"
+)
+
+var transparencyLog *transparency.Log
+
+var LogRequestTimeout = 10 * time.Second
+
+type LogGossip struct {
+	Heads []*transparency.SignedHead
+}
+
+func deliverToClient(msg *message.Message, nodeCount int) {
+	if clientConn, ok := clients[msg.To]; ok {
+		if err := msg.Send(clientConn); err != nil {
+			nodeLog.Warn("Delivering to client", append(messageAttrs(msg), "err", err)...)
+		}
+		return
+	}
+
+	if _, ok := clientNode[msg.To]; !ok {
+		nodeLog.Info("Dropping message for unknown client", messageAttrs(msg)...)
+		return
+	}
+
+	relayToNode(msg, processMessageRelay(msg, nodeCount), nodeCount)
+}
+
+func handleLogRequest(msg *message.Message, nodeCount int) {
+	if msg.ToNode != uint64(serverId) {
+		relayToNode(msg, processNodeRelay(msg, nodeCount), nodeCount)
+		return
+	}
+
+	if transparencyLog == nil {
+		nodeLog.Info("Dropping log request: this node does not serve a transparency log", messageAttrs(msg)...)
+		return
+	}
+
+	cert := nodeRenewer.Certificate()
+	var reply any
+	var err error
+	replyType := message.LOG_RECEIPT
+	switch msg.Type {
+	case message.LOG_SUBMIT:
+		reply, err = transparencyLog.Append(msg.Content, cert.Certificate, cert.PrivateKey)
+	case message.LOG_HEAD_REQUEST:
+		var req transparency.HeadRequest
+		if err = transparency.Decode(msg.Content, &req); err == nil {
+			reply, err = transparencyLog.Head(req.First, req.Second, cert.Certificate, cert.PrivateKey)
+		}
+		replyType = message.LOG_HEAD
+	}
+	if err != nil {
+		nodeLog.Warn("Serving log request", append(messageAttrs(msg), "err", err)...)
+		return
+	}
+
+	content, err := transparency.Encode(reply)
+	if err != nil {
+		nodeLog.Error("Encoding log reply", "err", err)
+		return
+	}
+
+	deliverToClient(&message.Message{
+		Type:         replyType,
+		From:         uint64(serverId),
+		To:           msg.From,
+		ID:           msg.ID,
+		Intermediate: -1,
+		Content:      content,
+	}, nodeCount)
+}
+
+func (c *TrustClient) logRequest(msgType uint8, logNode uint64, content []byte) (*message.Message, error) {
+	msg := &message.Message{
+		Type:         msgType,
+		From:         c.clientId,
+		ToNode:       logNode,
+		ID:           utils.GenerateRandomId(),
+		Intermediate: -1,
+		Content:      content,
+	}
+
+	reply, err := c.request(msg, LogRequestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("request to transparency log %d: %v", logNode, err)
+	}
+	if reply.From != logNode {
+		return nil, fmt.Errorf("log response from node %d, expected %d", reply.From, logNode)
+	}
+	return reply, nil
+}
+
+func (c *TrustClient) SubmitHash(logNode uint64, hash []byte) (*transparency.Receipt, error) {
+	reply, err := c.logRequest(message.LOG_SUBMIT, logNode, hash)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != message.LOG_RECEIPT {
+		return nil, fmt.Errorf("unexpected log response type %d", reply.Type)
+	}
+
+	var receipt transparency.Receipt
+	if err := transparency.Decode(reply.Content, &receipt); err != nil {
+		return nil, err
+	}
+
+	if receipt.Head == nil || receipt.Head.LogID != logNode || string(receipt.Hash) != string(hash) {
+		return nil, fmt.Errorf("receipt from log %d does not match the submitted hash", logNode)
+	}
+	if err := receipt.Verify(c.roots); err != nil {
+		return nil, fmt.Errorf("invalid receipt from log %d: %v", logNode, err)
+	}
+	return &receipt, nil
+}
+
+func (c *TrustClient) logHead(logNode uint64, req *transparency.HeadRequest) (*transparency.HeadResponse, error) {
+	content, err := transparency.Encode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.logRequest(message.LOG_HEAD_REQUEST, logNode, content)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != message.LOG_HEAD {
+		return nil, fmt.Errorf("unexpected log response type %d", reply.Type)
+	}
+
+	var resp transparency.HeadResponse
+	if err := transparency.Decode(reply.Content, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Head == nil || resp.Head.LogID != logNode {
+		return nil, fmt.Errorf("log head does not belong to log %d", logNode)
+	}
+	return &resp, nil
+}
+
+func (c *TrustClient) AuditLog(logNode uint64) (*transparency.SignedHead, error) {
+	c.logMu.Lock()
+	previous := c.logHeads[logNode]
+	c.logMu.Unlock()
+
+	req := &transparency.HeadRequest{}
+	if previous != nil {
+		req.First = previous.Size
+	}
+	resp, err := c.logHead(logNode, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := transparency.VerifyHeadResponse(previous, resp, c.roots); err != nil {
+		return nil, err
+	}
+
+	c.logMu.Lock()
+	if current := c.logHeads[logNode]; current == nil || current.Size <= resp.Head.Size {
+		c.logHeads[logNode] = resp.Head
+	}
+	c.logMu.Unlock()
+	return resp.Head, nil
+}
+
+func (c *TrustClient) GossipLogHeads(peer uint64) error {
+	if _, _, err := c.session(peer); err != nil {
+		return err
+	}
+
+	gossip := &LogGossip{}
+	c.logMu.Lock()
+	for _, head := range c.logHeads {
+		gossip.Heads = append(gossip.Heads, head)
+	}
+	c.logMu.Unlock()
+
+	if len(gossip.Heads) == 0 {
+		return nil
+	}
+	return c.sendControl(message.LOG_GOSSIP, peer, gossip)
+}
+
+func (c *TrustClient) handleLogGossip(msg *message.Message) {
+	gossip := &LogGossip{}
+	if !c.openControl(msg, gossip) {
+		return
+	}
+
+	for _, head := range gossip.Heads {
+		if head != nil {
+			go c.compareLogHead(msg.From, head)
+		}
+	}
+}
+
+func (c *TrustClient) compareLogHead(peer uint64, theirs *transparency.SignedHead) {
+	if err := theirs.Verify(c.roots); err != nil {
+		c.logger.Warn("Rejecting gossiped log head", "peer", peer, "log", theirs.LogID, "err", err)
+		return
+	}
+
+	c.logMu.Lock()
+	ours := c.logHeads[theirs.LogID]
+	c.logMu.Unlock()
+	if ours == nil {
+		var err error
+		if ours, err = c.AuditLog(theirs.LogID); err != nil {
+			c.logger.Warn("Auditing gossiped log", "peer", peer, "log", theirs.LogID, "err", err)
+			return
+		}
+	}
+
+	var resp *transparency.HeadResponse
+	if ours.Size != theirs.Size {
+		var err error
+		req := &transparency.HeadRequest{First: min(ours.Size, theirs.Size), Second: max(ours.Size, theirs.Size)}
+		if resp, err = c.logHead(theirs.LogID, req); err != nil {
+			c.logger.Warn("Requesting consistency proof for gossiped log head", "peer", peer, "log", theirs.LogID, "err", err)
+			return
+		}
+	}
+
+	err := transparency.CompareHeads(ours, theirs, resp, c.roots)
+	switch {
+	case errors.Is(err, transparency.ErrSplitView):
+		c.emit(Event{Type: EventSplitView, Peer: peer, First: ours.Size, Last: theirs.Size, Err: fmt.Errorf("log %d: %v", theirs.LogID, err)})
+	case err != nil:
+		c.logger.Warn("Comparing gossiped log head", "peer", peer, "log", theirs.LogID, "err", err)
+	default:
+		c.logger.Debug("Gossiped log head is consistent", "peer", peer, "log", theirs.LogID, "size", theirs.Size)
+	}
+}
@@ -0,0 +1,180 @@
+package capability
+
+import (
+	"bufio"
+	"bytes"
+	gocrypto "crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+const (
+	RevocationFile    = "capabilities.revoked"
+	revocationContext = "trust capability revocation v1"
+)
+
+type Revocation struct {
+	ID        []byte
+	Signer    string
+	Timestamp time.Time
+	Chain     [][]byte
+	Signature []byte
+}
+
+type RevocationList struct {
+	mu      sync.Mutex
+	path    string
+	revoked map[string][]string
+	all     []*Revocation
+}
+
+func (r *Revocation) SignedBytes() []byte {
+	buf := append([]byte{}, revocationContext...)
+	buf = append(buf, r.ID...)
+	buf = append(buf, r.Signer...)
+	buf = append(buf, 0)
+	return binary.BigEndian.AppendUint64(buf, uint64(r.Timestamp.UnixNano()))
+}
+
+func Revoke(token *Token, chain [][]byte, key gocrypto.PrivateKey) (*Revocation, error) {
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Revocation{
+		ID:        token.ID,
+		Signer:    cert.Subject.CommonName,
+		Timestamp: time.Now().UTC(),
+		Chain:     chain,
+	}
+	r.Signature, err = crypto.Sign(key, r.SignedBytes())
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Revocation) Verify(roots *x509.CertPool, revocations *crypto.RevocationStore) error {
+	if _, err := verifyChain(r.Chain, r.Signer, r.Timestamp, roots, revocations, r.SignedBytes(), r.Signature); err != nil {
+		return fmt.Errorf("revocation of capability token %x: %v", r.ID, err)
+	}
+	return nil
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{revoked: make(map[string][]string)}
+}
+
+func OpenRevocationList(path string) (*RevocationList, error) {
+	l := NewRevocationList()
+	l.path = path
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		r := &Revocation{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", path, err)
+		}
+		l.add(r)
+	}
+	return l, scanner.Err()
+}
+
+func (l *RevocationList) add(r *Revocation) bool {
+	key := hex.EncodeToString(r.ID)
+	if slices.Contains(l.revoked[key], r.Signer) {
+		return false
+	}
+	l.revoked[key] = append(l.revoked[key], r.Signer)
+	l.all = append(l.all, r)
+	return true
+}
+
+func (l *RevocationList) Add(r *Revocation, roots *x509.CertPool, revocations *crypto.RevocationStore) (bool, error) {
+	if err := r.Verify(roots, revocations); err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.add(r) {
+		return false, nil
+	}
+	if l.path == "" {
+		return true, nil
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return true, err
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return true, err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return true, err
+	}
+	return true, file.Sync()
+}
+
+func (l *RevocationList) Check(token *Token) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owner := token.Owner()
+	for t := token; t != nil; t = t.Parent {
+		for _, signer := range l.revoked[hex.EncodeToString(t.ID)] {
+			if signer == owner || signer == t.Issuer {
+				return fmt.Errorf("capability token %x was revoked by %s", t.ID, signer)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *RevocationList) All() []*Revocation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.all)
+}
+
+func EncodeRevocations(revocations []*Revocation) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(revocations); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeRevocations(data []byte) ([]*Revocation, error) {
+	var revocations []*Revocation
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&revocations); err != nil {
+		return nil, fmt.Errorf("error decoding capability revocations: %v", err)
+	}
+	return revocations, nil
+}
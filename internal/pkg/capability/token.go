@@ -0,0 +1,207 @@
+package capability
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+const tokenContext = "trust capability v1"
+
+type Right uint8
+
+const (
+	Fetch Right = 1 << iota
+	Forward
+)
+
+var ErrExpired = errors.New("capability token has expired")
+var ErrDenied = errors.New("capability token does not grant access")
+
+type Token struct {
+	ID        []byte
+	Hash      []byte
+	Holder    string
+	Rights    Right
+	IssuedAt  time.Time
+	NotAfter  time.Time
+	Issuer    string
+	Chain     [][]byte
+	Signature []byte
+	Parent    *Token `json:",omitempty"`
+}
+
+func (r Right) String() string {
+	switch r {
+	case Fetch:
+		return "fetch"
+	case Forward:
+		return "forward"
+	case Fetch | Forward:
+		return "fetch,forward"
+	}
+	return fmt.Sprintf("rights(%d)", uint8(r))
+}
+
+func New(hash []byte, holder string, rights Right, validFor time.Duration, parent *Token) (*Token, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return &Token{
+		ID:       id,
+		Hash:     hash,
+		Holder:   holder,
+		Rights:   rights,
+		IssuedAt: now,
+		NotAfter: now.Add(validFor),
+		Parent:   parent,
+	}, nil
+}
+
+func (t *Token) SignedBytes() []byte {
+	buf := append([]byte{}, tokenContext...)
+	buf = append(buf, t.ID...)
+	buf = append(buf, t.Hash...)
+	buf = append(buf, t.Holder...)
+	buf = append(buf, 0)
+	buf = append(buf, t.Issuer...)
+	buf = append(buf, 0, byte(t.Rights))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.IssuedAt.UnixNano()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.NotAfter.UnixNano()))
+	if t.Parent != nil {
+		buf = append(buf, t.Parent.ID...)
+	}
+	return buf
+}
+
+func (t *Token) Sign(chain [][]byte, key gocrypto.PrivateKey) error {
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+
+	t.Issuer = cert.Subject.CommonName
+	t.Chain = chain
+
+	signature, err := crypto.Sign(key, t.SignedBytes())
+	if err != nil {
+		return err
+	}
+	t.Signature = signature
+	return nil
+}
+
+func (t *Token) Owner() string {
+	for t.Parent != nil {
+		t = t.Parent
+	}
+	return t.Issuer
+}
+
+func (t *Token) Verify(roots *x509.CertPool, revocations *crypto.RevocationStore) error {
+	if _, err := verifyChain(t.Chain, t.Issuer, t.IssuedAt, roots, revocations, t.SignedBytes(), t.Signature); err != nil {
+		return fmt.Errorf("capability token %x: %v", t.ID, err)
+	}
+
+	if time.Now().After(t.NotAfter) {
+		return ErrExpired
+	}
+
+	if t.Parent == nil {
+		return nil
+	}
+	if err := t.Parent.Verify(roots, revocations); err != nil {
+		return err
+	}
+
+	switch {
+	case t.Parent.Rights&Forward == 0:
+		return fmt.Errorf("capability token %x was issued without the forward right", t.ID)
+	case t.Parent.Holder != t.Issuer:
+		return fmt.Errorf("capability token %x was issued by %s, parent is held by %s", t.ID, t.Issuer, t.Parent.Holder)
+	case t.Rights&^t.Parent.Rights != 0:
+		return fmt.Errorf("capability token %x grants more than its parent", t.ID)
+	case t.NotAfter.After(t.Parent.NotAfter):
+		return fmt.Errorf("capability token %x outlives its parent", t.ID)
+	case !bytes.Equal(t.Hash, t.Parent.Hash):
+		return fmt.Errorf("capability token %x covers different content than its parent", t.ID)
+	}
+	return nil
+}
+
+func (t *Token) Allows(hash []byte, holder string, right Right) error {
+	if !bytes.Equal(t.Hash, hash) || t.Holder != holder || t.Rights&right == 0 {
+		return ErrDenied
+	}
+	return nil
+}
+
+func verifyChain(chain [][]byte, signer string, at time.Time, roots *x509.CertPool, revocations *crypto.RevocationStore, signed []byte, signature []byte) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range chain[1:] {
+		intermediate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		intermediates.AddCert(intermediate)
+	}
+
+	if role := crypto.GetCertificateRole(cert); role != crypto.RoleClient {
+		return nil, fmt.Errorf("signed with %s certificate", role)
+	}
+	if cert.Subject.CommonName != signer {
+		return nil, fmt.Errorf("signed by %s, certificate belongs to %s", signer, cert.Subject.CommonName)
+	}
+
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if revocations != nil {
+		for _, chain := range chains {
+			if err := revocations.Check(chain); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return cert, crypto.VerifySignature(cert, signed, signature)
+}
+
+func (t *Token) Encode() ([]byte, error) {
+	return json.MarshalIndent(t, "", "  ")
+}
+
+func Decode(data []byte) (*Token, error) {
+	token := &Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("error decoding capability token: %v", err)
+	}
+	return token, nil
+}
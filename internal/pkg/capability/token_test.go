@@ -0,0 +1,249 @@
+package capability
+
+import (
+	gocrypto "crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+type testIdentity struct {
+	chain [][]byte
+	key   gocrypto.Signer
+}
+
+type testPKI struct {
+	roots      *x509.CertPool
+	identities map[string]*testIdentity
+}
+
+func newTestPKI(t *testing.T, names ...string) *testPKI {
+	t.Helper()
+
+	rootKey, err := crypto.GenerateKey(crypto.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTemplate := crypto.GenerateCACertificate(serial(t))
+	rootPem, err := crypto.EncodeCertificate(rootTemplate, rootTemplate, rootKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := crypto.DecodeCertificate(rootPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuerKey, err := crypto.GenerateKey(crypto.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerPem, err := crypto.EncodeCertificate(crypto.GenerateIntermediateCertificate(serial(t)), root, issuerKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := crypto.NewIssuer(issuerPem, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pki := &testPKI{roots: x509.NewCertPool(), identities: make(map[string]*testIdentity)}
+	pki.roots.AddCert(root)
+	for _, name := range names {
+		key, err := crypto.GenerateKey(crypto.ECDSAP256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certPem, err := issuer.Issue(crypto.GenerateClientCertificate(nil, name), key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		identity := &testIdentity{key: key}
+		for block, rest := pem.Decode(certPem); block != nil; block, rest = pem.Decode(rest) {
+			identity.chain = append(identity.chain, block.Bytes)
+		}
+		pki.identities[name] = identity
+	}
+	return pki
+}
+
+func serial(t *testing.T) *big.Int {
+	t.Helper()
+
+	n, err := crypto.GenerateSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func (p *testPKI) issue(t *testing.T, signer string, hash []byte, holder string, rights Right, validFor time.Duration, parent *Token) *Token {
+	t.Helper()
+
+	token, err := New(hash, holder, rights, validFor, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := p.identities[signer]
+	if err := token.Sign(identity.chain, identity.key); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenChains(t *testing.T) {
+	pki := newTestPKI(t, "alice", "bob", "carol")
+	hash := sha256.Sum256([]byte("file"))
+	other := sha256.Sum256([]byte("other file"))
+
+	tests := []struct {
+		name  string
+		token func() *Token
+		ok    bool
+	}{
+		{"issued by the owner", func() *Token {
+			return pki.issue(t, "alice", hash[:], "bob", Fetch, time.Hour, nil)
+		}, true},
+		{"forwarded", func() *Token {
+			parent := pki.issue(t, "alice", hash[:], "bob", Fetch|Forward, time.Hour, nil)
+			return pki.issue(t, "bob", hash[:], "carol", Fetch, time.Minute, parent)
+		}, true},
+		{"forwarded twice", func() *Token {
+			parent := pki.issue(t, "alice", hash[:], "bob", Fetch|Forward, time.Hour, nil)
+			child := pki.issue(t, "bob", hash[:], "carol", Fetch|Forward, time.Minute, parent)
+			return pki.issue(t, "carol", hash[:], "alice", Fetch, 30*time.Second, child)
+		}, true},
+		{"parent without forward", func() *Token {
+			parent := pki.issue(t, "alice", hash[:], "bob", Fetch, time.Hour, nil)
+			return pki.issue(t, "bob", hash[:], "carol", Fetch, time.Minute, parent)
+		}, false},
+		{"forwarded by someone other than the holder", func() *Token {
+			parent := pki.issue(t, "alice", hash[:], "bob", Fetch|Forward, time.Hour, nil)
+			return pki.issue(t, "carol", hash[:], "carol", Fetch, time.Minute, parent)
+		}, false},
+		{"more rights than the parent", func() *Token {
+			parent := pki.issue(t, "alice", hash[:], "bob", Forward, time.Hour, nil)
+			return pki.issue(t, "bob", hash[:], "carol", Fetch|Forward, time.Minute, parent)
+		}, false},
+		{"outlives the parent", func() *Token {
+			parent := pki.issue(t, "alice", hash[:], "bob", Fetch|Forward, time.Minute, nil)
+			return pki.issue(t, "bob", hash[:], "carol", Fetch, time.Hour, parent)
+		}, false},
+		{"different content than the parent", func() *Token {
+			parent := pki.issue(t, "alice", hash[:], "bob", Fetch|Forward, time.Hour, nil)
+			return pki.issue(t, "bob", other[:], "carol", Fetch, time.Minute, parent)
+		}, false},
+		{"expired", func() *Token {
+			return pki.issue(t, "alice", hash[:], "bob", Fetch, -time.Second, nil)
+		}, false},
+		{"tampered holder", func() *Token {
+			token := pki.issue(t, "alice", hash[:], "bob", Fetch, time.Hour, nil)
+			token.Holder = "carol"
+			return token
+		}, false},
+		{"tampered parent", func() *Token {
+			parent := pki.issue(t, "alice", hash[:], "bob", Fetch|Forward, time.Hour, nil)
+			child := pki.issue(t, "bob", hash[:], "carol", Fetch, time.Minute, parent)
+			parent.NotAfter = parent.NotAfter.Add(time.Hour)
+			return child
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token()
+
+			encoded, err := token.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := Decode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = decoded.Verify(pki.roots, nil)
+			if (err == nil) != tt.ok {
+				t.Errorf("Verify error = %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && decoded.Owner() != "alice" {
+				t.Errorf("owner = %s, want alice", decoded.Owner())
+			}
+		})
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	pki := newTestPKI(t, "alice", "bob")
+	hash := sha256.Sum256([]byte("file"))
+	other := sha256.Sum256([]byte("other file"))
+	token := pki.issue(t, "alice", hash[:], "bob", Fetch, time.Hour, nil)
+
+	tests := []struct {
+		name   string
+		hash   []byte
+		holder string
+		right  Right
+		err    error
+	}{
+		{"holder fetches", hash[:], "bob", Fetch, nil},
+		{"another holder", hash[:], "alice", Fetch, ErrDenied},
+		{"other content", other[:], "bob", Fetch, ErrDenied},
+		{"right not granted", hash[:], "bob", Forward, ErrDenied},
+	}
+
+	for _, tt := range tests {
+		if err := token.Allows(tt.hash, tt.holder, tt.right); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestRevocationListCheck(t *testing.T) {
+	pki := newTestPKI(t, "alice", "bob", "carol")
+	hash := sha256.Sum256([]byte("file"))
+	parent := pki.issue(t, "alice", hash[:], "bob", Fetch|Forward, time.Hour, nil)
+	child := pki.issue(t, "bob", hash[:], "carol", Fetch, time.Minute, parent)
+
+	tests := []struct {
+		name    string
+		signer  string
+		revoked *Token
+		ok      bool
+	}{
+		{"owner revokes the parent", "alice", parent, false},
+		{"owner revokes the child", "alice", child, false},
+		{"issuer revokes the child", "bob", child, false},
+		{"holder revokes the parent", "bob", parent, true},
+		{"unrelated client revokes the child", "carol", child, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity := pki.identities[tt.signer]
+			r, err := Revoke(tt.revoked, identity.chain, identity.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			list := NewRevocationList()
+			if added, err := list.Add(r, pki.roots, nil); !added || err != nil {
+				t.Fatalf("Add = %v, %v", added, err)
+			}
+			if added, _ := list.Add(r, pki.roots, nil); added {
+				t.Error("the same revocation was added twice")
+			}
+
+			if err := list.Check(child); (err == nil) != tt.ok {
+				t.Errorf("Check error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var signerProviders = map[string]func(uri string) (gocrypto.Signer, error){"exec": newExecSigner}
+
+var stdinOnce sync.Once
+var stdinContent []byte
+var stdinErr error
+
+func splitSource(source string) (string, string) {
+	if source == "-" || source == "stdin" {
+		return "stdin", ""
+	}
+
+	scheme, value, ok := strings.Cut(source, ":")
+	if !ok {
+		return "file", source
+	}
+	return scheme, value
+}
+
+func readStdin() ([]byte, error) {
+	stdinOnce.Do(func() {
+		stdinContent, stdinErr = io.ReadAll(os.Stdin)
+	})
+	return stdinContent, stdinErr
+}
+
+func LoadSecret(source string) ([]byte, error) {
+	scheme, value := splitSource(source)
+	switch scheme {
+	case "file":
+		return os.ReadFile(value)
+	case "env":
+		content := os.Getenv(value)
+		if content == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", value)
+		}
+		return []byte(content), nil
+	case "stdin":
+		return readStdin()
+	}
+	return nil, fmt.Errorf("unsupported credential source %q", source)
+}
+
+func checkKeyPermissions(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		return fmt.Errorf("key file %s has insecure permissions %04o, it must not be accessible by group or others (chmod 600 %s)", path, mode, path)
+	}
+	return nil
+}
+
+func LoadPrivateKey(source string) ([]byte, error) {
+	scheme, value := splitSource(source)
+	if scheme == "file" {
+		if err := checkKeyPermissions(value); err != nil {
+			return nil, err
+		}
+	}
+
+	return LoadSecret(source)
+}
+
+func LoadKeyPair(certSource string, keySource string) (tls.Certificate, error) {
+	certPem, err := LoadSecret(certSource)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("loading certificate: %v", err)
+	}
+
+	scheme, _ := splitSource(keySource)
+	if provider, ok := signerProviders[scheme]; ok {
+		signer, err := provider(keySource)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("loading signer: %v", err)
+		}
+		return SignerKeyPair(certPem, signer)
+	}
+
+	keyPem, err := LoadPrivateKey(keySource)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("loading private key: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	return cert, err
+}
+
+func SignerKeyPair(certPem []byte, signer gocrypto.Signer) (tls.Certificate, error) {
+	cert := tls.Certificate{PrivateKey: signer}
+	for {
+		var block *pem.Block
+		block, certPem = pem.Decode(certPem)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("no certificate found")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	publicKey, ok := leaf.PublicKey.(interface{ Equal(gocrypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(signer.Public()) {
+		return tls.Certificate{}, fmt.Errorf("signer does not match certificate public key")
+	}
+
+	cert.Leaf = leaf
+	return cert, nil
+}
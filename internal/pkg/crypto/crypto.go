@@ -1,16 +1,16 @@
 package crypto
 
 import (
+	gocrypto "crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha512"
-	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/base64"
 	"encoding/pem"
+	"fmt"
 	"io"
 	"math/big"
 	"net"
@@ -21,35 +21,87 @@ func GenerateRSAKey(bitSize int) (*rsa.PrivateKey, error) {
 	return rsa.GenerateKey(rand.Reader, bitSize)
 }
 
-func EncodeRSAKey(key *rsa.PrivateKey) []byte {
-	return pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		},
-	)
+type Role int
+
+const (
+	RoleUnknown Role = iota
+	RoleCA
+	RoleIntermediate
+	RoleNode
+	RoleClient
+)
+
+const (
+	TrustDomain   = "trust"
+	NodesDomain   = "nodes." + TrustDomain
+	ClientsDomain = "clients." + TrustDomain
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleCA:
+		return "ca"
+	case RoleIntermediate:
+		return "intermediate"
+	case RoleNode:
+		return "node"
+	case RoleClient:
+		return "client"
+	}
+	return "unknown"
+}
+
+func subject(role Role, commonName string) pkix.Name {
+	return pkix.Name{
+		CommonName:         commonName,
+		Organization:       []string{"Trust"},
+		OrganizationalUnit: []string{role.String()},
+		Country:            []string{"UA"},
+		Province:           []string{""},
+		Locality:           []string{"Kyiv"},
+	}
 }
 
-func GenerateCACertificate() *x509.Certificate {
+var NodeCertificateLifetime = 24 * time.Hour
+var ClientCertificateLifetime = 72 * time.Hour
+
+func GenerateSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func GenerateCACertificate(serial *big.Int) *x509.Certificate {
 	return &x509.Certificate{
-		SerialNumber: big.NewInt(2024),
-		Subject: pkix.Name{
-			Organization: []string{"Trust"},
-			Country:      []string{"UA"},
-			Province:     []string{""},
-			Locality:     []string{"Kyiv"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
+		SerialNumber:                serial,
+		Subject:                     subject(RoleCA, "Trust Root CA"),
+		NotBefore:                   time.Now(),
+		NotAfter:                    time.Now().AddDate(10, 0, 0),
+		IsCA:                        true,
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid:       true,
+		MaxPathLen:                  1,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{TrustDomain},
 	}
 }
 
-func EncodeCertificate(cert *x509.Certificate, parent *x509.Certificate, key *rsa.PrivateKey, parentKey *rsa.PrivateKey) ([]byte, error) {
-	certBytes, err := x509.CreateCertificate(rand.Reader, cert, parent, &key.PublicKey, parentKey)
+func GenerateIntermediateCertificate(serial *big.Int) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber:                serial,
+		Subject:                     subject(RoleIntermediate, "Trust Issuing CA"),
+		NotBefore:                   time.Now(),
+		NotAfter:                    time.Now().AddDate(5, 0, 0),
+		IsCA:                        true,
+		KeyUsage:                    x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid:       true,
+		MaxPathLen:                  0,
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{NodesDomain, ClientsDomain},
+	}
+}
+
+func EncodeCertificate(cert *x509.Certificate, parent *x509.Certificate, key gocrypto.Signer, parentKey gocrypto.Signer) ([]byte, error) {
+	certBytes, err := x509.CreateCertificate(rand.Reader, cert, parent, key.Public(), parentKey)
 	if err != nil {
 		return nil, err
 	}
@@ -62,21 +114,103 @@ func EncodeCertificate(cert *x509.Certificate, parent *x509.Certificate, key *rs
 	), nil
 }
 
-func GenerateCertificate(serial int64, a, b, c, d byte) *x509.Certificate {
+func GenerateNodeCertificate(serial *big.Int, id int, ips ...net.IP) *x509.Certificate {
+	return GenerateServiceCertificate(serial, fmt.Sprintf("node-%d", id), ips...)
+}
+
+func NodeServerName(id int) string {
+	return fmt.Sprintf("node-%d.%s", id, NodesDomain)
+}
+
+func VerifyNodeCertificate(chain [][]byte, id uint64, roots *x509.CertPool, revocations *RevocationStore) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("empty certificate chain for node %d", id)
+	}
+
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range chain[1:] {
+		intermediate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		intermediates.AddCert(intermediate)
+	}
+
+	if err := VerifyCertificate(cert, RoleNode, roots, intermediates, revocations); err != nil {
+		return nil, err
+	}
+
+	if err := cert.VerifyHostname(NodeServerName(int(id))); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+func GenerateServiceCertificate(serial *big.Int, name string, ips ...net.IP) *x509.Certificate {
 	return &x509.Certificate{
-		SerialNumber: big.NewInt(serial),
-		Subject: pkix.Name{
-			Organization: []string{"Trust"},
-			Country:      []string{"UA"},
-			Province:     []string{""},
-			Locality:     []string{"Kyiv"},
-		},
-		IPAddresses: []net.IP{net.IPv4(a, b, c, d), net.IPv6loopback},
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().AddDate(10, 0, 0),
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
+		SerialNumber: serial,
+		Subject:      subject(RoleNode, name),
+		DNSNames:     []string{name + "." + NodesDomain},
+		IPAddresses:  append(ips, net.IPv6loopback),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(NodeCertificateLifetime),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+}
+
+func GenerateClientCertificate(serial *big.Int, name string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject(RoleClient, name),
+		DNSNames:     []string{name + "." + ClientsDomain},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(ClientCertificateLifetime),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
 	}
+	return false
+}
+
+func GetCertificateRole(cert *x509.Certificate) Role {
+	if cert == nil || len(cert.Subject.OrganizationalUnit) != 1 {
+		return RoleUnknown
+	}
+
+	ou := cert.Subject.OrganizationalUnit[0]
+	if cert.IsCA {
+		switch ou {
+		case RoleCA.String():
+			return RoleCA
+		case RoleIntermediate.String():
+			return RoleIntermediate
+		}
+		return RoleUnknown
+	}
+
+	serverAuth := hasExtKeyUsage(cert, x509.ExtKeyUsageServerAuth)
+	clientAuth := hasExtKeyUsage(cert, x509.ExtKeyUsageClientAuth)
+	switch {
+	case ou == RoleNode.String() && serverAuth && clientAuth:
+		return RoleNode
+	case ou == RoleClient.String() && clientAuth && !serverAuth:
+		return RoleClient
+	}
+	return RoleUnknown
 }
 
 func GenerateAESKey() []byte {
@@ -86,26 +220,107 @@ func GenerateAESKey() []byte {
 }
 
 func EncryptMessage(message []byte, cert *x509.Certificate) ([]byte, error) {
-	publicKey := cert.PublicKey.(*rsa.PublicKey)
-	hash := sha512.New()
+	if publicKey, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+		return rsa.EncryptOAEP(sha512.New(), rand.Reader, publicKey, message, nil)
+	}
 
-	ciphertext, err := rsa.EncryptOAEP(hash, rand.Reader, publicKey, message, nil)
+	publicKey, err := agreementPublicKey(cert.PublicKey)
 	if err != nil {
 		return nil, err
 	}
 
-	return ciphertext, nil
+	return sealWithAgreement(message, publicKey)
+}
+
+var oaepOptions = &rsa.OAEPOptions{Hash: gocrypto.SHA512}
+
+func rsaDecrypter(key gocrypto.PrivateKey) (gocrypto.Decrypter, *rsa.PublicKey) {
+	decrypter, ok := key.(gocrypto.Decrypter)
+	if !ok {
+		return nil, nil
+	}
+	publicKey, ok := decrypter.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, nil
+	}
+	return decrypter, publicKey
+}
+
+func DecryptMessage(ciphertext []byte, key gocrypto.PrivateKey) ([]byte, error) {
+	if decrypter, _ := rsaDecrypter(key); decrypter != nil {
+		return decrypter.Decrypt(rand.Reader, ciphertext, oaepOptions)
+	}
+
+	privateKey, err := agreementPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return openWithAgreement(ciphertext, privateKey)
+}
+
+func SealMessage(message []byte, cert *x509.Certificate) ([]byte, error) {
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return EncryptMessage(message, cert)
+	}
+
+	key := GenerateAESKey()
+	encryptedKey, err := rsa.EncryptOAEP(sha512.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := append(encryptedKey, nonce...)
+	return gcm.Seal(ciphertext, nonce, message, nil), nil
 }
 
-func DecryptMessage(ciphertext []byte, key *rsa.PrivateKey) ([]byte, error) {
-	hash := sha512.New()
+func OpenMessage(ciphertext []byte, key gocrypto.PrivateKey) ([]byte, error) {
+	decrypter, publicKey := rsaDecrypter(key)
+	if decrypter == nil {
+		return DecryptMessage(ciphertext, key)
+	}
+
+	size := publicKey.Size()
+	if len(ciphertext) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	aesKey, err := decrypter.Decrypt(rand.Reader, ciphertext[:size], oaepOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext = ciphertext[size:]
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
 
-	message, err := rsa.DecryptOAEP(hash, rand.Reader, key, ciphertext, nil)
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return message, nil
+	return cipher.NewGCM(block)
 }
 
 func EncryptMessageAES(message []byte, key []byte) ([]byte, error) {
@@ -145,40 +360,41 @@ func DecryptMessageAES(ciphertext []byte, key []byte) ([]byte, error) {
 	return ciphertext, nil
 }
 
-func GetTLSConfig(certEnc string, keyEnc string, caEnc *string) (*tls.Config, error) {
-	certString, err := base64.StdEncoding.DecodeString(certEnc)
-	if err != nil {
-		return nil, err
+func DecodeCertificate(certPem []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPem)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found")
 	}
 
-	keyString, err := base64.StdEncoding.DecodeString(keyEnc)
-	if err != nil {
-		return nil, err
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func VerifyCertificate(cert *x509.Certificate, role Role, roots *x509.CertPool, intermediates *x509.CertPool, revocations *RevocationStore) error {
+	if GetCertificateRole(cert) != role {
+		return fmt.Errorf("certificate %s does not have %s role", cert.Subject.CommonName, role)
 	}
 
-	cer, err := tls.X509KeyPair(certString, keyString)
-	if err != nil {
-		return nil, err
+	usage := x509.ExtKeyUsageClientAuth
+	if role == RoleNode {
+		usage = x509.ExtKeyUsageServerAuth
 	}
 
-	config := tls.Config{
-		Certificates:       []tls.Certificate{cer},
-		InsecureSkipVerify: caEnc == nil,
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return err
 	}
 
-	if caEnc != nil {
-		caString, err := base64.StdEncoding.DecodeString(*caEnc)
-		if err != nil {
-			return nil, err
+	if revocations != nil {
+		for _, chain := range chains {
+			if err := revocations.Check(chain); err != nil {
+				return err
+			}
 		}
-
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caString)
-
-		config.RootCAs = caCertPool
-		config.ClientCAs = caCertPool
-		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
-	return &config, nil
+	return nil
 }
@@ -0,0 +1,154 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/x509"
+	"net"
+	"testing"
+)
+
+type testPKI struct {
+	root          *x509.Certificate
+	rootKey       gocrypto.Signer
+	issuer        *Issuer
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	rootKey, err := GenerateKey(ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := GenerateSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTemplate := GenerateCACertificate(serial)
+	rootPem, err := EncodeCertificate(rootTemplate, rootTemplate, rootKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := DecodeCertificate(rootPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuerKey, err := GenerateKey(ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial, err = GenerateSerialNumber(); err != nil {
+		t.Fatal(err)
+	}
+	issuerPem, err := EncodeCertificate(GenerateIntermediateCertificate(serial), root, issuerKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := NewIssuer(issuerPem, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testPKI{root: root, rootKey: rootKey, issuer: issuer, roots: x509.NewCertPool(), intermediates: x509.NewCertPool()}
+	p.roots.AddCert(root)
+	p.intermediates.AddCert(issuer.Cert)
+	return p
+}
+
+func (p *testPKI) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, gocrypto.Signer) {
+	t.Helper()
+
+	key, err := GenerateKey(ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem, err := p.issuer.Issue(template, key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := DecodeCertificate(certPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestGetCertificateRole(t *testing.T) {
+	p := newTestPKI(t)
+	node, _ := p.issue(t, GenerateNodeCertificate(nil, 1))
+	client, _ := p.issue(t, GenerateClientCertificate(nil, "client-1"))
+
+	serverClient := GenerateClientCertificate(nil, "client-2")
+	serverClient.ExtKeyUsage = append(serverClient.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	clientOnlyNode := GenerateNodeCertificate(nil, 2)
+	clientOnlyNode.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	twoUnits := GenerateClientCertificate(nil, "client-3")
+	twoUnits.Subject.OrganizationalUnit = append(twoUnits.Subject.OrganizationalUnit, RoleNode.String())
+	leafCA := GenerateNodeCertificate(nil, 3)
+	leafCA.IsCA = true
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		role Role
+	}{
+		{"root", p.root, RoleCA},
+		{"intermediate", p.issuer.Cert, RoleIntermediate},
+		{"node", node, RoleNode},
+		{"client", client, RoleClient},
+		{"client with server auth", serverClient, RoleUnknown},
+		{"node without server auth", clientOnlyNode, RoleUnknown},
+		{"two roles", twoUnits, RoleUnknown},
+		{"CA with a leaf role", leafCA, RoleUnknown},
+		{"nil", nil, RoleUnknown},
+	}
+
+	for _, tt := range tests {
+		if role := GetCertificateRole(tt.cert); role != tt.role {
+			t.Errorf("%s: role %s, want %s", tt.name, role, tt.role)
+		}
+	}
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	p := newTestPKI(t)
+	other := newTestPKI(t)
+
+	node, _ := p.issue(t, GenerateNodeCertificate(nil, 1, net.IPv4(127, 0, 0, 1)))
+	client, _ := p.issue(t, GenerateClientCertificate(nil, "client-1"))
+	foreign, _ := other.issue(t, GenerateClientCertificate(nil, "client-1"))
+	outside := GenerateClientCertificate(nil, "client-2")
+	outside.DNSNames = []string{"client-2.example.com"}
+	outsideCert, _ := p.issue(t, outside)
+
+	tests := []struct {
+		name  string
+		cert  *x509.Certificate
+		role  Role
+		valid bool
+	}{
+		{"node", node, RoleNode, true},
+		{"client", client, RoleClient, true},
+		{"node as client", node, RoleClient, false},
+		{"client as node", client, RoleNode, false},
+		{"issued under another root", foreign, RoleClient, false},
+		{"name outside the permitted domains", outsideCert, RoleClient, false},
+	}
+
+	for _, tt := range tests {
+		err := VerifyCertificate(tt.cert, tt.role, p.roots, p.intermediates, nil)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: error = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	if err := node.VerifyHostname(NodeServerName(1)); err != nil {
+		t.Errorf("node certificate does not match its server name: %v", err)
+	}
+	if err := client.VerifyHostname(NodeServerName(1)); err == nil {
+		t.Error("client certificate matches a node server name")
+	}
+}
@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+var CertificateClockSkew = time.Minute
+
+type Issuer struct {
+	Cert    *x509.Certificate
+	Key     gocrypto.Signer
+	Chain   []byte
+	OnIssue func(cert *x509.Certificate) error
+}
+
+func NewIssuer(certPem []byte, key gocrypto.Signer) (*Issuer, error) {
+	cert, err := DecodeCertificate(certPem)
+	if err != nil {
+		return nil, err
+	}
+
+	if GetCertificateRole(cert) != RoleIntermediate {
+		return nil, fmt.Errorf("certificate %s is not an issuing CA", cert.Subject.CommonName)
+	}
+
+	return &Issuer{Cert: cert, Key: key, Chain: certPem}, nil
+}
+
+func (i *Issuer) Issue(template *x509.Certificate, publicKey any) ([]byte, error) {
+	if template.SerialNumber == nil {
+		serial, err := GenerateSerialNumber()
+		if err != nil {
+			return nil, err
+		}
+		template.SerialNumber = serial
+	}
+
+	lifetime := ClientCertificateLifetime
+	if GetCertificateRole(template) == RoleNode {
+		lifetime = NodeCertificateLifetime
+	}
+	if !template.IsCA {
+		template.KeyUsage = leafKeyUsage(publicKey)
+	}
+	template.NotBefore = time.Now().Add(-CertificateClockSkew)
+	template.NotAfter = time.Now().Add(lifetime)
+	if template.NotAfter.After(i.Cert.NotAfter) {
+		template.NotAfter = i.Cert.NotAfter
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, i.Cert, publicKey, i.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.OnIssue != nil {
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := i.OnIssue(cert); err != nil {
+			return nil, err
+		}
+	}
+
+	certPem := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: certBytes,
+		},
+	)
+
+	return append(certPem, i.Chain...), nil
+}
+
+func (i *Issuer) Renew(current *x509.Certificate, csrBytes []byte) ([]byte, error) {
+	role := GetCertificateRole(current)
+	if role != RoleNode && role != RoleClient {
+		return nil, fmt.Errorf("certificates with %s role can not be renewed", role)
+	}
+
+	template := &x509.Certificate{
+		Subject:     current.Subject,
+		DNSNames:    current.DNSNames,
+		IPAddresses: current.IPAddresses,
+		ExtKeyUsage: current.ExtKeyUsage,
+		KeyUsage:    current.KeyUsage,
+	}
+
+	return i.IssueFromRequest(template, csrBytes)
+}
+
+func (i *Issuer) IssueFromRequest(template *x509.Certificate, csrBytes []byte) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+
+	return i.Issue(template, csr.PublicKey)
+}
+
+func CreateCertificateRequest(cert *x509.Certificate, key gocrypto.Signer) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject:     cert.Subject,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+	}
+
+	return x509.CreateCertificateRequest(rand.Reader, template, key)
+}
+
+func RenewalTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * 2 / 3)
+}
@@ -0,0 +1,139 @@
+package crypto
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func closeTo(got, want time.Time) bool {
+	return got.Sub(want).Abs() < 5*time.Second
+}
+
+func TestIssue(t *testing.T) {
+	p := newTestPKI(t)
+
+	var issued []*x509.Certificate
+	p.issuer.OnIssue = func(cert *x509.Certificate) error {
+		issued = append(issued, cert)
+		return nil
+	}
+
+	rsaKey, err := GenerateKey(RSA2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := GenerateKey(ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		template *x509.Certificate
+		key      any
+		lifetime time.Duration
+		usage    x509.KeyUsage
+	}{
+		{"node", GenerateNodeCertificate(nil, 1), ecKey.Public(), NodeCertificateLifetime, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement},
+		{"client", GenerateClientCertificate(nil, "client-1"), ecKey.Public(), ClientCertificateLifetime, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement},
+		{"rsa client", GenerateClientCertificate(nil, "client-2"), rsaKey.Public(), ClientCertificateLifetime, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment},
+	}
+
+	serials := make(map[string]bool)
+	for _, tt := range tests {
+		certPem, err := p.issuer.Issue(tt.template, tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var chain []*x509.Certificate
+		for block, rest := pem.Decode(certPem); block != nil; block, rest = pem.Decode(rest) {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chain = append(chain, cert)
+		}
+		if len(chain) != 2 || !chain[1].Equal(p.issuer.Cert) {
+			t.Fatalf("%s: issued %d certificates, want the leaf and the intermediate", tt.name, len(chain))
+		}
+
+		cert := chain[0]
+		if serials[cert.SerialNumber.String()] || cert.SerialNumber.Sign() <= 0 {
+			t.Errorf("%s: serial %s is not a fresh random serial", tt.name, cert.SerialNumber)
+		}
+		serials[cert.SerialNumber.String()] = true
+
+		if !closeTo(cert.NotBefore, time.Now().Add(-CertificateClockSkew)) || !closeTo(cert.NotAfter, time.Now().Add(tt.lifetime)) {
+			t.Errorf("%s: valid %s to %s, want %s from now", tt.name, cert.NotBefore, cert.NotAfter, tt.lifetime)
+		}
+		if cert.KeyUsage != tt.usage {
+			t.Errorf("%s: key usage %v, want %v", tt.name, cert.KeyUsage, tt.usage)
+		}
+	}
+
+	if len(issued) != len(tests) {
+		t.Errorf("OnIssue saw %d certificates, want %d", len(issued), len(tests))
+	}
+}
+
+func TestIssueCappedByIssuer(t *testing.T) {
+	p := newTestPKI(t)
+	p.issuer.Cert.NotAfter = time.Now().Add(time.Hour)
+
+	cert, _ := p.issue(t, GenerateClientCertificate(nil, "client-1"))
+	if !cert.NotAfter.Equal(p.issuer.Cert.NotAfter.Truncate(time.Second)) {
+		t.Errorf("certificate expires at %s, after its issuer at %s", cert.NotAfter, p.issuer.Cert.NotAfter)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	p := newTestPKI(t)
+	current, _ := p.issue(t, GenerateNodeCertificate(nil, 1))
+
+	key, err := GenerateKey(ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := CreateCertificateRequest(current, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem, err := p.issuer.Renew(current, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := DecodeCertificate(certPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Subject.String() != current.Subject.String() || GetCertificateRole(renewed) != RoleNode {
+		t.Errorf("renewed %s as %s, want %s as node", renewed.Subject, GetCertificateRole(renewed), current.Subject)
+	}
+	if renewed.SerialNumber.Cmp(current.SerialNumber) == 0 {
+		t.Error("renewed certificate kept the serial number")
+	}
+	if err := VerifyCertificate(renewed, RoleNode, p.roots, p.intermediates, nil); err != nil {
+		t.Errorf("renewed certificate: %v", err)
+	}
+
+	if _, err := p.issuer.Renew(p.issuer.Cert, csr); err == nil {
+		t.Error("renewed the intermediate")
+	}
+	tampered := append([]byte(nil), csr...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := p.issuer.Renew(current, tampered); err == nil {
+		t.Error("renewed from a request with a broken signature")
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: start, NotAfter: start.Add(72 * time.Hour)}
+	if got, want := RenewalTime(cert), start.Add(48*time.Hour); !got.Equal(want) {
+		t.Errorf("RenewalTime = %s, want %s", got, want)
+	}
+}
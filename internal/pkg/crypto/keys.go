@@ -0,0 +1,280 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+type KeyAlgorithm string
+
+const (
+	RSA2048   KeyAlgorithm = "rsa2048"
+	RSA4096   KeyAlgorithm = "rsa4096"
+	ECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	ECDSAP384 KeyAlgorithm = "ecdsa-p384"
+	Ed25519   KeyAlgorithm = "ed25519"
+)
+
+var KeyAlgorithms = []KeyAlgorithm{RSA2048, RSA4096, ECDSAP256, ECDSAP384, Ed25519}
+
+func ParseKeyAlgorithm(name string) (KeyAlgorithm, error) {
+	for _, alg := range KeyAlgorithms {
+		if string(alg) == name {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("unknown key algorithm %q", name)
+}
+
+func GenerateKey(alg KeyAlgorithm) (gocrypto.Signer, error) {
+	switch alg {
+	case RSA2048:
+		return GenerateRSAKey(2048)
+	case RSA4096:
+		return GenerateRSAKey(4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key algorithm %q", alg)
+}
+
+func GetKeyAlgorithm(key gocrypto.PrivateKey) (KeyAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() > 2048 {
+			return RSA4096, nil
+		}
+		return RSA2048, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P384() {
+			return ECDSAP384, nil
+		}
+		return ECDSAP256, nil
+	case ed25519.PrivateKey:
+		return Ed25519, nil
+	}
+	return "", fmt.Errorf("unsupported private key type %T", key)
+}
+
+func EncodePrivateKey(key gocrypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: der,
+		},
+	), nil
+}
+
+func DecodePrivateKey(keyPem []byte) (gocrypto.Signer, error) {
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, ok := key.(gocrypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported private key block %q", block.Type)
+}
+
+func leafKeyUsage(publicKey any) x509.KeyUsage {
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+}
+
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func ed25519PublicToX25519(publicKey ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key size")
+	}
+
+	yBytes := reverse(publicKey)
+	yBytes[0] &= 0x7f
+	y := new(big.Int).SetBytes(yBytes)
+
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, fmt.Errorf("invalid Ed25519 public key")
+	}
+	den.ModInverse(den, curve25519P)
+
+	u := num.Mul(num, den)
+	u.Mod(u, curve25519P)
+
+	uBytes := make([]byte, 32)
+	u.FillBytes(uBytes)
+	return ecdh.X25519().NewPublicKey(reverse(uBytes))
+}
+
+func ed25519PrivateToX25519(privateKey ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(privateKey.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+func agreementPublicKey(publicKey any) (*ecdh.PublicKey, error) {
+	switch k := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return k.ECDH()
+	case ed25519.PublicKey:
+		return ed25519PublicToX25519(k)
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", publicKey)
+}
+
+type keyAgreement interface {
+	PublicKey() *ecdh.PublicKey
+	ECDH(remote *ecdh.PublicKey) ([]byte, error)
+}
+
+func agreementPrivateKey(privateKey gocrypto.PrivateKey) (keyAgreement, error) {
+	switch k := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return k.ECDH()
+	case ed25519.PrivateKey:
+		return ed25519PrivateToX25519(k)
+	case *execSigner:
+		return k.agreement()
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+}
+
+func hkdf(secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	out := make([]byte, 0, length)
+	var previous []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand.Reset()
+		expand.Write(previous)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		previous = expand.Sum(nil)
+		out = append(out, previous...)
+	}
+	return out[:length]
+}
+
+func sealWithAgreement(message []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralBytes := ephemeral.PublicKey().Bytes()
+	info := append(append([]byte("trust ecies"), ephemeralBytes...), recipient.Bytes()...)
+
+	block, err := aes.NewCipher(hkdf(shared, info, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := append(ephemeralBytes, nonce...)
+	return gcm.Seal(ciphertext, nonce, message, nil), nil
+}
+
+func openWithAgreement(ciphertext []byte, key keyAgreement) ([]byte, error) {
+	size := len(key.PublicKey().Bytes())
+	if len(ciphertext) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	ephemeral, err := key.PublicKey().Curve().NewPublicKey(ciphertext[:size])
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	info := append(append([]byte("trust ecies"), ciphertext[:size]...), key.PublicKey().Bytes()...)
+
+	block, err := aes.NewCipher(hkdf(shared, info, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext = ciphertext[size:]
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,147 @@
+package crypto
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"testing"
+)
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869 test case 3: SHA-256 without salt and info.
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	want, _ := hex.DecodeString("8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8")
+	if got := hkdf(secret, nil, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("hkdf = %x, want %x", got, want)
+	}
+
+	if bytes.Equal(hkdf(secret, []byte("a"), 32), hkdf(secret, []byte("b"), 32)) {
+		t.Error("hkdf ignores info")
+	}
+}
+
+func testCertificate(t *testing.T, alg KeyAlgorithm) (*x509.Certificate, gocrypto.Signer) {
+	t.Helper()
+
+	key, err := GenerateKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := GenerateSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := GenerateCACertificate(serial)
+	certPem, err := EncodeCertificate(template, template, key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := DecodeCertificate(certPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestEncryptMessage(t *testing.T) {
+	for _, alg := range []KeyAlgorithm{RSA2048, ECDSAP256, ECDSAP384, Ed25519} {
+		t.Run(string(alg), func(t *testing.T) {
+			cert, key := testCertificate(t, alg)
+			_, otherKey := testCertificate(t, alg)
+			message := []byte("session key")
+
+			for _, scheme := range []struct {
+				name string
+				seal func([]byte, *x509.Certificate) ([]byte, error)
+				open func([]byte, gocrypto.PrivateKey) ([]byte, error)
+			}{
+				{"EncryptMessage", EncryptMessage, DecryptMessage},
+				{"SealMessage", SealMessage, OpenMessage},
+			} {
+				ciphertext, err := scheme.seal(message, cert)
+				if err != nil {
+					t.Fatal(err)
+				}
+				again, err := scheme.seal(message, cert)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Equal(ciphertext, again) {
+					t.Errorf("%s is deterministic", scheme.name)
+				}
+
+				if plaintext, err := scheme.open(ciphertext, key); err != nil || !bytes.Equal(plaintext, message) {
+					t.Errorf("%s: opened %q, %v", scheme.name, plaintext, err)
+				}
+				if _, err := scheme.open(ciphertext, otherKey); err == nil {
+					t.Errorf("%s: opened with another key", scheme.name)
+				}
+
+				tampered := append([]byte(nil), ciphertext...)
+				tampered[len(tampered)-1] ^= 1
+				if _, err := scheme.open(tampered, key); err == nil {
+					t.Errorf("%s: opened a tampered ciphertext", scheme.name)
+				}
+				if _, err := scheme.open(ciphertext[:8], key); err == nil {
+					t.Errorf("%s: opened a truncated ciphertext", scheme.name)
+				}
+			}
+		})
+	}
+}
+
+func TestEd25519ToX25519(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromPublic, err := ed25519PublicToX25519(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPrivate, err := ed25519PrivateToX25519(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromPublic.Equal(fromPrivate.PublicKey()) {
+		t.Error("X25519 keys derived from the Ed25519 key pair do not match")
+	}
+
+	if _, err := ed25519PublicToX25519(public[:16]); err == nil {
+		t.Error("converted a short Ed25519 public key")
+	}
+}
+
+func TestEncodePrivateKey(t *testing.T) {
+	for _, alg := range KeyAlgorithms {
+		if alg == RSA4096 {
+			continue
+		}
+
+		key, err := GenerateKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPem, err := EncodePrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodePrivateKey(keyPem)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if got, err := GetKeyAlgorithm(decoded); err != nil || got != alg {
+			t.Errorf("%s: decoded key is %s, %v", alg, got, err)
+		}
+		if parsed, err := ParseKeyAlgorithm(string(alg)); err != nil || parsed != alg {
+			t.Errorf("ParseKeyAlgorithm(%s) = %s, %v", alg, parsed, err)
+		}
+	}
+
+	if _, err := ParseKeyAlgorithm("dsa"); err == nil {
+		t.Error("parsed an unknown key algorithm")
+	}
+}
@@ -0,0 +1,134 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var KeyDerivationIterations = 600_000
+
+const encryptedKeyType = "TRUST ENCRYPTED PRIVATE KEY"
+
+func pbkdf2(passphrase, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	key := make([]byte, 0, keyLen)
+	counter := make([]byte, 4)
+
+	for block := uint32(1); len(key) < keyLen; block++ {
+		binary.BigEndian.PutUint32(counter, block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
+
+func newKeyCipher(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2(passphrase, salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func EncryptPEMBlock(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newKeyCipher(passphrase, salt, KeyDerivationIterations)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(
+		&pem.Block{
+			Type: encryptedKeyType,
+			Headers: map[string]string{
+				"Key-Type":   block.Type,
+				"Salt":       hex.EncodeToString(salt),
+				"Nonce":      hex.EncodeToString(nonce),
+				"Iterations": strconv.Itoa(KeyDerivationIterations),
+			},
+			Bytes: gcm.Seal(nil, nonce, block.Bytes, []byte(block.Type)),
+		},
+	), nil
+}
+
+func DecryptPEMBlock(data []byte, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyType {
+		return nil, fmt.Errorf("no encrypted private key found")
+	}
+
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, err
+	}
+
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newKeyCipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size")
+	}
+
+	keyType := block.Headers["Key-Type"]
+	plaintext, err := gcm.Open(nil, nonce, block.Bytes, []byte(keyType))
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted key")
+	}
+
+	return pem.EncodeToMemory(
+		&pem.Block{
+			Type:  keyType,
+			Bytes: plaintext,
+		},
+	), nil
+}
@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/pem"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 vectors from RFC 7914 section 11, and the RFC 6070
+	// inputs with embedded zero bytes run through SHA-256.
+	tests := []struct {
+		passphrase, salt string
+		iterations       int
+		key              string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+	}
+
+	for _, tt := range tests {
+		want, _ := hex.DecodeString(tt.key)
+		if got := pbkdf2([]byte(tt.passphrase), []byte(tt.salt), tt.iterations, len(want)); !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x, want %x", tt.passphrase, tt.salt, tt.iterations, got, want)
+		}
+	}
+}
+
+func TestEncryptPEMBlock(t *testing.T) {
+	defer func(iterations int) { KeyDerivationIterations = iterations }(KeyDerivationIterations)
+	KeyDerivationIterations = 1000
+
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key material")}
+	encrypted, err := EncryptPEMBlock(block, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, block.Bytes) {
+		t.Fatal("key material is stored in the clear")
+	}
+
+	decrypted, err := DecryptPEMBlock(encrypted, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, pem.EncodeToMemory(block)) {
+		t.Errorf("DecryptPEMBlock = %s, want %s", decrypted, pem.EncodeToMemory(block))
+	}
+
+	if _, err := DecryptPEMBlock(encrypted, []byte("wrong")); err == nil {
+		t.Error("decrypted with a wrong passphrase")
+	}
+
+	// The key type is authenticated, so relabelling the key must fail.
+	relabelled, _ := pem.Decode(encrypted)
+	relabelled.Headers["Key-Type"] = "EC PRIVATE KEY"
+	if _, err := DecryptPEMBlock(pem.EncodeToMemory(relabelled), []byte("secret")); err == nil {
+		t.Error("decrypted a key with a changed type")
+	}
+
+	if _, err := EncryptPEMBlock(block, nil); err == nil {
+		t.Error("encrypted with an empty passphrase")
+	}
+}
@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+var RevocationListValidity = 7 * 24 * time.Hour
+
+func CreateRevocationList(number int64, revoked []x509.RevocationListEntry, issuer *x509.Certificate, key gocrypto.Signer) ([]byte, error) {
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(number),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(RevocationListValidity),
+		RevokedCertificateEntries: revoked,
+	}
+
+	return x509.CreateRevocationList(rand.Reader, template, issuer, key)
+}
+
+func EncodeRevocationList(der []byte) []byte {
+	return pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "X509 CRL",
+			Bytes: der,
+		},
+	)
+}
+
+func ReadRevocationListFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, fmt.Errorf("no revocation list found in %s", path)
+	}
+
+	return block.Bytes, nil
+}
+
+var oidCertificateIssuer = asn1.ObjectIdentifier{2, 5, 29, 29}
+
+type revokedCert struct {
+	issuer string
+	serial string
+}
+
+func RevocationEntry(cert *x509.Certificate, revokedAt time.Time) (x509.RevocationListEntry, error) {
+	names, err := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: cert.RawIssuer}})
+	if err != nil {
+		return x509.RevocationListEntry{}, err
+	}
+
+	return x509.RevocationListEntry{
+		SerialNumber:    cert.SerialNumber,
+		RevocationTime:  revokedAt,
+		ExtraExtensions: []pkix.Extension{{Id: oidCertificateIssuer, Critical: true, Value: names}},
+	}, nil
+}
+
+func entryIssuer(entry x509.RevocationListEntry) ([]byte, bool, error) {
+	for _, ext := range entry.Extensions {
+		if !ext.Id.Equal(oidCertificateIssuer) {
+			continue
+		}
+
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return nil, false, err
+		}
+		for _, name := range names {
+			if name.Class == asn1.ClassContextSpecific && name.Tag == 4 {
+				return name.Bytes, true, nil
+			}
+		}
+		return nil, false, fmt.Errorf("certificate issuer of revoked serial %s has no directory name", entry.SerialNumber)
+	}
+	return nil, false, nil
+}
+
+type RevocationStore struct {
+	mu      sync.RWMutex
+	issuer  *x509.Certificate
+	list    *x509.RevocationList
+	revoked map[revokedCert]bool
+}
+
+func NewRevocationStore(issuer *x509.Certificate) *RevocationStore {
+	return &RevocationStore{
+		issuer:  issuer,
+		revoked: make(map[revokedCert]bool),
+	}
+}
+
+func (s *RevocationStore) Update(der []byte) (bool, error) {
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return false, err
+	}
+
+	if err := list.CheckSignatureFrom(s.issuer); err != nil {
+		return false, fmt.Errorf("revocation list not signed by CA: %v", err)
+	}
+	if !list.NextUpdate.IsZero() && time.Now().After(list.NextUpdate) {
+		return false, fmt.Errorf("revocation list %s expired at %s", list.Number, list.NextUpdate)
+	}
+
+	// Entries without a certificate issuer extension belong to the issuer of
+	// the previous entry, starting with the issuer of the list (RFC 5280 5.3.3).
+	issuer := list.RawIssuer
+	revoked := make(map[revokedCert]bool, len(list.RevokedCertificateEntries))
+	for _, entry := range list.RevokedCertificateEntries {
+		next, ok, err := entryIssuer(entry)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			issuer = next
+		}
+		revoked[revokedCert{issuer: string(issuer), serial: entry.SerialNumber.String()}] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.list != nil && list.Number.Cmp(s.list.Number) <= 0 {
+		return false, nil
+	}
+
+	s.list = list
+	s.revoked = revoked
+	return true, nil
+}
+
+func (s *RevocationStore) Bytes() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.list == nil {
+		return nil
+	}
+	return s.list.Raw
+}
+
+func (s *RevocationStore) IsRevoked(cert *x509.Certificate) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.revoked[revokedCert{issuer: string(cert.RawIssuer), serial: cert.SerialNumber.String()}]
+}
+
+func (s *RevocationStore) Check(certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		if s.IsRevoked(cert) {
+			return fmt.Errorf("certificate %s (serial %s) is revoked", cert.Subject.CommonName, cert.SerialNumber)
+		}
+	}
+	return nil
+}
+
+func (s *RevocationStore) VerifyConnection(state tls.ConnectionState) error {
+	return s.Check(state.PeerCertificates)
+}
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestRevocationStoreUpdate(t *testing.T) {
+	p := newTestPKI(t)
+	other := newTestPKI(t)
+
+	list := func(number int64, entries ...x509.RevocationListEntry) []byte {
+		der, err := CreateRevocationList(number, entries, p.root, p.rootKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+
+	expired, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(10),
+		ThisUpdate: time.Now().Add(-2 * time.Hour),
+		NextUpdate: time.Now().Add(-time.Hour),
+	}, p.root, p.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := CreateRevocationList(10, nil, other.root, other.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewRevocationStore(p.root)
+	steps := []struct {
+		name    string
+		der     []byte
+		updated bool
+		valid   bool
+	}{
+		{"first list", list(2), true, true},
+		{"same number", list(2), false, true},
+		{"older number", list(1), false, true},
+		{"newer number", list(3), true, true},
+		{"expired", expired, false, false},
+		{"signed by another CA", foreign, false, false},
+		{"garbage", []byte("not a list"), false, false},
+	}
+
+	for _, step := range steps {
+		updated, err := store.Update(step.der)
+		if updated != step.updated || (err == nil) != step.valid {
+			t.Errorf("%s: Update = %v, %v, want updated %v, valid %v", step.name, updated, err, step.updated, step.valid)
+		}
+	}
+	if list, err := x509.ParseRevocationList(store.Bytes()); err != nil || list.Number.Int64() != 3 {
+		t.Errorf("store kept list %v, %v, want number 3", list, err)
+	}
+}
+
+func TestRevocationStoreIssuerAndSerial(t *testing.T) {
+	p := newTestPKI(t)
+
+	revoked, _ := p.issue(t, GenerateClientCertificate(nil, "client-1"))
+	kept, _ := p.issue(t, GenerateClientCertificate(nil, "client-2"))
+
+	// Same serial number, but issued by the next intermediate of the root.
+	nextKey, err := GenerateKey(ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextTemplate := GenerateIntermediateCertificate(big.NewInt(2))
+	nextTemplate.Subject.CommonName = "Trust Issuing CA 2"
+	nextPem, err := EncodeCertificate(nextTemplate, p.root, nextKey, p.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := NewIssuer(nextPem, nextKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twin := &testPKI{issuer: next}
+	twinCert, _ := twin.issue(t, GenerateClientCertificate(revoked.SerialNumber, "client-1"))
+
+	entry, err := RevocationEntry(revoked, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a certificate issuer extension the serial belongs to the
+	// issuer of the list, so it must not revoke the intermediate's leaf.
+	bare := x509.RevocationListEntry{SerialNumber: kept.SerialNumber, RevocationTime: time.Now()}
+
+	der, err := CreateRevocationList(1, []x509.RevocationListEntry{bare, entry}, p.root, p.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewRevocationStore(p.root)
+	if _, err := store.Update(der); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		revoked bool
+	}{
+		{"revoked", revoked, true},
+		{"serial listed for the root", kept, false},
+		{"same serial from another issuer", twinCert, false},
+	}
+
+	for _, tt := range tests {
+		if got := store.IsRevoked(tt.cert); got != tt.revoked {
+			t.Errorf("%s: IsRevoked = %v, want %v", tt.name, got, tt.revoked)
+		}
+	}
+
+	if err := VerifyCertificate(revoked, RoleClient, p.roots, p.intermediates, store); err == nil {
+		t.Error("VerifyCertificate accepted a revoked certificate")
+	}
+	if err := VerifyCertificate(kept, RoleClient, p.roots, p.intermediates, store); err != nil {
+		t.Errorf("VerifyCertificate: %v", err)
+	}
+}
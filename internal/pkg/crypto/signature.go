@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+)
+
+func Sign(key gocrypto.PrivateKey, data []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		return rsa.SignPSS(rand.Reader, k, gocrypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.SignASN1(rand.Reader, k, digest[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, data), nil
+	case gocrypto.Signer:
+		return signWithSigner(k, data)
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+func signWithSigner(signer gocrypto.Signer, data []byte) ([]byte, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: gocrypto.SHA256})
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return signer.Sign(rand.Reader, digest[:], gocrypto.SHA256)
+	case ed25519.PublicKey:
+		return signer.Sign(rand.Reader, data, gocrypto.Hash(0))
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", signer.Public())
+}
+
+func VerifySignature(cert *x509.Certificate, data []byte, signature []byte) error {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPSS(k, gocrypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+}
@@ -0,0 +1,65 @@
+package crypto
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"testing"
+)
+
+type opaqueSigner struct {
+	gocrypto.Signer
+}
+
+func TestSignEd25519Vector(t *testing.T) {
+	// RFC 8032 section 7.1, test 1: the empty message.
+	seed, _ := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	public, _ := hex.DecodeString("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+	want, _ := hex.DecodeString("e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b")
+
+	key := ed25519.NewKeyFromSeed(seed)
+	for _, signer := range []gocrypto.PrivateKey{key, opaqueSigner{key}} {
+		if got, err := Sign(signer, nil); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("Sign(%T) = %x, %v, want %x", signer, got, err, want)
+		}
+	}
+
+	cert := &x509.Certificate{PublicKey: ed25519.PublicKey(public)}
+	if err := VerifySignature(cert, nil, want); err != nil {
+		t.Errorf("VerifySignature: %v", err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	for _, alg := range []KeyAlgorithm{RSA2048, ECDSAP256, ECDSAP384, Ed25519} {
+		t.Run(string(alg), func(t *testing.T) {
+			cert, key := testCertificate(t, alg)
+			other, _ := testCertificate(t, alg)
+			data := []byte("signed envelope")
+
+			// Keys held behind a gocrypto.Signer, like the exec signer, must
+			// produce signatures VerifySignature accepts.
+			for _, signer := range []gocrypto.PrivateKey{key, opaqueSigner{key}} {
+				signature, err := Sign(signer, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := VerifySignature(cert, data, signature); err != nil {
+					t.Errorf("Sign(%T): %v", signer, err)
+				}
+				if err := VerifySignature(cert, []byte("signed envelopE"), signature); err == nil {
+					t.Errorf("Sign(%T): verified changed data", signer)
+				}
+				if err := VerifySignature(other, data, signature); err == nil {
+					t.Errorf("Sign(%T): verified with another certificate", signer)
+				}
+			}
+		})
+	}
+
+	if _, err := Sign("not a key", nil); err == nil {
+		t.Error("signed with an unsupported key")
+	}
+}
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// The command is run as "<command> public", printing the PEM public key, and
+// "<command> sign <hash> [pss]", reading the digest (or the message when the
+// hash is "none") on stdin and printing the raw signature. Clients and relays
+// also open session keys and onion layers with it: "<command> decrypt" reads
+// an RSA-OAEP SHA-512 ciphertext and prints the plaintext, and "<command>
+// ecdh" reads a raw peer public key (X25519 for Ed25519 keys) and prints the
+// shared secret. This is enough to put keys held in an HSM or a PKCS#11 token
+// behind a small helper script.
+type execSigner struct {
+	command []string
+	public  gocrypto.PublicKey
+}
+
+func newExecSigner(uri string) (gocrypto.Signer, error) {
+	command := strings.Fields(strings.TrimPrefix(uri, "exec:"))
+	if len(command) == 0 {
+		return nil, fmt.Errorf("exec signer needs a command, got %q", uri)
+	}
+
+	s := &execSigner{command: command}
+	out, err := s.run(nil, "public")
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(out)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s public: expected a PEM encoded PUBLIC KEY", command[0])
+	}
+	s.public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s public: %v", command[0], err)
+	}
+	return s, nil
+}
+
+func (s *execSigner) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(s.command[0], append(s.command[1:], args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v: %s", s.command[0], strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (s *execSigner) Public() gocrypto.PublicKey {
+	return s.public
+}
+
+func (s *execSigner) Sign(_ io.Reader, digest []byte, opts gocrypto.SignerOpts) ([]byte, error) {
+	hash := "none"
+	if opts.HashFunc() != 0 {
+		hash = opts.HashFunc().String()
+	}
+
+	args := []string{"sign", hash}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		if pss.SaltLength != rsa.PSSSaltLengthAuto && pss.SaltLength != rsa.PSSSaltLengthEqualsHash {
+			return nil, fmt.Errorf("exec signer only supports PSS salts as long as the hash, got %d", pss.SaltLength)
+		}
+		args = append(args, "pss")
+	}
+
+	signature, err := s.run(digest, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) == 0 {
+		return nil, fmt.Errorf("%s sign: empty signature", s.command[0])
+	}
+	return signature, nil
+}
+
+func (s *execSigner) Decrypt(_ io.Reader, ciphertext []byte, opts gocrypto.DecrypterOpts) ([]byte, error) {
+	if oaep, ok := opts.(*rsa.OAEPOptions); !ok || oaep.Hash != gocrypto.SHA512 || len(oaep.Label) != 0 {
+		return nil, fmt.Errorf("exec signer only decrypts RSA-OAEP with SHA-512")
+	}
+	return s.run(ciphertext, "decrypt")
+}
+
+type execAgreement struct {
+	signer *execSigner
+	public *ecdh.PublicKey
+}
+
+func (s *execSigner) agreement() (keyAgreement, error) {
+	public, err := agreementPublicKey(s.public)
+	if err != nil {
+		return nil, err
+	}
+	return &execAgreement{signer: s, public: public}, nil
+}
+
+func (a *execAgreement) PublicKey() *ecdh.PublicKey {
+	return a.public
+}
+
+func (a *execAgreement) ECDH(remote *ecdh.PublicKey) ([]byte, error) {
+	shared, err := a.signer.run(remote.Bytes(), "ecdh")
+	if err != nil {
+		return nil, err
+	}
+	if len(shared) == 0 {
+		return nil, fmt.Errorf("%s ecdh: empty shared secret", a.signer.command[0])
+	}
+	return shared, nil
+}
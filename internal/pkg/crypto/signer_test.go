@@ -0,0 +1,195 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExecSignerHelper(t *testing.T) {
+	keyFile := os.Getenv("EXEC_SIGNER_KEY")
+	if keyFile == "" {
+		t.Skip("only runs as the helper of TestExecSigner")
+	}
+
+	if err := execSignerHelper(keyFile, flagArgs()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func flagArgs() []string {
+	for i, arg := range os.Args {
+		if arg == "--" {
+			return os.Args[i+1:]
+		}
+	}
+	return nil
+}
+
+func execSignerHelper(keyFile string, args []string) error {
+	keyPem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := DecodePrivateKey(keyPem)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "public":
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return err
+		}
+		return pem.Encode(os.Stdout, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	case len(args) >= 2 && args[0] == "sign":
+		digest, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		var opts gocrypto.SignerOpts = gocrypto.Hash(0)
+		if args[1] == "SHA-256" {
+			opts = gocrypto.SHA256
+		}
+		if len(args) == 3 && args[2] == "pss" {
+			opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: gocrypto.SHA256}
+		}
+
+		signature, err := key.Sign(rand.Reader, digest, opts)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(signature)
+		return err
+	case len(args) == 1 && args[0] == "decrypt":
+		ciphertext, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		plaintext, err := DecryptMessage(ciphertext, key)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(plaintext)
+		return err
+	case len(args) == 1 && args[0] == "ecdh":
+		remote, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		agreement, err := agreementPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		publicKey, err := agreement.PublicKey().Curve().NewPublicKey(remote)
+		if err != nil {
+			return err
+		}
+		shared, err := agreement.ECDH(publicKey)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(shared)
+		return err
+	}
+	return errors.New("usage: public | sign <hash> [pss] | decrypt | ecdh")
+}
+
+func TestExecSigner(t *testing.T) {
+	tests := []struct {
+		name string
+		alg  KeyAlgorithm
+	}{
+		{"ecdsa", ECDSAP256},
+		{"rsa", RSA2048},
+		{"ed25519", Ed25519},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := GenerateKey(tt.alg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyPem, err := EncodePrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyFile := filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("EXEC_SIGNER_KEY", keyFile)
+
+			signer, err := signerProviders["exec"]("exec:" + os.Args[0] + " -test.run=^TestExecSignerHelper$ --")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serial, err := GenerateSerialNumber()
+			if err != nil {
+				t.Fatal(err)
+			}
+			template := GenerateCACertificate(serial)
+			certPem, err := EncodeCertificate(template, template, signer, signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := DecodeCertificate(certPem)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cert.CheckSignatureFrom(cert); err != nil {
+				t.Errorf("self-signed certificate: %v", err)
+			}
+
+			data := []byte("signed through a helper")
+			signature, err := Sign(signer, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifySignature(cert, data, signature); err != nil {
+				t.Errorf("VerifySignature: %v", err)
+			}
+			digest := sha256.Sum256([]byte("other data"))
+			if err := VerifySignature(cert, digest[:], signature); err == nil {
+				t.Error("signature verified over other data")
+			}
+
+			secret := []byte("opened through a helper")
+			encrypted, err := EncryptMessage(secret, cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plaintext, err := DecryptMessage(encrypted, signer); err != nil || string(plaintext) != string(secret) {
+				t.Errorf("DecryptMessage = %q, %v", plaintext, err)
+			}
+			sealed, err := SealMessage(secret, cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plaintext, err := OpenMessage(sealed, signer); err != nil || string(plaintext) != string(secret) {
+				t.Errorf("OpenMessage = %q, %v", plaintext, err)
+			}
+		})
+	}
+
+	if _, err := signerProviders["exec"]("exec:"); err == nil {
+		t.Error("exec signer without a command: expected an error")
+	}
+}
@@ -0,0 +1,131 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+const ALPNProtocol = "trust/1"
+
+type TLSProfile struct {
+	MinVersion        uint16
+	CurvePreferences  []tls.CurveID
+	CipherSuites      []uint16
+	TicketKeyRotation time.Duration
+}
+
+var DefaultTLSProfile = TLSProfile{
+	MinVersion:       tls.VersionTLS13,
+	CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	CipherSuites: []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	},
+	TicketKeyRotation: 12 * time.Hour,
+}
+
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, expected 1.2 or 1.3", version)
+}
+
+func NewTLSProfile(minVersion string, ticketKeyRotation time.Duration) (TLSProfile, error) {
+	profile := DefaultTLSProfile
+	if minVersion != "" {
+		version, err := ParseTLSVersion(minVersion)
+		if err != nil {
+			return TLSProfile{}, err
+		}
+		profile.MinVersion = version
+	}
+	if ticketKeyRotation > 0 {
+		profile.TicketKeyRotation = ticketKeyRotation
+	}
+	return profile, nil
+}
+
+func (p TLSProfile) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:       p.MinVersion,
+		CurvePreferences: p.CurvePreferences,
+		CipherSuites:     p.CipherSuites,
+		NextProtos:       []string{ALPNProtocol},
+	}
+}
+
+func NewCertPool(caPem []byte) (*x509.CertPool, error) {
+	if len(caPem) == 0 {
+		return nil, fmt.Errorf("CA certificate bundle is empty")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("CA certificate bundle contains no valid certificates")
+	}
+	return pool, nil
+}
+
+func GetTLSConfig(cer tls.Certificate, caPem []byte, revocations *RevocationStore, profile TLSProfile) (*tls.Config, error) {
+	caCertPool, err := NewCertPool(caPem)
+	if err != nil {
+		return nil, err
+	}
+
+	config := profile.Config()
+	config.Certificates = []tls.Certificate{cer}
+	config.RootCAs = caCertPool
+	config.ClientCAs = caCertPool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if revocations != nil {
+		config.VerifyConnection = revocations.VerifyConnection
+	}
+
+	return config, nil
+}
+
+func CheckALPN(conn *tls.Conn) error {
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != ALPNProtocol {
+		return fmt.Errorf("peer %s did not negotiate %s (got %q)", conn.RemoteAddr(), ALPNProtocol, protocol)
+	}
+	return nil
+}
+
+func newSessionTicketKey() ([32]byte, error) {
+	var key [32]byte
+	_, err := io.ReadFull(rand.Reader, key[:])
+	return key, err
+}
+
+func RotateSessionTicketKeys(config *tls.Config, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	var previous [][32]byte
+	for {
+		key, err := newSessionTicketKey()
+		if err != nil {
+			slog.Warn("Rotating session ticket keys", "err", err)
+		} else {
+			keys := append([][32]byte{key}, previous...)
+			config.SetSessionTicketKeys(keys)
+			previous = keys[:1]
+		}
+		time.Sleep(interval)
+	}
+}
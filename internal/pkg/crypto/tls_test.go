@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewTLSProfile(t *testing.T) {
+	tests := []struct {
+		version  string
+		rotation time.Duration
+		min      uint16
+		valid    bool
+	}{
+		{"", 0, tls.VersionTLS13, true},
+		{"1.2", time.Hour, tls.VersionTLS12, true},
+		{"1.3", 0, tls.VersionTLS13, true},
+		{"1.1", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		profile, err := NewTLSProfile(tt.version, tt.rotation)
+		if (err == nil) != tt.valid {
+			t.Errorf("NewTLSProfile(%q): error = %v, want valid %v", tt.version, err, tt.valid)
+			continue
+		}
+		if !tt.valid {
+			continue
+		}
+
+		rotation := tt.rotation
+		if rotation == 0 {
+			rotation = DefaultTLSProfile.TicketKeyRotation
+		}
+		if profile.MinVersion != tt.min || profile.TicketKeyRotation != rotation {
+			t.Errorf("NewTLSProfile(%q, %s) = min %x, rotation %s", tt.version, tt.rotation, profile.MinVersion, profile.TicketKeyRotation)
+		}
+		if config := profile.Config(); len(config.NextProtos) != 1 || config.NextProtos[0] != ALPNProtocol {
+			t.Errorf("profile offers %v, want only %s", config.NextProtos, ALPNProtocol)
+		}
+	}
+}
+
+func (p *testPKI) keyPair(t *testing.T, template *x509.Certificate) (*x509.Certificate, tls.Certificate) {
+	t.Helper()
+
+	cert, key := p.issue(t, template)
+	return cert, tls.Certificate{Certificate: [][]byte{cert.Raw, p.issuer.Cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (*tls.Conn, error, error) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	server := tls.Server(serverConn, serverConfig)
+	client := tls.Client(clientConn, clientConfig)
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Handshake() }()
+	clientErr := client.Handshake()
+	if clientErr != nil {
+		client.Close()
+	} else {
+		// The pipe is unbuffered: drain the tickets or the alert the server
+		// writes after the client has finished its side of the handshake.
+		go io.Copy(io.Discard, client)
+	}
+	return server, <-serverErr, clientErr
+}
+
+func TestTLSHandshake(t *testing.T) {
+	p := newTestPKI(t)
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.root.Raw})
+
+	_, nodeCert := p.keyPair(t, GenerateNodeCertificate(nil, 1))
+	_, clientCert := p.keyPair(t, GenerateClientCertificate(nil, "client-1"))
+	revokedLeaf, revokedCert := p.keyPair(t, GenerateClientCertificate(nil, "client-2"))
+
+	entry, err := RevocationEntry(revokedLeaf, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := CreateRevocationList(1, []x509.RevocationListEntry{entry}, p.root, p.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations := NewRevocationStore(p.root)
+	if _, err := revocations.Update(crl); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig, err := GetTLSConfig(nodeCert, caPem, revocations, DefaultTLSProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := func(cert tls.Certificate) *tls.Config {
+		config, err := GetTLSConfig(cert, caPem, nil, DefaultTLSProfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.ServerName = NodeServerName(1)
+		return config
+	}
+
+	server, serverErr, clientErr := handshake(t, serverConfig, clientConfig(clientCert))
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake: server %v, client %v", serverErr, clientErr)
+	}
+	if err := CheckALPN(server); err != nil {
+		t.Errorf("CheckALPN: %v", err)
+	}
+
+	noALPN := clientConfig(clientCert)
+	noALPN.NextProtos = nil
+	server, serverErr, _ = handshake(t, serverConfig, noALPN)
+	if serverErr == nil && CheckALPN(server) == nil {
+		t.Error("accepted a client without the trust ALPN protocol")
+	}
+
+	oldTLS := clientConfig(clientCert)
+	oldTLS.MaxVersion = tls.VersionTLS12
+	if _, serverErr, clientErr := handshake(t, serverConfig, oldTLS); serverErr == nil && clientErr == nil {
+		t.Error("accepted TLS 1.2 with a TLS 1.3 profile")
+	}
+
+	if _, serverErr, _ := handshake(t, serverConfig, clientConfig(revokedCert)); serverErr == nil {
+		t.Error("accepted a revoked client certificate")
+	}
+
+	wrongName := clientConfig(clientCert)
+	wrongName.ServerName = NodeServerName(2)
+	if _, _, clientErr := handshake(t, serverConfig, wrongName); clientErr == nil {
+		t.Error("client accepted a node certificate for another node")
+	}
+}
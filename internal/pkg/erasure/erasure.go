@@ -0,0 +1,204 @@
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrTooFewShards = errors.New("not enough shards to reconstruct")
+var ErrShardSize = errors.New("shards have different sizes")
+
+var expTable [510]byte
+var logTable [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(expTable); i++ {
+		expTable[i] = expTable[i-255]
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+type Code struct {
+	k, n   int
+	matrix [][]byte
+}
+
+func New(k, n int) (*Code, error) {
+	if k < 1 || n < k || n > 256 {
+		return nil, fmt.Errorf("invalid erasure code %d of %d", k, n)
+	}
+
+	matrix := make([][]byte, n)
+	for r := range matrix {
+		matrix[r] = make([]byte, k)
+		if r < k {
+			matrix[r][r] = 1
+			continue
+		}
+		for c := 0; c < k; c++ {
+			matrix[r][c] = inv(byte(r) ^ byte(c))
+		}
+	}
+	return &Code{k: k, n: n, matrix: matrix}, nil
+}
+
+func (c *Code) DataShards() int {
+	return c.k
+}
+
+func (c *Code) Shards() int {
+	return c.n
+}
+
+func (c *Code) Encode(data []byte) [][]byte {
+	size := (len(data) + c.k - 1) / c.k
+	shards := make([][]byte, c.n)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < c.k && i*size < len(data) {
+			copy(shards[i], data[i*size:])
+		}
+	}
+
+	for r := c.k; r < c.n; r++ {
+		c.combine(c.matrix[r], shards[:c.k], shards[r])
+	}
+	return shards
+}
+
+func (c *Code) combine(row []byte, inputs [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for j, input := range inputs {
+		coef := row[j]
+		if coef == 0 {
+			continue
+		}
+		for i, b := range input {
+			out[i] ^= mul(coef, b)
+		}
+	}
+}
+
+func (c *Code) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.n {
+		return fmt.Errorf("expected %d shards, got %d", c.n, len(shards))
+	}
+
+	size := -1
+	rows := make([]int, 0, c.k)
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+		if len(rows) < c.k {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < c.k {
+		return ErrTooFewShards
+	}
+
+	sub := make([][]byte, c.k)
+	inputs := make([][]byte, c.k)
+	for i, r := range rows {
+		sub[i] = append([]byte{}, c.matrix[r]...)
+		inputs[i] = shards[r]
+	}
+
+	decode, err := invert(sub)
+	if err != nil {
+		return err
+	}
+
+	for r := 0; r < c.k; r++ {
+		if shards[r] == nil {
+			shards[r] = make([]byte, size)
+			c.combine(decode[r], inputs, shards[r])
+		}
+	}
+	for r := c.k; r < c.n; r++ {
+		if shards[r] == nil {
+			shards[r] = make([]byte, size)
+			c.combine(c.matrix[r], shards[:c.k], shards[r])
+		}
+	}
+	return nil
+}
+
+func (c *Code) Join(shards [][]byte, size int) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for _, shard := range shards[:c.k] {
+		if shard == nil {
+			return nil, ErrTooFewShards
+		}
+		data = append(data, shard...)
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("shards hold %d bytes, expected %d", len(data), size)
+	}
+	return data[:size], nil
+}
+
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = make([]byte, n)
+		out[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, fmt.Errorf("singular decoding matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		out[col], out[pivot] = out[pivot], out[col]
+
+		scale := inv(m[col][col])
+		for j := 0; j < n; j++ {
+			m[col][j] = mul(m[col][j], scale)
+			out[col][j] = mul(out[col][j], scale)
+		}
+
+		for r := 0; r < n; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			factor := m[r][col]
+			for j := 0; j < n; j++ {
+				m[r][j] ^= mul(factor, m[col][j])
+				out[r][j] ^= mul(factor, out[col][j])
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,116 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		k, n int
+		ok   bool
+	}{
+		{1, 1, true},
+		{4, 6, true},
+		{10, 256, true},
+		{0, 2, false},
+		{3, 2, false},
+		{4, 257, false},
+	}
+
+	for _, tt := range tests {
+		_, err := New(tt.k, tt.n)
+		if (err == nil) != tt.ok {
+			t.Errorf("New(%d, %d) error = %v, want ok %v", tt.k, tt.n, err, tt.ok)
+		}
+	}
+}
+
+func TestReconstruct(t *testing.T) {
+	tests := []struct {
+		k, n, size int
+	}{
+		{1, 1, 10},
+		{1, 3, 10},
+		{2, 3, 1},
+		{3, 5, 100},
+		{4, 6, 64 * 1024},
+		{5, 8, 1000},
+	}
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, tt := range tests {
+		code, err := New(tt.k, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, tt.size)
+		for i := range data {
+			data[i] = byte(rng.IntN(256))
+		}
+		encoded := code.Encode(data)
+
+		// Every way of losing up to n-k shards must be recoverable.
+		for lost := 0; lost < 1<<tt.n; lost++ {
+			missing := 0
+			shards := make([][]byte, tt.n)
+			for i := range shards {
+				if lost&(1<<i) != 0 {
+					missing++
+					continue
+				}
+				shards[i] = append([]byte{}, encoded[i]...)
+			}
+			if missing > tt.n-tt.k {
+				continue
+			}
+
+			if err := code.Reconstruct(shards); err != nil {
+				t.Fatalf("%d of %d, lost %b: %v", tt.k, tt.n, lost, err)
+			}
+			for i := range shards {
+				if !bytes.Equal(shards[i], encoded[i]) {
+					t.Fatalf("%d of %d, lost %b: shard %d differs after reconstruction", tt.k, tt.n, lost, i)
+				}
+			}
+
+			joined, err := code.Join(shards, tt.size)
+			if err != nil {
+				t.Fatalf("%d of %d, lost %b: %v", tt.k, tt.n, lost, err)
+			}
+			if !bytes.Equal(joined, data) {
+				t.Fatalf("%d of %d, lost %b: joined data differs", tt.k, tt.n, lost)
+			}
+		}
+	}
+}
+
+func TestReconstructErrors(t *testing.T) {
+	code, err := New(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := code.Encode([]byte("the quick brown fox jumps over the lazy dog"))
+
+	tests := []struct {
+		name   string
+		shards [][]byte
+		err    error
+	}{
+		{"too few", [][]byte{encoded[0], nil, nil, encoded[3], nil}, ErrTooFewShards},
+		{"different sizes", [][]byte{encoded[0], encoded[1][:1], encoded[2], nil, nil}, ErrShardSize},
+	}
+
+	for _, tt := range tests {
+		if err := code.Reconstruct(tt.shards); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	if err := code.Reconstruct(encoded[:4]); err == nil {
+		t.Error("wrong shard count: expected an error")
+	}
+}
@@ -3,19 +3,34 @@ package flags
 import (
 	"flag"
 	"log"
+	"time"
 )
 
 type ServerFlags struct {
-	NodeId     int
-	NodeCount  int
-	Host       string
-	Port       string
-	Cert       string
-	Key        string
-	Ca         string
-	Timeout    int
-	Peers      string
-	BufferSize int
+	NodeId      int
+	NodeCount   int
+	Host        string
+	Port        string
+	Cert        string
+	Key         string
+	Ca          string
+	Crl         string
+	Issuer      string
+	Timeout     int
+	Peers       string
+	BufferSize  int
+	TLSVersion  string
+	TicketKeys  time.Duration
+	Log         string
+	Store       string
+	Replicas    int
+	ClientRate  float64
+	ClientBurst float64
+	PeerRate    float64
+	PeerBurst   float64
+	Quota       int64
+	LogLevel    string
+	LogFormat   string
 }
 
 type ClientFlags struct {
@@ -23,8 +38,23 @@ type ClientFlags struct {
 	ServerPort         string
 	Cert               string
 	Key                string
+	Ca                 string
+	Crl                string
+	Issuer             string
+	ServerName         string
+	TLSVersion         string
 	BufferSize         int
 	ValidateBlockchain bool
+	OnionHops          int
+	CoverTraffic       time.Duration
+	Ledger             string
+	TreeHeads          time.Duration
+	Shards             int
+	Parity             int
+	Allow              string
+	Blocklist          string
+	LogLevel           string
+	LogFormat          string
 }
 
 const (
@@ -38,39 +68,82 @@ func ParseServerFlags() *ServerFlags {
 	host := flag.String("host", HOST, "Listening host")
 	port := flag.String("port", PORT, "Listening port")
 
-	cert := flag.String("cert", "", "Certificate in Base64")
-	key := flag.String("key", "", "Key in Base64")
-	ca := flag.String("ca", "", "CA certificate in Base64")
+	cert := flag.String("cert", "", "Certificate source (path, file:<path>, env:<var> or stdin)")
+	key := flag.String("key", "", "Key source (path, file:<path>, env:<var>, stdin or exec:<command>)")
+	ca := flag.String("ca", "", "CA certificate source (path, file:<path>, env:<var> or stdin)")
+	crl := flag.String("crl", "", "Revocation list file")
+	issuer := flag.String("issuer", "", "Certificate issuer address")
 	timeout := flag.Int("timeout", 5000, "Timeout for connection")
 	bufferSize := flag.Int("buffer", 64*1024, "Buffer size")
+	tlsVersion := flag.String("tls", "1.3", "Minimum TLS version (1.2 or 1.3)")
+	ticketKeys := flag.Duration("ticket-rotation", 12*time.Hour, "Session ticket key rotation interval")
+	transparencyLog := flag.String("log", "", "Directory of the transparency log served by this node (empty disables)")
+	storeDir := flag.String("store", "", "Directory of the chunk store kept by this node (empty disables)")
+	replicas := flag.Int("replicas", 2, "Number of nodes that keep a copy of each stored chunk")
+	clientRate := flag.Float64("client-rate", 0, "Bytes per second each connected client may send (0 disables)")
+	clientBurst := flag.Float64("client-burst", 0, "Bytes a client may send in a burst (defaults to one second of -client-rate)")
+	peerRate := flag.Float64("peer-rate", 0, "Bytes per second accepted from each peer link (0 disables)")
+	peerBurst := flag.Float64("peer-burst", 0, "Bytes a peer link may send in a burst (defaults to one second of -peer-rate)")
+	quota := flag.Int64("quota", 0, "Bytes each client certificate may send through this node per day (0 disables)")
+	logLevel := flag.String("log-level", "info", "Log level (trace, debug, info, warn or error; trace logs every routed message)")
+	logFormat := flag.String("log-format", "text", "Log format (text or json)")
 
-	peers := flag.String("peers", PEERS, "Peers")
+	peers := flag.String("peers", PEERS, "Peers (host:port or server-name@host:port)")
 	nodes := flag.Int("nodes", 0, "Number of nodes")
 
 	flag.Parse()
 
 	return &ServerFlags{
-		Host:       *host,
-		Port:       *port,
-		Cert:       *cert,
-		Key:        *key,
-		Ca:         *ca,
-		Peers:      *peers,
-		NodeId:     *nodeId,
-		NodeCount:  *nodes,
-		Timeout:    *timeout,
-		BufferSize: *bufferSize,
+		Host:        *host,
+		Port:        *port,
+		Cert:        *cert,
+		Key:         *key,
+		Ca:          *ca,
+		Crl:         *crl,
+		Issuer:      *issuer,
+		Peers:       *peers,
+		NodeId:      *nodeId,
+		NodeCount:   *nodes,
+		Timeout:     *timeout,
+		BufferSize:  *bufferSize,
+		TLSVersion:  *tlsVersion,
+		TicketKeys:  *ticketKeys,
+		Log:         *transparencyLog,
+		Store:       *storeDir,
+		Replicas:    *replicas,
+		ClientRate:  *clientRate,
+		ClientBurst: *clientBurst,
+		PeerRate:    *peerRate,
+		PeerBurst:   *peerBurst,
+		Quota:       *quota,
+		LogLevel:    *logLevel,
+		LogFormat:   *logFormat,
 	}
 }
 
 func ParseClientFlags() *ClientFlags {
 	host := flag.String("host", HOST, "Server host")
 	port := flag.String("port", PORT, "Server port")
+	serverName := flag.String("servername", "", "Expected server name (defaults to host)")
+	tlsVersion := flag.String("tls", "1.3", "Minimum TLS version (1.2 or 1.3)")
 	bufferSize := flag.Int("buffer", 64*1024, "Buffer size")
 
-	cert := flag.String("cert", "certs/client-1.crt", "Certificate")
-	key := flag.String("key", "certs/client-1.key", "Key")
+	cert := flag.String("cert", "certs/client-1.crt", "Certificate source (path, file:<path>, env:<var> or stdin)")
+	key := flag.String("key", "certs/client-1.key", "Key source (path, file:<path>, env:<var>, stdin or exec:<command>)")
+	ca := flag.String("ca", "certs/ca.crt", "CA certificate source (path, file:<path>, env:<var> or stdin)")
+	crl := flag.String("crl", "", "Revocation list file")
+	issuer := flag.String("issuer", "", "Certificate issuer address")
 	validate := flag.Bool("validate", false, "Validate received data with the blockchain")
+	ledger := flag.String("ledger", "", "Directory of the persistent per-peer message ledger (requires -validate)")
+	treeHeads := flag.Duration("heads", 30*time.Second, "Interval between signed tree head exchanges with peers (0 disables, requires -validate)")
+	onionHops := flag.Int("onion", 0, "Route messages through this many nodes with layered encryption (0 disables onion mode)")
+	shards := flag.Int("shards", 4, "Number of data shards each published chunk is split into")
+	parity := flag.Int("parity", 2, "Number of parity shards added to each published chunk (0 replicates whole chunks instead)")
+	allow := flag.String("allow", "", "Comma-separated certificate names allowed to open sessions (empty allows everyone not blocked)")
+	blocklist := flag.String("blocklist", "", "File of certificate names blocked from opening sessions")
+	coverTraffic := flag.Duration("cover", 0, "Mean interval between cover traffic messages in onion mode (0 disables)")
+	logLevel := flag.String("log-level", "info", "Log level (trace, debug, info, warn or error)")
+	logFormat := flag.String("log-format", "text", "Log format (text or json)")
 
 	if *cert == "" || *key == "" {
 		log.Fatal("Certificate and key are required")
@@ -83,7 +156,22 @@ func ParseClientFlags() *ClientFlags {
 		ServerPort:         *port,
 		Cert:               *cert,
 		Key:                *key,
+		Ca:                 *ca,
+		Crl:                *crl,
+		Issuer:             *issuer,
+		ServerName:         *serverName,
+		TLSVersion:         *tlsVersion,
 		BufferSize:         *bufferSize,
 		ValidateBlockchain: *validate,
+		OnionHops:          *onionHops,
+		CoverTraffic:       *coverTraffic,
+		Ledger:             *ledger,
+		TreeHeads:          *treeHeads,
+		Shards:             *shards,
+		Parity:             *parity,
+		Allow:              *allow,
+		Blocklist:          *blocklist,
+		LogLevel:           *logLevel,
+		LogFormat:          *logFormat,
 	}
 }
@@ -0,0 +1,93 @@
+package ledger
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+type Evidence struct {
+	Head       *TreeHead
+	Block      structs.Block
+	Proof      [][]byte
+	Entry      []byte              `json:",omitempty"`
+	EntryProof *structs.EntryProof `json:",omitempty"`
+}
+
+func (s *Stream) Prove(id int) (*Evidence, error) {
+	if id < 1 || id >= len(s.Chain.Blocks) {
+		return nil, fmt.Errorf("block %d is not in the %s stream", id, s.Direction)
+	}
+
+	head := s.LatestHead(id + 1)
+	if head == nil {
+		return nil, fmt.Errorf("no tree head signed by the peer covers block %d", id)
+	}
+
+	proof, err := s.Chain.Tree().InclusionProof(id, head.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Evidence{Head: head, Block: *s.Chain.Blocks[id], Proof: proof}, nil
+}
+
+func (s *Stream) ProveEntry(id int, index int) (*Evidence, error) {
+	evidence, err := s.Prove(id)
+	if err != nil {
+		return nil, err
+	}
+
+	entryProof, err := evidence.Block.ProveEntry(index)
+	if err != nil {
+		return nil, err
+	}
+
+	evidence.Entry = evidence.Block.Entries[index]
+	evidence.EntryProof = entryProof
+	evidence.Block = *evidence.Block.Header()
+	return evidence, nil
+}
+
+func (e *Evidence) Check(roots *x509.CertPool) error {
+	cert, intermediates, err := e.Head.Certificate()
+	if err != nil {
+		return err
+	}
+
+	if role := crypto.GetCertificateRole(cert); role != crypto.RoleClient {
+		return fmt.Errorf("tree head signed with %s certificate", role)
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   e.Head.Timestamp,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return err
+	}
+
+	if err := e.Head.Verify(cert); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(e.Block.Hash, e.Block.CalculateHash()) {
+		return structs.ErrBadHash
+	}
+
+	if e.EntryProof != nil {
+		if err := e.Block.VerifyEntry(e.Entry, e.EntryProof); err != nil {
+			return err
+		}
+	} else if e.Block.Entries != nil {
+		if err := e.Block.CheckEntries(); err != nil {
+			return err
+		}
+	}
+
+	return structs.VerifyInclusion(e.Block.ID, e.Head.Size, structs.LeafHash(e.Block.Hash), e.Proof, e.Head.Root)
+}
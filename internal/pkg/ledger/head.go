@@ -0,0 +1,102 @@
+package ledger
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+const treeHeadContext = "trust tree head v1"
+
+type TreeHead struct {
+	Peer      string
+	Direction string
+	Session   uint64
+	Size      int
+	Root      []byte
+	Timestamp time.Time
+	Signer    string
+	Chain     [][]byte
+	Signature []byte
+}
+
+func (h *TreeHead) SignedBytes() []byte {
+	buf := append([]byte{}, treeHeadContext...)
+	buf = append(buf, h.Peer...)
+	buf = append(buf, 0)
+	buf = append(buf, h.Direction...)
+	buf = append(buf, 0)
+	buf = append(buf, h.Signer...)
+	buf = append(buf, 0)
+	buf = binary.BigEndian.AppendUint64(buf, h.Session)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Size))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Timestamp.UnixNano()))
+	return append(buf, h.Root...)
+}
+
+func (h *TreeHead) Sign(chain [][]byte, key gocrypto.PrivateKey) error {
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+
+	h.Signer = cert.Subject.CommonName
+	h.Chain = chain
+
+	signature, err := crypto.Sign(key, h.SignedBytes())
+	if err != nil {
+		return err
+	}
+	h.Signature = signature
+	return nil
+}
+
+func (h *TreeHead) Certificate() (*x509.Certificate, *x509.CertPool, error) {
+	if len(h.Chain) == 0 {
+		return nil, nil, fmt.Errorf("tree head has no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(h.Chain[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range h.Chain[1:] {
+		intermediate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, err
+		}
+		intermediates.AddCert(intermediate)
+	}
+	return cert, intermediates, nil
+}
+
+func (h *TreeHead) Verify(cert *x509.Certificate) error {
+	if cert.Subject.CommonName != h.Signer {
+		return fmt.Errorf("tree head signed by %s, certificate belongs to %s", h.Signer, cert.Subject.CommonName)
+	}
+	return crypto.VerifySignature(cert, h.SignedBytes(), h.Signature)
+}
+
+func (h *TreeHead) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(h); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeTreeHead(data []byte) (*TreeHead, error) {
+	head := &TreeHead{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(head); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
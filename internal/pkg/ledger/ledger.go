@@ -0,0 +1,274 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+const (
+	Sent     = "sent"
+	Received = "received"
+
+	segmentExt = ".seg"
+)
+
+func Opposite(direction string) string {
+	if direction == Sent {
+		return Received
+	}
+	return Sent
+}
+
+var MaxSegmentSize int64 = 16 << 20
+var MaxRecordSize = 64 << 20
+
+var ErrCorrupted = errors.New("ledger record corrupted")
+var ErrTruncated = errors.New("ledger record truncated")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Record struct {
+	Direction string
+	Session   uint64
+	Peer      uint64
+	Recorded  time.Time
+	Block     structs.Block
+	Head      *TreeHead
+}
+
+type Ledger struct {
+	Dir string
+
+	mu       sync.Mutex
+	segment  *os.File
+	index    int
+	size     int64
+	sessions map[string]uint64
+}
+
+func PeerDir(root string, commonName string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+			return r
+		}
+		return '_'
+	}, commonName)
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return filepath.Join(root, name)
+}
+
+func segmentName(index int) string {
+	return fmt.Sprintf("%08d%s", index, segmentExt)
+}
+
+func Segments(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func Open(dir string) (*Ledger, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	l := &Ledger{Dir: dir, index: 1, sessions: make(map[string]uint64)}
+
+	segments, err := Segments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, path := range segments {
+		valid, err := readSegment(path, func(rec *Record) error {
+			if rec.Session > l.sessions[rec.Direction] {
+				l.sessions[rec.Direction] = rec.Session
+			}
+			return nil
+		})
+
+		last := i == len(segments)-1
+		if err != nil && (!last || !errors.Is(err, ErrTruncated)) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err != nil {
+			if err := os.Truncate(path, valid); err != nil {
+				return nil, err
+			}
+		}
+
+		if last {
+			fmt.Sscanf(filepath.Base(path), "%08d", &l.index)
+			l.size = valid
+		}
+	}
+
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Ledger) openSegment() error {
+	file, err := os.OpenFile(filepath.Join(l.Dir, segmentName(l.index)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	l.segment = file
+	return nil
+}
+
+func (l *Ledger) rotate() error {
+	if err := l.segment.Sync(); err != nil {
+		return err
+	}
+	if err := l.segment.Close(); err != nil {
+		return err
+	}
+
+	l.index++
+	l.size = 0
+	return l.openSegment()
+}
+
+func (l *Ledger) NewSession(direction string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sessions[direction]++
+	return l.sessions[direction]
+}
+
+func (l *Ledger) Append(rec *Record) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(rec); err != nil {
+		return err
+	}
+	if payload.Len() > MaxRecordSize {
+		return fmt.Errorf("ledger record of %d bytes exceeds the limit of %d bytes", payload.Len(), MaxRecordSize)
+	}
+
+	frame := make([]byte, 8, 8+payload.Len())
+	binary.BigEndian.PutUint32(frame, uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload.Bytes(), crcTable))
+	frame = append(frame, payload.Bytes()...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size > 0 && l.size+int64(len(frame)) > MaxSegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.segment.Write(frame); err != nil {
+		// Drop the torn frame so later records do not land behind it.
+		if truncErr := l.segment.Truncate(l.size); truncErr != nil {
+			return errors.Join(err, truncErr)
+		}
+		return err
+	}
+	l.size += int64(len(frame))
+	return nil
+}
+
+func (l *Ledger) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.segment.Sync()
+}
+
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.segment.Sync(); err != nil {
+		return err
+	}
+	return l.segment.Close()
+}
+
+func readSegment(path string, fn func(*Record) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("%w: header at offset %d", ErrTruncated, offset)
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if size == 0 {
+			// Records are never empty; a crash can leave a zero-filled tail.
+			return offset, fmt.Errorf("%w: zero-filled tail at offset %d", ErrTruncated, offset)
+		}
+		if int64(size) > int64(MaxRecordSize) {
+			return offset, fmt.Errorf("%w: record size %d at offset %d", ErrCorrupted, size, offset)
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return offset, fmt.Errorf("%w: record at offset %d", ErrTruncated, offset)
+		}
+
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+			return offset, fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorrupted, offset)
+		}
+
+		rec := &Record{}
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(rec); err != nil {
+			return offset, fmt.Errorf("%w: %v at offset %d", ErrCorrupted, err, offset)
+		}
+
+		if err := fn(rec); err != nil {
+			return offset, err
+		}
+		offset += int64(len(header)) + int64(size)
+	}
+}
+
+func Read(dir string, fn func(*Record) error) error {
+	segments, err := Segments(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range segments {
+		if _, err := readSegment(path, fn); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
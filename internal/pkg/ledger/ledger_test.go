@@ -0,0 +1,207 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+func writeLedger(t *testing.T, dir string, blocks int) []string {
+	t.Helper()
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := structs.NewBlockchain()
+	session := l.NewSession(Sent)
+	for i := 0; i < blocks; i++ {
+		block := chain.AddBatch([][]byte{[]byte(fmt.Sprintf("entry %d", i))})
+		block.ChainRoot = chain.Tree().Root()
+		if err := l.Append(&Record{Direction: Sent, Session: session, Peer: 1, Recorded: time.Now(), Block: *block}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := Segments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+func countRecords(t *testing.T, dir string) int {
+	t.Helper()
+
+	count := 0
+	if err := Read(dir, func(*Record) error { count++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func truncateBy(n int64) func(path string) error {
+	return func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		return os.Truncate(path, info.Size()-n)
+	}
+}
+
+func TestOpenRecoversTornTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(path string) error
+		want   int
+	}{
+		{"intact", func(string) error { return nil }, 5},
+		{"partial payload", truncateBy(3), 4},
+		{"partial header", func(path string) error {
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := file.Write([]byte{0, 0, 1}); err != nil {
+				file.Close()
+				return err
+			}
+			return file.Close()
+		}, 5},
+		{"zero-filled tail", func(path string) error {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return os.Truncate(path, info.Size()+4096)
+		}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			segments := writeLedger(t, dir, 5)
+			if err := tt.damage(segments[len(segments)-1]); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := Open(dir)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if got := l.NewSession(Sent); got != 2 {
+				t.Errorf("next session = %d, want 2", got)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := countRecords(t, dir); got != tt.want {
+				t.Errorf("%d records after recovery, want %d", got, tt.want)
+			}
+			if _, err := Verify(dir); err != nil {
+				t.Errorf("Verify after recovery: %v", err)
+			}
+		})
+	}
+}
+
+func TestRecordLargerThanSegment(t *testing.T) {
+	defer func(size int64) { MaxSegmentSize = size }(MaxSegmentSize)
+	MaxSegmentSize = 64
+
+	dir := t.TempDir()
+	if segments := writeLedger(t, dir, 3); len(segments) != 3 {
+		t.Errorf("%d segments, want one per record", len(segments))
+	}
+	if _, err := Open(dir); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := countRecords(t, dir); got != 3 {
+		t.Errorf("%d records, want 3", got)
+	}
+}
+
+func TestOpenRejectsDamage(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(path string) error
+		err    error
+	}{
+		{"corrupted record", func(path string) error {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			data[len(data)/2] ^= 0xff
+			return os.WriteFile(path, data, 0600)
+		}, ErrCorrupted},
+		{"torn sealed segment", truncateBy(3), ErrTruncated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(size int64) { MaxSegmentSize = size }(MaxSegmentSize)
+			MaxSegmentSize = 1024
+
+			dir := t.TempDir()
+			segments := writeLedger(t, dir, 8)
+			if len(segments) < 2 {
+				t.Fatalf("expected the ledger to rotate, got %d segments", len(segments))
+			}
+			if err := tt.damage(segments[0]); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Open(dir); !errors.Is(err, tt.err) {
+				t.Errorf("Open error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAppendDropsFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	writeLedger(t, dir, 2)
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := l.segment
+	readOnly, err := os.Open(segment.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := l.size
+
+	l.segment = readOnly
+	block := structs.NewBlockchain().AddBatch([][]byte{[]byte("lost")})
+	if err := l.Append(&Record{Direction: Sent, Session: 2, Peer: 1, Recorded: time.Now(), Block: *block}); err == nil {
+		t.Fatal("Append to a read-only segment succeeded")
+	}
+	readOnly.Close()
+	l.segment = segment
+	if l.size != size {
+		t.Errorf("segment size %d after a failed write, want %d", l.size, size)
+	}
+
+	if err := l.Append(&Record{Direction: Sent, Session: 2, Peer: 1, Recorded: time.Now(), Block: *block}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := countRecords(t, dir); got != 3 {
+		t.Errorf("%d records, want 3", got)
+	}
+}
@@ -0,0 +1,112 @@
+package ledger
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+type Stream struct {
+	Direction string
+	Session   uint64
+	Peer      uint64
+	Chain     *structs.Blockchain
+	Heads     []*TreeHead
+	Last      time.Time
+}
+
+func (s *Stream) Head() *TreeHead {
+	tree := s.Chain.Tree()
+	return &TreeHead{
+		Direction: s.Direction,
+		Session:   s.Session,
+		Size:      tree.Size(),
+		Root:      tree.Root(),
+		Timestamp: s.Last,
+	}
+}
+
+func Verify(dir string) ([]*Stream, error) {
+	streams := make(map[string]*Stream)
+	err := Read(dir, func(rec *Record) error {
+		key := fmt.Sprintf("%s/%d", rec.Direction, rec.Session)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &Stream{Direction: rec.Direction, Session: rec.Session, Peer: rec.Peer, Chain: structs.NewBlockchain()}
+			streams[key] = stream
+		}
+
+		if rec.Head != nil {
+			stream.Heads = append(stream.Heads, rec.Head)
+			return nil
+		}
+
+		block := rec.Block
+		if err := stream.Chain.AddBlock(&block); err != nil {
+			return fmt.Errorf("%s session %d: %w", rec.Direction, rec.Session, err)
+		}
+
+		if block.ChainRoot != nil && !bytes.Equal(stream.Chain.Tree().Root(), block.ChainRoot) {
+			return fmt.Errorf("%s session %d: merkle root mismatch at block %d", rec.Direction, rec.Session, block.ID)
+		}
+
+		stream.Last = rec.Recorded
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Stream, 0, len(streams))
+	for _, stream := range streams {
+		for _, head := range stream.Heads {
+			if err := stream.CheckHead(head); err != nil {
+				return nil, fmt.Errorf("%s session %d: %w", stream.Direction, stream.Session, err)
+			}
+		}
+		result = append(result, stream)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Direction != result[j].Direction {
+			return result[i].Direction < result[j].Direction
+		}
+		return result[i].Session < result[j].Session
+	})
+	return result, nil
+}
+
+func (s *Stream) CheckHead(head *TreeHead) error {
+	if head.Direction != Opposite(s.Direction) {
+		return fmt.Errorf("tree head of %s stream recorded for %s stream", head.Direction, s.Direction)
+	}
+
+	cert, _, err := head.Certificate()
+	if err != nil {
+		return err
+	}
+	if err := head.Verify(cert); err != nil {
+		return fmt.Errorf("tree head signature: %w", err)
+	}
+
+	root, err := s.Chain.Tree().RootAt(head.Size)
+	if err != nil {
+		return fmt.Errorf("tree head of size %d: %w", head.Size, err)
+	}
+	if !bytes.Equal(root, head.Root) {
+		return fmt.Errorf("tree head of size %d signed by %s does not match the ledger", head.Size, head.Signer)
+	}
+	return nil
+}
+
+func (s *Stream) LatestHead(size int) *TreeHead {
+	var latest *TreeHead
+	for _, head := range s.Heads {
+		if head.Size >= size && (latest == nil || head.Size > latest.Size) {
+			latest = head
+		}
+	}
+	return latest
+}
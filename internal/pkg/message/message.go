@@ -5,18 +5,26 @@ import (
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 )
 
 type Message struct {
 	Type             uint8
 	From, To         uint64
+	ID               uint64
 	Intermediate     int64
 	FromNode, ToNode uint64
 	Content          []byte
+	Signature        []byte
 	AlreadyBeen      []uint64
 }
 
+var ErrUnsigned = errors.New("message is not signed")
+
+var MaxMessageSize uint32 = 16 * 1024 * 1024
+
 const (
 	PEER_ID              uint8 = 0
 	REGISTER_CLIENT      uint8 = 1
@@ -29,8 +37,91 @@ const (
 	GET_CLIENT_CERT_RESP uint8 = 8
 	I_HAVE_CLIENT        uint8 = 9
 	AES_KEY              uint8 = 10
+	REVOCATION_LIST      uint8 = 11
+	CERT_REQUEST         uint8 = 12
+	CERT_RESPONSE        uint8 = 13
+	CERT_REJECTED        uint8 = 14
+	NODE_CERT            uint8 = 15
+	NODE_DIRECTORY       uint8 = 16
+	NODE_DIRECTORY_RESP  uint8 = 17
+	ONION                uint8 = 18
+	ONION_DELIVER        uint8 = 19
+	TREE_HEAD            uint8 = 20
+	LOG_SUBMIT           uint8 = 21
+	LOG_RECEIPT          uint8 = 22
+	LOG_HEAD_REQUEST     uint8 = 23
+	LOG_HEAD             uint8 = 24
+	BLOCK_REQUEST        uint8 = 25
+	RESYNC_REQUEST       uint8 = 26
+	RESYNC               uint8 = 27
+	STORE_PUT            uint8 = 28
+	STORE_GET            uint8 = 29
+	STORE_ACK            uint8 = 30
+	STORE_DATA           uint8 = 31
+	STORE_MISSING        uint8 = 32
+	SHARD_GET            uint8 = 33
+	SHARD_DATA           uint8 = 34
+	CAP_REVOKE           uint8 = 35
+	STORE_DENIED         uint8 = 36
+	BLOCK                uint8 = 37
+	THROTTLE             uint8 = 38
+	CREDIT               uint8 = 39
+	STREAM               uint8 = 40
+	LOG_GOSSIP           uint8 = 41
 )
 
+var typeNames = map[uint8]string{
+	PEER_ID:              "PEER_ID",
+	REGISTER_CLIENT:      "REGISTER_CLIENT",
+	REGISTER_CLIENT_RESP: "REGISTER_CLIENT_RESP",
+	DATA:                 "DATA",
+	CLIENT_NON_EXISTENT:  "CLIENT_NON_EXISTENT",
+	PING:                 "PING",
+	PONG:                 "PONG",
+	GET_CLIENT_CERT:      "GET_CLIENT_CERT",
+	GET_CLIENT_CERT_RESP: "GET_CLIENT_CERT_RESP",
+	I_HAVE_CLIENT:        "I_HAVE_CLIENT",
+	AES_KEY:              "AES_KEY",
+	REVOCATION_LIST:      "REVOCATION_LIST",
+	CERT_REQUEST:         "CERT_REQUEST",
+	CERT_RESPONSE:        "CERT_RESPONSE",
+	CERT_REJECTED:        "CERT_REJECTED",
+	NODE_CERT:            "NODE_CERT",
+	NODE_DIRECTORY:       "NODE_DIRECTORY",
+	NODE_DIRECTORY_RESP:  "NODE_DIRECTORY_RESP",
+	ONION:                "ONION",
+	ONION_DELIVER:        "ONION_DELIVER",
+	TREE_HEAD:            "TREE_HEAD",
+	LOG_SUBMIT:           "LOG_SUBMIT",
+	LOG_RECEIPT:          "LOG_RECEIPT",
+	LOG_HEAD_REQUEST:     "LOG_HEAD_REQUEST",
+	LOG_HEAD:             "LOG_HEAD",
+	BLOCK_REQUEST:        "BLOCK_REQUEST",
+	RESYNC_REQUEST:       "RESYNC_REQUEST",
+	RESYNC:               "RESYNC",
+	STORE_PUT:            "STORE_PUT",
+	STORE_GET:            "STORE_GET",
+	STORE_ACK:            "STORE_ACK",
+	STORE_DATA:           "STORE_DATA",
+	STORE_MISSING:        "STORE_MISSING",
+	SHARD_GET:            "SHARD_GET",
+	SHARD_DATA:           "SHARD_DATA",
+	CAP_REVOKE:           "CAP_REVOKE",
+	STORE_DENIED:         "STORE_DENIED",
+	BLOCK:                "BLOCK",
+	THROTTLE:             "THROTTLE",
+	CREDIT:               "CREDIT",
+	STREAM:               "STREAM",
+	LOG_GOSSIP:           "LOG_GOSSIP",
+}
+
+func TypeName(t uint8) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprint(t)
+}
+
 func MessageFromBytes(input []byte) (*Message, error) {
 	dec := gob.NewDecoder(bytes.NewReader(input))
 	msg := &Message{}
@@ -45,6 +136,25 @@ func ReadSize(bytes []byte) uint32 {
 	return binary.BigEndian.Uint32(bytes[:4])
 }
 
+func ReadMessage(r io.Reader) (*Message, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := ReadSize(header)
+	if size > MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d bytes", size, MaxMessageSize)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return MessageFromBytes(body)
+}
+
 func (m *Message) Send(conn *tls.Conn) error {
 	msgBytes, err := m.Bytes()
 	if err != nil {
@@ -0,0 +1,39 @@
+package message
+
+import (
+	gocrypto "crypto"
+	"crypto/x509"
+	"encoding/binary"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+const signatureContext = "trust message signature v1"
+
+func (m *Message) SignedBytes() []byte {
+	buf := make([]byte, 0, len(signatureContext)+1+8*4+len(m.Content))
+	buf = append(buf, signatureContext...)
+	buf = append(buf, m.Type)
+	buf = binary.BigEndian.AppendUint64(buf, m.From)
+	buf = binary.BigEndian.AppendUint64(buf, m.To)
+	buf = binary.BigEndian.AppendUint64(buf, m.ID)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(m.Content)))
+	return append(buf, m.Content...)
+}
+
+func (m *Message) Sign(key gocrypto.PrivateKey) error {
+	signature, err := crypto.Sign(key, m.SignedBytes())
+	if err != nil {
+		return err
+	}
+
+	m.Signature = signature
+	return nil
+}
+
+func (m *Message) Verify(cert *x509.Certificate) error {
+	if len(m.Signature) == 0 {
+		return ErrUnsigned
+	}
+	return crypto.VerifySignature(cert, m.SignedBytes(), m.Signature)
+}
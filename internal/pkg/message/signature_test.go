@@ -0,0 +1,69 @@
+package message
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestSignedBytes(t *testing.T) {
+	msg := &Message{Type: DATA, From: 1, To: 2, ID: 3, Content: []byte("hi")}
+	fields, _ := hex.DecodeString("03" +
+		"0000000000000001" +
+		"0000000000000002" +
+		"0000000000000003" +
+		"0000000000000002" +
+		"6869")
+	want := append([]byte(signatureContext), fields...)
+	if got := msg.SignedBytes(); !bytes.Equal(got, want) {
+		t.Errorf("SignedBytes = %x, want %x", got, want)
+	}
+
+	// Routing fields are rewritten by nodes on the way and are not signed.
+	routed := *msg
+	routed.Intermediate, routed.FromNode, routed.ToNode, routed.AlreadyBeen = 4, 5, 6, []uint64{7}
+	if !bytes.Equal(routed.SignedBytes(), want) {
+		t.Error("SignedBytes covers the routing fields")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{PublicKey: public}
+
+	msg := &Message{Type: DATA, From: 1, To: 2, ID: 3, Content: []byte("hi")}
+	if err := msg.Verify(cert); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Verify of an unsigned message = %v, want %v", err, ErrUnsigned)
+	}
+	if err := msg.Sign(private); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Message)
+		valid  bool
+	}{
+		{"unchanged", func(*Message) {}, true},
+		{"relayed", func(m *Message) { m.Intermediate, m.AlreadyBeen = 9, []uint64{9} }, true},
+		{"type", func(m *Message) { m.Type = AES_KEY }, false},
+		{"sender", func(m *Message) { m.From = 4 }, false},
+		{"recipient", func(m *Message) { m.To = 4 }, false},
+		{"id", func(m *Message) { m.ID = 4 }, false},
+		{"content", func(m *Message) { m.Content = []byte("ho") }, false},
+	}
+
+	for _, tt := range tests {
+		changed := *msg
+		tt.change(&changed)
+		if err := changed.Verify(cert); (err == nil) != tt.valid {
+			t.Errorf("%s: Verify = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package onion
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+var PadSizes = []int{1 << 11, 1 << 13, 1 << 15, 1 << 17, 1 << 20}
+
+type Hop struct {
+	Node uint64
+	Cert *x509.Certificate
+}
+
+type Layer struct {
+	Next    uint64
+	Exit    bool
+	Drop    bool
+	Client  uint64
+	Sealed  bool
+	Payload []byte
+}
+
+func Pad(data []byte) ([]byte, error) {
+	size := len(data) + 4
+	padded := PadSizes[len(PadSizes)-1]
+	for _, bucket := range PadSizes {
+		if size <= bucket {
+			padded = bucket
+			break
+		}
+	}
+	if size > padded {
+		padded = (size + padded - 1) / padded * padded
+	}
+
+	out := make([]byte, padded)
+	binary.BigEndian.PutUint32(out, uint32(len(data)))
+	copy(out[4:], data)
+	if _, err := io.ReadFull(rand.Reader, out[size:]); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func Unpad(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	size := binary.BigEndian.Uint32(data)
+	if int(size) > len(data)-4 {
+		return nil, fmt.Errorf("invalid padded length %d", size)
+	}
+	return data[4 : 4+size], nil
+}
+
+func encodeLayer(layer *Layer) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(layer); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func Wrap(path []Hop, exit *Layer) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("empty onion path")
+	}
+
+	layer := exit
+	var sealed []byte
+	for i := len(path) - 1; i >= 0; i-- {
+		plaintext, err := encodeLayer(layer)
+		if err != nil {
+			return nil, err
+		}
+
+		sealed, err = crypto.SealMessage(plaintext, path[i].Cert)
+		if err != nil {
+			return nil, err
+		}
+
+		layer = &Layer{Next: path[i].Node, Payload: sealed}
+	}
+
+	return Pad(sealed)
+}
+
+func Peel(content []byte, keys []gocrypto.PrivateKey) (*Layer, error) {
+	sealed, err := Unpad(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	for _, key := range keys {
+		plaintext, err = crypto.OpenMessage(sealed, key)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &Layer{}
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(layer); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+func EncodeDelivery(layer *Layer) ([]byte, error) {
+	delivery := append([]byte{0}, layer.Payload...)
+	if layer.Sealed {
+		delivery[0] = 1
+	}
+	return Pad(delivery)
+}
+
+func DecodeDelivery(content []byte) (bool, []byte, error) {
+	delivery, err := Unpad(content)
+	if err != nil {
+		return false, nil, err
+	}
+	if len(delivery) == 0 {
+		return false, nil, io.ErrUnexpectedEOF
+	}
+	return delivery[0] == 1, delivery[1:], nil
+}
+
+func EncodeDirectory(nodes map[uint64][][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(nodes); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeDirectory(content []byte) (map[uint64][][]byte, error) {
+	nodes := make(map[uint64][][]byte)
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
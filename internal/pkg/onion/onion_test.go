@@ -0,0 +1,147 @@
+package onion
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+func testHop(t *testing.T, node uint64, alg crypto.KeyAlgorithm) (Hop, gocrypto.Signer) {
+	t.Helper()
+
+	key, err := crypto.GenerateKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := crypto.GenerateSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := crypto.GenerateCACertificate(serial)
+	certPem, err := crypto.EncodeCertificate(template, template, key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := crypto.DecodeCertificate(certPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Hop{Node: node, Cert: cert}, key
+}
+
+func TestPad(t *testing.T) {
+	largest := PadSizes[len(PadSizes)-1]
+	tests := []struct {
+		name   string
+		length int
+		padded int
+	}{
+		{"empty", 0, 1 << 11},
+		{"fills the smallest bucket", 1<<11 - 4, 1 << 11},
+		{"one byte over", 1<<11 - 3, 1 << 13},
+		{"fills the largest bucket", largest - 4, largest},
+		{"larger than every bucket", largest, 2 * largest},
+	}
+
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte{7}, tt.length)
+		padded, err := Pad(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(padded) != tt.padded {
+			t.Errorf("%s: padded to %d, want %d", tt.name, len(padded), tt.padded)
+		}
+
+		unpadded, err := Unpad(padded)
+		if err != nil || !bytes.Equal(unpadded, data) {
+			t.Errorf("%s: Unpad returned %d bytes, %v", tt.name, len(unpadded), err)
+		}
+	}
+
+	if _, err := Unpad([]byte{0, 0, 0}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Unpad of a truncated header: error = %v", err)
+	}
+	if _, err := Unpad([]byte{0, 0, 0, 5, 1, 2}); err == nil {
+		t.Error("Unpad of a length past the end: expected an error")
+	}
+}
+
+func TestWrapPeel(t *testing.T) {
+	var path []Hop
+	var keys []gocrypto.Signer
+	for i, alg := range []crypto.KeyAlgorithm{crypto.RSA2048, crypto.ECDSAP256, crypto.Ed25519} {
+		hop, key := testHop(t, uint64(i+1), alg)
+		path = append(path, hop)
+		keys = append(keys, key)
+	}
+	_, stranger := testHop(t, 9, crypto.ECDSAP256)
+
+	exit := &Layer{Exit: true, Client: 42, Sealed: true, Payload: []byte("for the client")}
+	content, err := Wrap(path, exit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		if !slices.Contains(PadSizes, len(content)) {
+			t.Fatalf("hop %d: onion of %d bytes is not padded to a bucket size", i, len(content))
+		}
+		if _, err := Peel(content, []gocrypto.PrivateKey{stranger}); err == nil {
+			t.Fatalf("hop %d: peeled with another node's key", i)
+		}
+
+		// Nodes that just renewed their certificate try the previous key too.
+		layer, err := Peel(content, []gocrypto.PrivateKey{stranger, key})
+		if err != nil {
+			t.Fatalf("hop %d: %v", i, err)
+		}
+
+		if i == len(keys)-1 {
+			if !layer.Exit || layer.Client != exit.Client || !layer.Sealed || !bytes.Equal(layer.Payload, exit.Payload) {
+				t.Errorf("exit layer = %+v, want %+v", layer, exit)
+			}
+			break
+		}
+		if layer.Exit || layer.Next != path[i+1].Node {
+			t.Fatalf("hop %d: layer points to %d (exit %v), want %d", i, layer.Next, layer.Exit, path[i+1].Node)
+		}
+		// Relays pad the inner layer again before forwarding it.
+		if content, err = Pad(layer.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Wrap(nil, exit); err == nil {
+		t.Error("Wrap with an empty path: expected an error")
+	}
+	if _, err := Peel([]byte{0, 0, 0, 5}, []gocrypto.PrivateKey{keys[0]}); err == nil {
+		t.Error("Peel of a bad padding: expected an error")
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	for _, sealed := range []bool{false, true} {
+		content, err := EncodeDelivery(&Layer{Sealed: sealed, Payload: []byte("envelope")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotSealed, payload, err := DecodeDelivery(content)
+		if err != nil || gotSealed != sealed || string(payload) != "envelope" {
+			t.Errorf("DecodeDelivery = %v, %q, %v, want %v, envelope", gotSealed, payload, err, sealed)
+		}
+	}
+
+	empty, err := Pad(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeDelivery(empty); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeDelivery of an empty delivery: error = %v", err)
+	}
+}
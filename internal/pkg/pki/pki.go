@@ -0,0 +1,395 @@
+package pki
+
+import (
+	gocrypto "crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+const (
+	RootCertFile         = "ca.crt"
+	RootKeyFile          = "ca.key"
+	IntermediateCertFile = "intermediate.crt"
+	IntermediateKeyFile  = "intermediate.key"
+	RevocationListFile   = "crl.pem"
+	IndexFile            = "index.json"
+	IssuedDir            = "issued"
+)
+
+type Entry struct {
+	Serial    string
+	Role      string
+	Subject   string
+	NotAfter  time.Time
+	Revoked   bool
+	RevokedAt time.Time
+}
+
+type Store struct {
+	Dir         string
+	RootCert    *x509.Certificate
+	RootCertPem []byte
+	Issuer      *crypto.Issuer
+
+	mu      sync.Mutex
+	rootKey gocrypto.Signer
+}
+
+func Exists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, RootKeyFile))
+	return err == nil
+}
+
+func writeKey(path string, key gocrypto.Signer, passphrase []byte) error {
+	keyPem, err := crypto.EncodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(keyPem)
+	encrypted, err := crypto.EncryptPEMBlock(block, passphrase)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, encrypted, 0600)
+}
+
+func readKey(path string, passphrase []byte) (gocrypto.Signer, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPem, err := crypto.DecryptPEMBlock(content, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return crypto.DecodePrivateKey(keyPem)
+}
+
+func Init(dir string, passphrase []byte, alg crypto.KeyAlgorithm) (*Store, error) {
+	if Exists(dir) {
+		return nil, fmt.Errorf("CA already initialized in %s", dir)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, IssuedDir), 0700); err != nil {
+		return nil, err
+	}
+
+	rootKey, err := crypto.GenerateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	rootSerial, err := crypto.GenerateSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	rootCert := crypto.GenerateCACertificate(rootSerial)
+	rootCertPem, err := crypto.EncodeCertificate(rootCert, rootCert, rootKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rootCert, err = crypto.DecodeCertificate(rootCertPem)
+	if err != nil {
+		return nil, err
+	}
+
+	intermediateKey, err := crypto.GenerateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	intermediateSerial, err := crypto.GenerateSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	intermediateCert := crypto.GenerateIntermediateCertificate(intermediateSerial)
+	intermediateCertPem, err := crypto.EncodeCertificate(intermediateCert, rootCert, intermediateKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := crypto.CreateRevocationList(1, nil, rootCert, rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKey(filepath.Join(dir, RootKeyFile), rootKey, passphrase); err != nil {
+		return nil, err
+	}
+	if err := writeKey(filepath.Join(dir, IntermediateKeyFile), intermediateKey, passphrase); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, RootCertFile), rootCertPem, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, IntermediateCertFile), intermediateCertPem, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, RevocationListFile), crypto.EncodeRevocationList(crl), 0644); err != nil {
+		return nil, err
+	}
+
+	return Open(dir, passphrase)
+}
+
+func Open(dir string, passphrase []byte) (*Store, error) {
+	rootCertPem, err := os.ReadFile(filepath.Join(dir, RootCertFile))
+	if err != nil {
+		return nil, err
+	}
+
+	rootCert, err := crypto.DecodeCertificate(rootCertPem)
+	if err != nil {
+		return nil, err
+	}
+
+	rootKey, err := readKey(filepath.Join(dir, RootKeyFile), passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	intermediateCertPem, err := os.ReadFile(filepath.Join(dir, IntermediateCertFile))
+	if err != nil {
+		return nil, err
+	}
+
+	intermediateKey, err := readKey(filepath.Join(dir, IntermediateKeyFile), passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := crypto.NewIssuer(intermediateCertPem, intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		Dir:         dir,
+		RootCert:    rootCert,
+		RootCertPem: rootCertPem,
+		Issuer:      issuer,
+		rootKey:     rootKey,
+	}
+	issuer.OnIssue = store.record
+
+	return store, nil
+}
+
+func (s *Store) RevocationListPath() string {
+	return filepath.Join(s.Dir, RevocationListFile)
+}
+
+func (s *Store) readIndex() ([]Entry, error) {
+	content, err := os.ReadFile(filepath.Join(s.Dir, IndexFile))
+	if os.IsNotExist(err) {
+		return []Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *Store) writeIndex(entries []Entry) error {
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.Dir, IndexFile+".tmp")
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.Dir, IndexFile))
+}
+
+func (s *Store) record(cert *x509.Certificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+
+	entries = append(entries, Entry{
+		Serial:   cert.SerialNumber.String(),
+		Role:     crypto.GetCertificateRole(cert).String(),
+		Subject:  cert.Subject.CommonName,
+		NotAfter: cert.NotAfter,
+	})
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := os.WriteFile(filepath.Join(s.Dir, IssuedDir, cert.SerialNumber.String()+".crt"), certPem, 0644); err != nil {
+		return err
+	}
+
+	return s.writeIndex(entries)
+}
+
+func (s *Store) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].NotAfter.Before(entries[j].NotAfter)
+	})
+	return entries, nil
+}
+
+func (s *Store) RevocationList() ([]byte, error) {
+	return crypto.ReadRevocationListFile(s.RevocationListPath())
+}
+
+func (s *Store) issued(serial *big.Int) (*x509.Certificate, error) {
+	if serial.Cmp(s.Issuer.Cert.SerialNumber) == 0 {
+		return s.Issuer.Cert, nil
+	}
+
+	certPem, err := os.ReadFile(filepath.Join(s.Dir, IssuedDir, serial.String()+".crt"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("certificate %s was not issued by this CA", serial)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return crypto.DecodeCertificate(certPem)
+}
+
+func (s *Store) readRevocationList() (*x509.RevocationList, error) {
+	der, err := crypto.ReadRevocationListFile(s.RevocationListPath())
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseRevocationList(der)
+}
+
+func (s *Store) writeRevocationList(list *x509.RevocationList, revoked []x509.RevocationListEntry) ([]byte, error) {
+	// Parsed entries keep their certificate issuer in Extensions, which
+	// x509.CreateRevocationList ignores, so every entry is rebuilt.
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, entry := range revoked {
+		cert, err := s.issued(entry.SerialNumber)
+		if err != nil {
+			return nil, err
+		}
+
+		rebuilt, err := crypto.RevocationEntry(cert, entry.RevocationTime)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, rebuilt)
+	}
+
+	number := new(big.Int).Add(list.Number, big.NewInt(1))
+	crl, err := crypto.CreateRevocationList(number.Int64(), entries, s.RootCert, s.rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(s.RevocationListPath(), crypto.EncodeRevocationList(crl), 0644); err != nil {
+		return nil, err
+	}
+	return crl, nil
+}
+
+func (s *Store) RefreshRevocationList() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, err := s.readRevocationList()
+	if err != nil {
+		return false, err
+	}
+	if time.Until(list.NextUpdate) > crypto.RevocationListValidity/2 {
+		return false, nil
+	}
+
+	if _, err := s.writeRevocationList(list, list.RevokedCertificateEntries); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) Revoke(serial *big.Int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.issued(serial); err != nil {
+		return nil, err
+	}
+
+	list, err := s.readRevocationList()
+	if err != nil {
+		return nil, err
+	}
+
+	revokedEntries := list.RevokedCertificateEntries
+	for _, entry := range revokedEntries {
+		if entry.SerialNumber.Cmp(serial) == 0 {
+			return nil, fmt.Errorf("certificate %s is already revoked", serial)
+		}
+	}
+
+	now := time.Now()
+	revokedEntries = append(revokedEntries, x509.RevocationListEntry{
+		SerialNumber:   serial,
+		RevocationTime: now,
+	})
+
+	crl, err := s.writeRevocationList(list, revokedEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].Serial == serial.String() {
+			entries[i].Revoked = true
+			entries[i].RevokedAt = now
+		}
+	}
+
+	return crl, s.writeIndex(entries)
+}
+
+func (s *Store) Bundle() ([]byte, error) {
+	bundle := append([]byte{}, s.RootCertPem...)
+	bundle = append(bundle, s.Issuer.Chain...)
+
+	crl, err := s.RevocationList()
+	if err != nil {
+		return nil, err
+	}
+	return append(bundle, crypto.EncodeRevocationList(crl)...), nil
+}
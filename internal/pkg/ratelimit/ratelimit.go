@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[uint64]*Bucket
+}
+
+type Quota struct {
+	mu    sync.Mutex
+	limit int64
+	day   time.Time
+	used  map[string]int64
+}
+
+func NewBucket(rate float64, burst float64) *Bucket {
+	return &Bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *Bucket) Take(n float64, maxWait time.Duration) (time.Duration, bool) {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	// A take larger than the burst only needs a full bucket, but is charged
+	// in full, leaving a debt that later takes wait for.
+	need := min(n, b.burst)
+	if b.tokens >= need {
+		b.tokens -= n
+		return 0, true
+	}
+
+	wait := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+func (b *Bucket) Refund(n float64) {
+	b.tokens = min(b.burst, b.tokens+n)
+}
+
+func NewLimiter(rate float64, burst float64) *Limiter {
+	if burst < rate {
+		burst = rate
+	}
+	return &Limiter{rate: rate, burst: burst, buckets: make(map[uint64]*Bucket)}
+}
+
+func (l *Limiter) Take(key uint64, n int, maxWait time.Duration) (time.Duration, bool) {
+	if l == nil || l.rate <= 0 {
+		return 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewBucket(l.rate, l.burst)
+		l.buckets[key] = bucket
+	}
+	return bucket.Take(float64(n), maxWait)
+}
+
+func (l *Limiter) Refund(key uint64, n int) {
+	if l == nil || l.rate <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bucket, ok := l.buckets[key]; ok {
+		bucket.Refund(float64(n))
+	}
+}
+
+func (l *Limiter) Forget(key uint64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
+
+func NewQuota(limit int64) *Quota {
+	return &Quota{limit: limit, used: make(map[string]int64)}
+}
+
+func (q *Quota) Use(identity string, n int) (time.Duration, bool) {
+	if q == nil || q.limit <= 0 {
+		return 0, true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now().UTC()
+	day := now.Truncate(24 * time.Hour)
+	if !day.Equal(q.day) {
+		q.day = day
+		q.used = make(map[string]int64)
+	}
+
+	if q.used[identity]+int64(n) > q.limit {
+		return day.Add(24 * time.Hour).Sub(now), false
+	}
+	q.used[identity] += int64(n)
+	return 0, true
+}
+
+func (q *Quota) Used(identity string) int64 {
+	if q == nil {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used[identity]
+}
@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func closeTo(got, want time.Duration) bool {
+	diff := got - want
+	return diff > -5*time.Millisecond && diff < 5*time.Millisecond
+}
+
+func TestBucketTake(t *testing.T) {
+	steps := []struct {
+		name    string
+		elapsed time.Duration
+		n       float64
+		maxWait time.Duration
+		wait    time.Duration
+		ok      bool
+	}{
+		{"burst", 0, 100, 0, 0, true},
+		{"empty, no wait allowed", 0, 50, 0, 500 * time.Millisecond, false},
+		{"empty, wait allowed", 0, 50, time.Second, 500 * time.Millisecond, true},
+		{"repaying debt", 500 * time.Millisecond, 1, 0, 10 * time.Millisecond, false},
+		{"refilled", 10 * time.Millisecond, 1, 0, 0, true},
+		{"refill is capped at burst", time.Hour, 100, 0, 0, true},
+		{"larger than burst", time.Second, 500, 0, 0, true},
+		{"debt of a large take", 0, 1, 0, 4010 * time.Millisecond, false},
+		{"larger than burst waits for a full bucket", 4 * time.Second, 200, 0, time.Second, false},
+	}
+
+	bucket := NewBucket(100, 100)
+	for _, step := range steps {
+		bucket.last = bucket.last.Add(-step.elapsed)
+		wait, ok := bucket.Take(step.n, step.maxWait)
+		if ok != step.ok || !closeTo(wait, step.wait) {
+			t.Errorf("%s: Take(%v, %v) = %v, %v, want %v, %v", step.name, step.n, step.maxWait, wait, ok, step.wait, step.ok)
+		}
+	}
+
+	bucket.Refund(1000)
+	if _, ok := bucket.Take(100, 0); !ok {
+		t.Error("refunded bucket is not full")
+	}
+	if _, ok := bucket.Take(1, 0); ok {
+		t.Error("refund filled the bucket past its burst")
+	}
+}
+
+func TestLimiterTake(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter *Limiter
+		takes   []uint64
+		forget  uint64
+		ok      []bool
+	}{
+		{"nil limiter", nil, []uint64{1, 1, 1}, 0, []bool{true, true, true}},
+		{"unlimited rate", NewLimiter(0, 0), []uint64{1, 1, 1}, 0, []bool{true, true, true}},
+		{"one bucket per key", NewLimiter(10, 10), []uint64{1, 2, 1}, 0, []bool{true, true, false}},
+		{"forgotten key starts full", NewLimiter(10, 10), []uint64{1, 1}, 1, []bool{true, true}},
+		{"burst below rate is raised", NewLimiter(10, 1), []uint64{1, 1}, 0, []bool{true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, key := range tt.takes {
+				if _, ok := tt.limiter.Take(key, 10, 0); ok != tt.ok[i] {
+					t.Errorf("take %d on key %d: ok = %v, want %v", i, key, ok, tt.ok[i])
+				}
+				if tt.forget != 0 {
+					tt.limiter.Forget(tt.forget)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaUse(t *testing.T) {
+	quota := NewQuota(100)
+	steps := []struct {
+		identity string
+		n        int
+		ok       bool
+		used     int64
+	}{
+		{"alice", 60, true, 60},
+		{"alice", 40, true, 100},
+		{"alice", 1, false, 100},
+		{"bob", 100, true, 100},
+		{"bob", 101, false, 100},
+	}
+
+	for i, step := range steps {
+		wait, ok := quota.Use(step.identity, step.n)
+		if ok != step.ok {
+			t.Errorf("step %d: Use(%s, %d) ok = %v, want %v", i, step.identity, step.n, ok, step.ok)
+		}
+		if !ok && (wait <= 0 || wait > 24*time.Hour) {
+			t.Errorf("step %d: wait %v is not until the next day", i, wait)
+		}
+		if used := quota.Used(step.identity); used != step.used {
+			t.Errorf("step %d: %s used %d, want %d", i, step.identity, used, step.used)
+		}
+	}
+
+	var unlimited *Quota
+	if _, ok := unlimited.Use("alice", 1<<30); !ok {
+		t.Error("nil quota refused usage")
+	}
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+var ChunkSize = 64 * 1024
+
+var ErrCorrupted = errors.New("file does not match its content hash")
+
+const manifestIndex = ^uint64(0)
+
+type Manifest struct {
+	Size    int64
+	Chunks  [][]byte
+	Stripes []*Stripe
+}
+
+type Chunk struct {
+	ID   []byte
+	Data []byte
+}
+
+func FileKey(hash []byte) []byte {
+	key := sha256.Sum256(append([]byte("trust file key v1"), hash...))
+	return key[:]
+}
+
+func ManifestID(hash []byte) []byte {
+	id := sha256.Sum256(append([]byte("trust manifest v1"), hash...))
+	return id[:]
+}
+
+func seal(key []byte, index uint64, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce[gcm.NonceSize()-8:], index)
+	return gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func open(key []byte, index uint64, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce[gcm.NonceSize()-8:], index)
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func Split(data []byte) ([]byte, *Manifest, []*Chunk, error) {
+	sum := sha256.Sum256(data)
+	hash := sum[:]
+	key := FileKey(hash)
+
+	manifest := &Manifest{Size: int64(len(data))}
+	chunks := make([]*Chunk, 0, len(data)/ChunkSize+1)
+	for index := uint64(0); len(data) > 0 || index == 0; index++ {
+		part := data[:min(ChunkSize, len(data))]
+		data = data[len(part):]
+
+		sealed, err := seal(key, index, part)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		chunk := &Chunk{ID: ChunkID(sealed), Data: sealed}
+		chunks = append(chunks, chunk)
+		manifest.Chunks = append(manifest.Chunks, chunk.ID)
+	}
+
+	return hash, manifest, chunks, nil
+}
+
+func SealManifest(hash []byte, manifest *Manifest) (*Chunk, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(manifest); err != nil {
+		return nil, err
+	}
+	sealed, err := seal(FileKey(hash), manifestIndex, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &Chunk{ID: ManifestID(hash), Data: sealed}, nil
+}
+
+func OpenManifest(hash []byte, data []byte) (*Manifest, error) {
+	plaintext, err := open(FileKey(hash), manifestIndex, data)
+	if err != nil {
+		return nil, fmt.Errorf("opening manifest: %v", err)
+	}
+
+	manifest := &Manifest{}
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func Join(hash []byte, manifest *Manifest, chunks [][]byte) ([]byte, error) {
+	if len(chunks) != len(manifest.Chunks) {
+		return nil, fmt.Errorf("expected %d chunks, got %d", len(manifest.Chunks), len(chunks))
+	}
+
+	key := FileKey(hash)
+	data := make([]byte, 0, manifest.Size)
+	for index, chunk := range chunks {
+		if !bytes.Equal(ChunkID(chunk), manifest.Chunks[index]) {
+			return nil, ErrBadChunk
+		}
+
+		part, err := open(key, uint64(index), chunk)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, part...)
+	}
+
+	if sum := sha256.Sum256(data); int64(len(data)) != manifest.Size || !bytes.Equal(sum[:], hash) {
+		return nil, ErrCorrupted
+	}
+	return data, nil
+}
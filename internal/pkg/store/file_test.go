@@ -0,0 +1,145 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestSplitJoin(t *testing.T) {
+	defer func(size int) { ChunkSize = size }(ChunkSize)
+	ChunkSize = 16
+
+	tests := []struct {
+		size   int
+		chunks int
+	}{
+		{0, 1},
+		{1, 1},
+		{16, 1},
+		{17, 2},
+		{47, 3},
+	}
+
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte("x"), tt.size)
+		hash, manifest, chunks, err := Split(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sum := sha256.Sum256(data); !bytes.Equal(hash, sum[:]) {
+			t.Errorf("%d bytes: hash %x, want the SHA-256 of the file", tt.size, hash)
+		}
+		if len(chunks) != tt.chunks || len(manifest.Chunks) != tt.chunks || manifest.Size != int64(tt.size) {
+			t.Errorf("%d bytes: %d chunks, manifest of %d chunks and %d bytes, want %d chunks", tt.size, len(chunks), len(manifest.Chunks), manifest.Size, tt.chunks)
+			continue
+		}
+
+		contents := make([][]byte, len(chunks))
+		for i, chunk := range chunks {
+			if !bytes.Equal(chunk.ID, ChunkID(chunk.Data)) || !bytes.Equal(chunk.ID, manifest.Chunks[i]) {
+				t.Errorf("%d bytes: chunk %d ID does not match its content", tt.size, i)
+			}
+			if tt.size > 0 && bytes.Contains(chunk.Data, []byte("xxxxxxxx")) {
+				t.Errorf("%d bytes: chunk %d is not encrypted", tt.size, i)
+			}
+			contents[i] = chunk.Data
+		}
+
+		joined, err := Join(hash, manifest, contents)
+		if err != nil || !bytes.Equal(joined, data) {
+			t.Errorf("%d bytes: Join = %d bytes, %v", tt.size, len(joined), err)
+		}
+	}
+}
+
+func TestSplitIsConvergent(t *testing.T) {
+	data := []byte("the same file uploaded twice")
+	_, first, _, err := Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, _, err := Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Chunks[0], second.Chunks[0]) {
+		t.Error("splitting the same file twice gave different chunks")
+	}
+}
+
+func TestJoinRejectsDamage(t *testing.T) {
+	defer func(size int) { ChunkSize = size }(ChunkSize)
+	ChunkSize = 16
+
+	data := []byte("a file that spans three chunks....")
+	hash, manifest, chunks, err := Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := func() [][]byte {
+		contents := make([][]byte, len(chunks))
+		for i, chunk := range chunks {
+			contents[i] = append([]byte(nil), chunk.Data...)
+		}
+		return contents
+	}
+
+	swapped := contents()
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	tampered := contents()
+	tampered[1][0] ^= 1
+	shrunk := *manifest
+	shrunk.Size--
+
+	tests := []struct {
+		name     string
+		hash     []byte
+		manifest *Manifest
+		chunks   [][]byte
+		err      error
+	}{
+		{"missing chunk", hash, manifest, contents()[1:], nil},
+		{"swapped chunks", hash, manifest, swapped, ErrBadChunk},
+		{"tampered chunk", hash, manifest, tampered, ErrBadChunk},
+		{"wrong size", hash, &shrunk, contents(), ErrCorrupted},
+		{"wrong hash", ChunkID(hash), manifest, contents(), nil},
+	}
+
+	for _, tt := range tests {
+		_, err := Join(tt.hash, tt.manifest, tt.chunks)
+		if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("%s: Join = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSealManifest(t *testing.T) {
+	hash, manifest, _, err := Split([]byte("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := SealManifest(hash, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sealed.ID, ManifestID(hash)) {
+		t.Errorf("manifest ID %x, want %x", sealed.ID, ManifestID(hash))
+	}
+
+	opened, err := OpenManifest(hash, sealed.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Size != manifest.Size || !bytes.Equal(opened.Chunks[0], manifest.Chunks[0]) {
+		t.Errorf("OpenManifest = %+v, want %+v", opened, manifest)
+	}
+
+	// Only someone who knows the file hash can read its manifest.
+	if _, err := OpenManifest(ChunkID(hash), sealed.Data); err == nil {
+		t.Error("opened a manifest without the file hash")
+	}
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/jenyaftw/trust/internal/pkg/capability"
+)
+
+var ErrNotFound = errors.New("chunk not found")
+var ErrBadChunk = errors.New("chunk content does not match its ID")
+var ErrOwned = errors.New("chunk is owned by another client")
+
+type Store struct {
+	dir      string
+	ownersMu sync.Mutex
+}
+
+type Grant struct {
+	Owner string
+	File  []byte
+}
+
+type Ownership struct {
+	Public bool
+	Grants []Grant
+}
+
+type Request struct {
+	ID         []byte
+	Data       []byte
+	Manifest   bool
+	Placed     bool
+	Replica    int
+	Stripe     *Stripe
+	Shard      int
+	Redirect   bool
+	Node       uint64
+	Repair     bool
+	Requester  string
+	Private    bool
+	File       []byte
+	Ownership  *Ownership
+	Capability *capability.Token
+}
+
+type Response struct {
+	ID       []byte
+	Data     []byte
+	Replicas int
+	Nodes    int
+	Stripe   *Stripe
+}
+
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+func ChunkID(data []byte) []byte {
+	id := sha256.Sum256(data)
+	return id[:]
+}
+
+func (s *Store) path(id []byte) string {
+	name := hex.EncodeToString(id)
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+func (s *Store) Put(id []byte, data []byte, manifest bool) error {
+	if len(id) != sha256.Size {
+		return fmt.Errorf("invalid chunk ID length %d", len(id))
+	}
+	if !manifest && !bytes.Equal(ChunkID(data), id) {
+		return ErrBadChunk
+	}
+
+	path := s.path(id)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *Store) Get(id []byte) ([]byte, error) {
+	if len(id) != sha256.Size {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *Store) Has(id []byte) bool {
+	if len(id) != sha256.Size {
+		return false
+	}
+	_, err := os.Stat(s.path(id))
+	return err == nil
+}
+
+func (s *Store) ownerPath(id []byte) string {
+	return filepath.Join(s.dir, "owners", hex.EncodeToString(id))
+}
+
+func (o *Ownership) Owns(owner string) bool {
+	return slices.ContainsFunc(o.Grants, func(g Grant) bool { return g.Owner == owner })
+}
+
+func (o *Ownership) Granted(owner string, file []byte) bool {
+	return slices.ContainsFunc(o.Grants, func(g Grant) bool { return g.Owner == owner && bytes.Equal(g.File, file) })
+}
+
+func (o *Ownership) merge(other *Ownership) {
+	o.Public = o.Public || other.Public
+	for _, grant := range other.Grants {
+		if !o.Granted(grant.Owner, grant.File) {
+			o.Grants = append(o.Grants, grant)
+		}
+	}
+}
+
+func (s *Store) Claim(id []byte, grant Grant, private bool, exclusive bool) error {
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+
+	current, err := s.readOwnership(id)
+	if err != nil {
+		return err
+	}
+	if exclusive && len(current.Grants) > 0 && !current.Owns(grant.Owner) {
+		return ErrOwned
+	}
+
+	current.merge(&Ownership{Public: !private, Grants: []Grant{grant}})
+	return s.writeOwnership(id, current)
+}
+
+func (s *Store) AddOwnership(id []byte, ownership *Ownership) error {
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+
+	current, err := s.readOwnership(id)
+	if err != nil {
+		return err
+	}
+	current.merge(ownership)
+	return s.writeOwnership(id, current)
+}
+
+func (s *Store) Ownership(id []byte) (*Ownership, error) {
+	if len(id) != sha256.Size {
+		return nil, ErrNotFound
+	}
+
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+
+	ownership, err := s.readOwnership(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ownership.Public && len(ownership.Grants) == 0 {
+		return nil, ErrNotFound
+	}
+	return ownership, nil
+}
+
+func (s *Store) readOwnership(id []byte) (*Ownership, error) {
+	ownership := &Ownership{}
+	data, err := os.ReadFile(s.ownerPath(id))
+	if os.IsNotExist(err) {
+		return ownership, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(ownership); err != nil {
+		return nil, fmt.Errorf("error decoding owners of chunk %x: %v", id, err)
+	}
+	return ownership, nil
+}
+
+func (s *Store) writeOwnership(id []byte, ownership *Ownership) error {
+	path := s.ownerPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(ownership); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func Placement(id []byte, nodeCount int, replicas int) []uint64 {
+	if nodeCount <= 0 {
+		return nil
+	}
+	replicas = max(1, min(replicas, nodeCount))
+
+	point := binary.BigEndian.Uint64(id[:8]) % uint64(nodeCount)
+	nodes := make([]uint64, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		nodes = append(nodes, (point+uint64(i))%uint64(nodeCount))
+	}
+	return nodes
+}
+
+func (r *Request) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeRequest(data []byte) (*Request, error) {
+	req := &Request{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(req); err != nil {
+		return nil, fmt.Errorf("error decoding store request: %v", err)
+	}
+	return req, nil
+}
+
+func (r *Response) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeResponse(data []byte) (*Response, error) {
+	resp := &Response{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(resp); err != nil {
+		return nil, fmt.Errorf("error decoding store response: %v", err)
+	}
+	return resp, nil
+}
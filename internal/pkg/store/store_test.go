@@ -0,0 +1,154 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestClaim(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := ChunkID([]byte("chunk"))
+	fileA, fileB := ChunkID([]byte("a")), ChunkID([]byte("b"))
+
+	if _, err := s.Ownership(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Ownership of an unclaimed chunk = %v, want %v", err, ErrNotFound)
+	}
+	if _, err := s.Ownership(id[:8]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Ownership of a short ID = %v, want %v", err, ErrNotFound)
+	}
+
+	steps := []struct {
+		name      string
+		grant     Grant
+		private   bool
+		exclusive bool
+		err       error
+	}{
+		{"first private claim", Grant{"alice", fileA}, true, true, nil},
+		{"exclusive claim by another client", Grant{"bob", fileA}, true, true, ErrOwned},
+		{"owner claims for another file", Grant{"alice", fileB}, true, true, nil},
+		{"repeated grant", Grant{"alice", fileA}, true, true, nil},
+		{"shared claim by another client", Grant{"bob", fileB}, false, false, nil},
+	}
+	for _, step := range steps {
+		if err := s.Claim(id, step.grant, step.private, step.exclusive); !errors.Is(err, step.err) {
+			t.Errorf("%s: Claim = %v, want %v", step.name, err, step.err)
+		}
+	}
+
+	// Ownership is kept on disk, so a reopened store sees the same grants.
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownership, err := s.Ownership(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ownership.Public {
+		t.Error("a public claim did not make the chunk public")
+	}
+	if len(ownership.Grants) != 3 {
+		t.Errorf("%d grants, want 3: %v", len(ownership.Grants), ownership.Grants)
+	}
+
+	tests := []struct {
+		owner   string
+		file    []byte
+		granted bool
+	}{
+		{"alice", fileA, true},
+		{"alice", fileB, true},
+		{"bob", fileB, true},
+		{"bob", fileA, false},
+		{"carol", fileA, false},
+	}
+	for _, tt := range tests {
+		if got := ownership.Granted(tt.owner, tt.file); got != tt.granted {
+			t.Errorf("Granted(%s, %x) = %v, want %v", tt.owner, tt.file[:4], got, tt.granted)
+		}
+	}
+	if ownership.Owns("carol") {
+		t.Error("a client that never claimed the chunk owns it")
+	}
+}
+
+func TestAddOwnership(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := ChunkID([]byte("chunk"))
+	file := ChunkID([]byte("file"))
+	if err := s.Claim(id, Grant{"alice", file}, true, true); err != nil {
+		t.Fatal(err)
+	}
+	// Replicas merge the ownership they are handed with what they already know.
+	if err := s.AddOwnership(id, &Ownership{Grants: []Grant{{"alice", file}, {"bob", file}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ownership, err := s.Ownership(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ownership.Public || len(ownership.Grants) != 2 || !ownership.Granted("bob", file) {
+		t.Errorf("merged ownership = %+v", ownership)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("chunk")
+	id := ChunkID(data)
+	if err := s.Put(id, []byte("other"), false); !errors.Is(err, ErrBadChunk) {
+		t.Errorf("Put with a mismatched ID = %v, want %v", err, ErrBadChunk)
+	}
+	if err := s.Put(id[:8], data, true); err == nil {
+		t.Error("stored a chunk under a short ID")
+	}
+	if _, err := s.Get(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get before Put = %v, want %v", err, ErrNotFound)
+	}
+
+	if err := s.Put(id, data, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(id); err != nil || string(got) != string(data) || !s.Has(id) {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	id := make([]byte, 32)
+	id[7] = 5
+
+	tests := []struct {
+		nodes, replicas int
+		want            []uint64
+	}{
+		{0, 3, nil},
+		{4, 1, []uint64{1}},
+		{4, 0, []uint64{1}},
+		{4, 3, []uint64{1, 2, 3}},
+		{4, 10, []uint64{1, 2, 3, 0}},
+		{1, 3, []uint64{0}},
+	}
+
+	for _, tt := range tests {
+		if got := Placement(id, tt.nodes, tt.replicas); !slices.Equal(got, tt.want) {
+			t.Errorf("Placement(%d nodes, %d replicas) = %v, want %v", tt.nodes, tt.replicas, got, tt.want)
+		}
+	}
+}
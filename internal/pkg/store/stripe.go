@@ -0,0 +1,165 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jenyaftw/trust/internal/pkg/erasure"
+)
+
+const stripeSuffix = ".stripe"
+
+type Stripe struct {
+	K, N    int
+	Size    int
+	Shards  [][]byte
+	Nodes   []uint64
+	Version int
+}
+
+func (s *Stripe) ID() []byte {
+	hash := sha256.New()
+	hash.Write([]byte("trust stripe v1"))
+	binary.Write(hash, binary.BigEndian, int64(s.K))
+	binary.Write(hash, binary.BigEndian, int64(s.N))
+	binary.Write(hash, binary.BigEndian, int64(s.Size))
+	for _, shard := range s.Shards {
+		hash.Write(shard)
+	}
+	return hash.Sum(nil)
+}
+
+func (s *Stripe) Code() (*erasure.Code, error) {
+	if len(s.Shards) != s.N {
+		return nil, fmt.Errorf("stripe lists %d shards, expected %d", len(s.Shards), s.N)
+	}
+	return erasure.New(s.K, s.N)
+}
+
+func (s *Stripe) Index(node uint64) []int {
+	indexes := make([]int, 0)
+	for i, holder := range s.Nodes {
+		if holder == node {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func EncodeStripe(chunk []byte, k, n int) (*Stripe, [][]byte, error) {
+	code, err := erasure.New(k, n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shards := code.Encode(chunk)
+	stripe := &Stripe{K: k, N: n, Size: len(chunk)}
+	for _, shard := range shards {
+		stripe.Shards = append(stripe.Shards, ChunkID(shard))
+	}
+	return stripe, shards, nil
+}
+
+func DecodeStripe(stripe *Stripe, shards [][]byte) ([]byte, error) {
+	code, err := stripe.Code()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, shard := range shards {
+		if shard != nil && !bytes.Equal(ChunkID(shard), stripe.Shards[i]) {
+			shards[i] = nil
+		}
+	}
+	if err := code.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	return code.Join(shards, stripe.Size)
+}
+
+func StripePlacement(stripe *Stripe, nodeCount int) []uint64 {
+	id := stripe.ID()
+	nodes := Placement(id, nodeCount, nodeCount)
+	placement := make([]uint64, stripe.N)
+	for i := range placement {
+		placement[i] = nodes[i%len(nodes)]
+	}
+	return placement
+}
+
+func (s *Store) stripePath(id []byte) string {
+	return filepath.Join(s.dir, "stripes", hex.EncodeToString(id)+stripeSuffix)
+}
+
+func (s *Store) PutStripe(stripe *Stripe) error {
+	path := s.stripePath(stripe.ID())
+	if current, err := readStripe(path); err == nil && current.Version >= stripe.Version {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(stripe); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Store) GetStripe(id []byte) (*Stripe, error) {
+	stripe, err := readStripe(s.stripePath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return stripe, err
+}
+
+func readStripe(path string) (*Stripe, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stripe := &Stripe{}
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(stripe); err != nil {
+		return nil, fmt.Errorf("error decoding stripe %s: %v", path, err)
+	}
+	return stripe, nil
+}
+
+func (s *Store) Stripes() ([]*Stripe, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "stripes"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stripes := make([]*Stripe, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), stripeSuffix) {
+			continue
+		}
+		stripe, err := readStripe(filepath.Join(s.dir, "stripes", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		stripes = append(stripes, stripe)
+	}
+	return stripes, nil
+}
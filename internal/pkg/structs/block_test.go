@@ -0,0 +1,38 @@
+package structs
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBlockHash(t *testing.T) {
+	chain := NewBlockchain()
+	chain.AddBatch([][]byte{[]byte("first")})
+	block := chain.AddBatch([][]byte{[]byte("second"), []byte("third")})
+
+	tests := []struct {
+		name   string
+		change func(b *Block)
+		err    error
+	}{
+		{"unchanged", func(b *Block) {}, nil},
+		{"derived chain root", func(b *Block) { b.ChainRoot = []byte("root") }, nil},
+		{"id", func(b *Block) { b.ID++ }, ErrBadHash},
+		{"timestamp", func(b *Block) { b.Timestamp++ }, ErrBadHash},
+		{"previous hash", func(b *Block) { b.PrevHash = bytes.Clone(b.Hash) }, ErrBadHash},
+		{"merkle root", func(b *Block) { b.MerkleRoot = EntriesRoot(nil) }, ErrBadHash},
+		{"entries", func(b *Block) { b.Entries = [][]byte{[]byte("other")} }, ErrBadRoot},
+	}
+
+	for _, tt := range tests {
+		b := *block
+		tt.change(&b)
+
+		check := NewBlockchain()
+		check.Blocks = chain.Blocks[:2]
+		if err := check.CheckBlock(&b); !errors.Is(err, tt.err) {
+			t.Errorf("%s: CheckBlock error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package structs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+var ErrInvalidProof = errors.New("invalid merkle proof")
+
+type MerkleTree struct {
+	levels [][][]byte
+}
+
+func LeafHash(data []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{0})
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+func NodeHash(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{1})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+func NewMerkleTree() *MerkleTree {
+	return &MerkleTree{levels: [][][]byte{{}}}
+}
+
+func BuildTreeFromBlockchain(bc *Blockchain) *MerkleTree {
+	tree := NewMerkleTree()
+	for _, block := range bc.Blocks {
+		tree.AddBlock(block)
+	}
+	return tree
+}
+
+func (mt *MerkleTree) AddBlock(block *Block) {
+	mt.AppendLeaf(block.CalculateHash())
+}
+
+func (mt *MerkleTree) AppendLeaf(data []byte) int {
+	return mt.AppendLeafHash(LeafHash(data))
+}
+
+func (mt *MerkleTree) AppendLeafHash(hash []byte) int {
+	index := len(mt.levels[0])
+	mt.levels[0] = append(mt.levels[0], hash)
+
+	for level := 0; len(mt.levels[level])%2 == 0; level++ {
+		if level+1 == len(mt.levels) {
+			mt.levels = append(mt.levels, [][]byte{})
+		}
+
+		nodes := mt.levels[level]
+		mt.levels[level+1] = append(mt.levels[level+1], NodeHash(nodes[len(nodes)-2], nodes[len(nodes)-1]))
+	}
+
+	return index
+}
+
+func (mt *MerkleTree) Size() int {
+	return len(mt.levels[0])
+}
+
+func (mt *MerkleTree) LeafHashAt(index int) []byte {
+	return mt.levels[0][index]
+}
+
+func (mt *MerkleTree) Root() []byte {
+	return mt.hashRange(0, mt.Size())
+}
+
+func (mt *MerkleTree) RootAt(size int) ([]byte, error) {
+	if size < 0 || size > mt.Size() {
+		return nil, fmt.Errorf("tree size %d out of range (0..%d)", size, mt.Size())
+	}
+	return mt.hashRange(0, size), nil
+}
+
+func splitPoint(n int) int {
+	return 1 << (bits.Len(uint(n-1)) - 1)
+}
+
+func (mt *MerkleTree) hashRange(start, end int) []byte {
+	n := end - start
+	if n == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+
+	if n&(n-1) == 0 && start%n == 0 {
+		level := bits.TrailingZeros(uint(n))
+		return mt.levels[level][start>>level]
+	}
+
+	k := splitPoint(n)
+	return NodeHash(mt.hashRange(start, start+k), mt.hashRange(start+k, end))
+}
+
+func (mt *MerkleTree) InclusionProof(index, size int) ([][]byte, error) {
+	if size < 1 || size > mt.Size() || index < 0 || index >= size {
+		return nil, fmt.Errorf("leaf %d out of range for tree size %d", index, size)
+	}
+	return mt.inclusionPath(index, 0, size), nil
+}
+
+func (mt *MerkleTree) inclusionPath(index, start, end int) [][]byte {
+	n := end - start
+	if n == 1 {
+		return [][]byte{}
+	}
+
+	k := splitPoint(n)
+	if index < k {
+		return append(mt.inclusionPath(index, start, start+k), mt.hashRange(start+k, end))
+	}
+	return append(mt.inclusionPath(index-k, start+k, end), mt.hashRange(start, start+k))
+}
+
+func (mt *MerkleTree) ConsistencyProof(first, second int) ([][]byte, error) {
+	if first < 0 || first > second || second > mt.Size() {
+		return nil, fmt.Errorf("invalid consistency range %d..%d for tree size %d", first, second, mt.Size())
+	}
+	if first == 0 || first == second {
+		return [][]byte{}, nil
+	}
+	return mt.consistencyPath(first, 0, second, true), nil
+}
+
+func (mt *MerkleTree) consistencyPath(m, start, end int, complete bool) [][]byte {
+	n := end - start
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{mt.hashRange(start, end)}
+	}
+
+	k := splitPoint(n)
+	if m <= k {
+		return append(mt.consistencyPath(m, start, start+k, complete), mt.hashRange(start+k, end))
+	}
+	return append(mt.consistencyPath(m-k, start+k, end, false), mt.hashRange(start, start+k))
+}
+
+func VerifyInclusion(index, size int, leafHash []byte, proof [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return ErrInvalidProof
+	}
+
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(r, root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+func VerifyConsistency(first, second int, firstRoot, secondRoot []byte, proof [][]byte) error {
+	switch {
+	case first < 0 || first > second:
+		return ErrInvalidProof
+	case first == second:
+		if len(proof) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return ErrInvalidProof
+		}
+		return nil
+	case first == 0:
+		if len(proof) != 0 {
+			return ErrInvalidProof
+		}
+		return nil
+	case len(proof) == 0:
+		return ErrInvalidProof
+	}
+
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return ErrInvalidProof
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package structs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Test vectors from the RFC 6962 reference implementation.
+var rfc6962Leaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var rfc6962Roots = []string{
+	"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func decodeHex(t *testing.T, values ...string) [][]byte {
+	t.Helper()
+
+	decoded := make([][]byte, 0, len(values))
+	for _, value := range values {
+		b, err := hex.DecodeString(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, b)
+	}
+	return decoded
+}
+
+func rfc6962Tree(t *testing.T) *MerkleTree {
+	t.Helper()
+
+	tree := NewMerkleTree()
+	for _, leaf := range decodeHex(t, rfc6962Leaves...) {
+		tree.AppendLeaf(leaf)
+	}
+	return tree
+}
+
+func TestMerkleRoots(t *testing.T) {
+	tree := rfc6962Tree(t)
+	roots := decodeHex(t, rfc6962Roots...)
+
+	for size, want := range roots {
+		got, err := tree.RootAt(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("root of size %d = %x, want %x", size, got, want)
+		}
+	}
+
+	if _, err := tree.RootAt(len(roots)); err == nil {
+		t.Error("RootAt past the end: expected an error")
+	}
+}
+
+func TestMerkleInclusion(t *testing.T) {
+	tests := []struct {
+		index, size int
+		proof       []string
+	}{
+		{0, 1, nil},
+		{0, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{5, 8, []string{
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 3, []string{
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		}},
+		{1, 5, []string{
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	}
+
+	tree := rfc6962Tree(t)
+	roots := decodeHex(t, rfc6962Roots...)
+	for _, tt := range tests {
+		want := decodeHex(t, tt.proof...)
+		got, err := tree.InclusionProof(tt.index, tt.size)
+		if err != nil {
+			t.Fatalf("InclusionProof(%d, %d): %v", tt.index, tt.size, err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("InclusionProof(%d, %d) has %d hashes, want %d", tt.index, tt.size, len(got), len(want))
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("InclusionProof(%d, %d)[%d] = %x, want %x", tt.index, tt.size, i, got[i], want[i])
+			}
+		}
+
+		leaf := tree.LeafHashAt(tt.index)
+		if err := VerifyInclusion(tt.index, tt.size, leaf, want, roots[tt.size]); err != nil {
+			t.Errorf("VerifyInclusion(%d, %d): %v", tt.index, tt.size, err)
+		}
+		if err := VerifyInclusion(tt.index, tt.size, LeafHash([]byte("other")), want, roots[tt.size]); !errors.Is(err, ErrInvalidProof) {
+			t.Errorf("VerifyInclusion(%d, %d) of another leaf: error = %v", tt.index, tt.size, err)
+		}
+	}
+}
+
+func TestMerkleConsistency(t *testing.T) {
+	tests := []struct {
+		first, second int
+		proof         []string
+	}{
+		{1, 1, nil},
+		{1, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{6, 8, []string{
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 5, []string{
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	}
+
+	tree := rfc6962Tree(t)
+	roots := decodeHex(t, rfc6962Roots...)
+	for _, tt := range tests {
+		want := decodeHex(t, tt.proof...)
+		got, err := tree.ConsistencyProof(tt.first, tt.second)
+		if err != nil {
+			t.Fatalf("ConsistencyProof(%d, %d): %v", tt.first, tt.second, err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("ConsistencyProof(%d, %d) has %d hashes, want %d", tt.first, tt.second, len(got), len(want))
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("ConsistencyProof(%d, %d)[%d] = %x, want %x", tt.first, tt.second, i, got[i], want[i])
+			}
+		}
+
+		if err := VerifyConsistency(tt.first, tt.second, roots[tt.first], roots[tt.second], want); err != nil {
+			t.Errorf("VerifyConsistency(%d, %d): %v", tt.first, tt.second, err)
+		}
+		if tt.first != tt.second {
+			if err := VerifyConsistency(tt.first, tt.second, roots[tt.first], roots[tt.first], want); !errors.Is(err, ErrInvalidProof) {
+				t.Errorf("VerifyConsistency(%d, %d) against the wrong root: error = %v", tt.first, tt.second, err)
+			}
+		}
+	}
+}
+
+func TestMerkleProofsRoundTrip(t *testing.T) {
+	tree := NewMerkleTree()
+	for i := 0; i < 33; i++ {
+		tree.AppendLeaf([]byte{byte(i)})
+	}
+
+	for size := 1; size <= tree.Size(); size++ {
+		root, _ := tree.RootAt(size)
+		for index := 0; index < size; index++ {
+			proof, err := tree.InclusionProof(index, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyInclusion(index, size, tree.LeafHashAt(index), proof, root); err != nil {
+				t.Errorf("inclusion of %d in %d: %v", index, size, err)
+			}
+		}
+
+		for first := 0; first <= size; first++ {
+			firstRoot, _ := tree.RootAt(first)
+			proof, err := tree.ConsistencyProof(first, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyConsistency(first, size, firstRoot, root, proof); err != nil {
+				t.Errorf("consistency of %d with %d: %v", first, size, err)
+			}
+		}
+	}
+}
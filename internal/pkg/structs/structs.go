@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -130,20 +132,121 @@ func (n *TreeNode) FindNode(id int) *TreeNode {
 type Block struct {
 	ID         int
 	Timestamp  int64
-	MerkleRoot []byte
-	Data       []byte
 	PrevHash   []byte
+	MerkleRoot []byte
+	Hash       []byte
+	Entries    [][]byte
+	ChainRoot  []byte
+}
+
+type BlockRef struct {
+	ID   int
+	Hash []byte
+}
+
+type EntryProof struct {
+	BlockID int
+	Index   int
+	Count   int
+	Path    [][]byte
+}
+
+var (
+	ErrGap     = errors.New("blockchain gap")
+	ErrReorder = errors.New("blockchain reorder")
+	ErrFork    = errors.New("blockchain fork")
+	ErrBadHash = errors.New("blockchain bad hash")
+	ErrBadRoot = errors.New("blockchain bad merkle root")
+)
+
+type ChainError struct {
+	Err      error
+	ID       int
+	Expected int
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("%v: block %d, expected %d", e.Err, e.ID, e.Expected)
+}
+
+func (e *ChainError) Unwrap() error {
+	return e.Err
+}
+
+func NewBlock(prev *Block, entries [][]byte) *Block {
+	block := &Block{
+		Timestamp:  time.Now().Unix(),
+		MerkleRoot: EntriesRoot(entries),
+		Entries:    entries,
+	}
+	if prev != nil {
+		block.ID = prev.ID + 1
+		block.PrevHash = prev.Hash
+	}
+	block.Hash = block.CalculateHash()
+	return block
+}
+
+func EntriesRoot(entries [][]byte) []byte {
+	return buildEntriesTree(entries).Root()
+}
+
+func buildEntriesTree(entries [][]byte) *MerkleTree {
+	tree := NewMerkleTree()
+	for _, entry := range entries {
+		tree.AppendLeaf(entry)
+	}
+	return tree
 }
 
 func (b *Block) CalculateHash() []byte {
 	hash := sha256.New()
-	hash.Write(b.Data)
+	hash.Write([]byte("trust block v2"))
+	binary.Write(hash, binary.BigEndian, int64(b.ID))
+	binary.Write(hash, binary.BigEndian, b.Timestamp)
+	binary.Write(hash, binary.BigEndian, uint32(len(b.PrevHash)))
 	hash.Write(b.PrevHash)
-	hash.Write([]byte(fmt.Sprint(b.ID)))
-	hash.Write([]byte(fmt.Sprint(b.Timestamp)))
+	binary.Write(hash, binary.BigEndian, uint32(len(b.MerkleRoot)))
+	hash.Write(b.MerkleRoot)
+	// Entries are hashed through MerkleRoot. ChainRoot is derived, not hashed:
+	// it is the root over every block hash in the chain, this one included,
+	// and receivers recompute it from their own copy of the chain.
 	return hash.Sum(nil)
 }
 
+func (b *Block) Header() *Block {
+	return &Block{ID: b.ID, Timestamp: b.Timestamp, PrevHash: b.PrevHash, MerkleRoot: b.MerkleRoot, Hash: b.Hash, ChainRoot: b.ChainRoot}
+}
+
+func (b *Block) CheckEntries() error {
+	if !bytes.Equal(b.MerkleRoot, EntriesRoot(b.Entries)) {
+		return &ChainError{Err: ErrBadRoot, ID: b.ID, Expected: b.ID}
+	}
+	return nil
+}
+
+func (b *Block) ProveEntry(index int) (*EntryProof, error) {
+	if index < 0 || index >= len(b.Entries) {
+		return nil, fmt.Errorf("entry %d is not in block %d (%d entries)", index, b.ID, len(b.Entries))
+	}
+
+	path, err := buildEntriesTree(b.Entries).InclusionProof(index, len(b.Entries))
+	if err != nil {
+		return nil, err
+	}
+	return &EntryProof{BlockID: b.ID, Index: index, Count: len(b.Entries), Path: path}, nil
+}
+
+func (b *Block) VerifyEntry(entry []byte, proof *EntryProof) error {
+	if !bytes.Equal(b.Hash, b.CalculateHash()) {
+		return &ChainError{Err: ErrBadHash, ID: b.ID, Expected: b.ID}
+	}
+	if proof.BlockID != b.ID {
+		return fmt.Errorf("entry proof for block %d, got block %d", proof.BlockID, b.ID)
+	}
+	return VerifyInclusion(proof.Index, proof.Count, LeafHash(entry), proof.Path, b.MerkleRoot)
+}
+
 func (b *Block) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -168,18 +271,18 @@ func DecodeBlock(data []byte) (*Block, error) {
 
 type Blockchain struct {
 	Blocks []*Block
+	tree   *MerkleTree
 }
 
 func NewBlockchain() *Blockchain {
+	entries := [][]byte{[]byte("Genesis block")}
 	genesisBlock := &Block{
-		ID:        0,
-		Timestamp: 1111111111,
-		Data:      []byte("Genesis block"),
-		PrevHash:  nil,
+		ID:         0,
+		Timestamp:  1111111111,
+		MerkleRoot: EntriesRoot(entries),
+		Entries:    entries,
 	}
-
-	genesisHash := genesisBlock.CalculateHash()
-	genesisBlock.MerkleRoot = genesisHash
+	genesisBlock.Hash = genesisBlock.CalculateHash()
 
 	blockchain := &Blockchain{
 		Blocks: []*Block{genesisBlock},
@@ -188,131 +291,110 @@ func NewBlockchain() *Blockchain {
 	return blockchain
 }
 
-func (bc *Blockchain) AddBlock(block *Block) *Block {
-	prevBlock := bc.Blocks[len(bc.Blocks)-1]
-	block.PrevHash = prevBlock.MerkleRoot
-	block.ID = prevBlock.ID + 1
-	block.Timestamp = time.Now().Unix()
-
-	bc.Blocks = append(bc.Blocks, block)
-	return block
-}
-
-func (bc *Blockchain) AddBlockFromBytes(data []byte) *Block {
-	prevBlock := bc.Blocks[len(bc.Blocks)-1]
-	newBlock := &Block{
-		ID:        prevBlock.ID + 1,
-		Timestamp: time.Now().Unix(),
-		Data:      data,
-		PrevHash:  prevBlock.MerkleRoot,
+func (bc *Blockchain) Tree() *MerkleTree {
+	if bc.tree == nil || bc.tree.Size() > len(bc.Blocks) {
+		bc.tree = BuildTreeFromBlockchain(bc)
 	}
-
-	bc.Blocks = append(bc.Blocks, newBlock)
-	return newBlock
-}
-
-func (bc *Blockchain) Validate() bool {
-	for i := 1; i < len(bc.Blocks); i++ {
-		currentBlock := bc.Blocks[i]
-		prevBlock := bc.Blocks[i-1]
-
-		if string(currentBlock.PrevHash) != string(prevBlock.MerkleRoot) {
-			return false
-		}
-
-		if string(currentBlock.MerkleRoot) != string(currentBlock.CalculateHash()) {
-			return false
-		}
+	for bc.tree.Size() < len(bc.Blocks) {
+		bc.tree.AddBlock(bc.Blocks[bc.tree.Size()])
 	}
-	return true
-}
-
-type MerkleNode struct {
-	Left    *MerkleNode
-	Right   *MerkleNode
-	Value   []byte
-	Content *Block
+	return bc.tree
 }
 
-type MerkleTree struct {
-	Root *MerkleNode
+func (bc *Blockchain) Last() *Block {
+	return bc.Blocks[len(bc.Blocks)-1]
 }
 
-func BuildTreeFromBlockchain(bc *Blockchain) *MerkleTree {
-	leaves := make([]*MerkleNode, 0)
-	for _, block := range bc.Blocks {
-		leaves = append(leaves, &MerkleNode{Value: block.CalculateHash(), Content: block})
+func (bc *Blockchain) CheckBlock(block *Block) error {
+	if !bytes.Equal(block.Hash, block.CalculateHash()) {
+		return &ChainError{Err: ErrBadHash, ID: block.ID, Expected: block.ID}
 	}
 
-	if len(leaves)%2 != 0 {
-		leaves = append(leaves, leaves[len(leaves)-1])
+	if err := block.CheckEntries(); err != nil {
+		return err
 	}
 
-	return &MerkleTree{
-		Root: BuildTreeRecursively(leaves),
+	prevBlock := bc.Last()
+	expected := prevBlock.ID + 1
+	switch {
+	case block.ID > expected:
+		return &ChainError{Err: ErrGap, ID: block.ID, Expected: expected}
+	case block.ID < expected:
+		if block.ID >= 0 && block.ID < len(bc.Blocks) && bytes.Equal(bc.Blocks[block.ID].Hash, block.Hash) {
+			return &ChainError{Err: ErrReorder, ID: block.ID, Expected: expected}
+		}
+		return &ChainError{Err: ErrFork, ID: block.ID, Expected: expected}
+	case !bytes.Equal(block.PrevHash, prevBlock.Hash):
+		return &ChainError{Err: ErrFork, ID: block.ID, Expected: expected}
 	}
+	return nil
 }
 
-func BuildTreeRecursively(nodes []*MerkleNode) *MerkleNode {
-	if len(nodes)%2 == 1 {
-		nodes = append(nodes, nodes[len(nodes)-1])
+func (bc *Blockchain) AddBlock(block *Block) error {
+	if err := bc.CheckBlock(block); err != nil {
+		return err
 	}
-	half := len(nodes) / 2
 
-	if len(nodes) == 2 {
-		hash := sha256.New()
-		hash.Write(nodes[0].Value)
-		hash.Write(nodes[1].Value)
+	bc.Blocks = append(bc.Blocks, block)
+	return nil
+}
 
-		return &MerkleNode{
-			Left:  nodes[0],
-			Right: nodes[1],
-			Value: hash.Sum(nil),
-		}
+func (bc *Blockchain) Truncate(id int) {
+	if id < 0 || id+1 >= len(bc.Blocks) {
+		return
 	}
+	bc.Blocks = bc.Blocks[:id+1]
+	bc.tree = nil
+}
 
-	left := BuildTreeRecursively(nodes[:half])
-	right := BuildTreeRecursively(nodes[half:])
-
-	hash := sha256.New()
-	hash.Write(left.Value)
-	hash.Write(right.Value)
-
-	return &MerkleNode{
-		Left:  left,
-		Right: right,
-		Value: hash.Sum(nil),
+func (bc *Blockchain) Locator() []BlockRef {
+	locator := make([]BlockRef, 0)
+	step := 1
+	for id := bc.Last().ID; id > 0; id -= step {
+		locator = append(locator, BlockRef{ID: id, Hash: bc.Blocks[id].Hash})
+		if len(locator) > 8 {
+			step *= 2
+		}
 	}
+	return append(locator, BlockRef{ID: 0, Hash: bc.Blocks[0].Hash})
 }
 
-func (mt *MerkleTree) AddBlock(block *Block) {
-	newNode := &MerkleNode{
-		Value:   block.CalculateHash(),
-		Content: block,
+func (bc *Blockchain) FindFork(locator []BlockRef) int {
+	for _, ref := range locator {
+		if ref.ID >= 0 && ref.ID < len(bc.Blocks) && bytes.Equal(bc.Blocks[ref.ID].Hash, ref.Hash) {
+			return ref.ID
+		}
 	}
+	return -1
+}
 
-	if mt.Root == nil {
-		mt.Root = newNode
-		return
-	}
+func (bc *Blockchain) AddBlockFromBytes(data []byte) *Block {
+	return bc.AddBatch([][]byte{data})
+}
 
-	mt.Root = mt.AddNodeRecursively(newNode)
+func (bc *Blockchain) AddBatch(entries [][]byte) *Block {
+	newBlock := NewBlock(bc.Last(), entries)
+	bc.Blocks = append(bc.Blocks, newBlock)
+	return newBlock
 }
 
-func (mt *MerkleTree) AddNodeRecursively(node *MerkleNode) *MerkleNode {
-	if mt.Root == nil {
-		return node
-	}
+func (bc *Blockchain) Validate() error {
+	for i, block := range bc.Blocks {
+		if block.ID != i {
+			return &ChainError{Err: ErrReorder, ID: block.ID, Expected: i}
+		}
 
-	hash := sha256.New()
-	hash.Write(mt.Root.Value)
-	hash.Write(node.Value)
+		if !bytes.Equal(block.Hash, block.CalculateHash()) {
+			return &ChainError{Err: ErrBadHash, ID: block.ID, Expected: i}
+		}
 
-	newNode := &MerkleNode{
-		Left:  mt.Root,
-		Right: node,
-		Value: hash.Sum(nil),
-	}
+		if err := block.CheckEntries(); err != nil {
+			return err
+		}
 
-	return mt.AddNodeRecursively(newNode)
+		if i > 0 && !bytes.Equal(block.PrevHash, bc.Blocks[i-1].Hash) {
+			return &ChainError{Err: ErrFork, ID: block.ID, Expected: i}
+		}
+	}
+	return nil
 }
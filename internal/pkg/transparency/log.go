@@ -0,0 +1,314 @@
+package transparency
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+	"github.com/jenyaftw/trust/internal/pkg/structs"
+)
+
+const (
+	LogFile   = "log.dat"
+	entrySize = 8 + sha256.Size
+
+	headContext = "trust transparency head v1"
+)
+
+var ErrSplitView = errors.New("transparency log presented inconsistent views")
+
+type SignedHead struct {
+	LogID     uint64
+	Size      int
+	Root      []byte
+	Timestamp time.Time
+	Chain     [][]byte
+	Signature []byte
+}
+
+type Receipt struct {
+	Index     int
+	Hash      []byte
+	Timestamp time.Time
+	Proof     [][]byte
+	Head      *SignedHead
+}
+
+type HeadRequest struct {
+	First  int
+	Second int
+}
+
+type HeadResponse struct {
+	Head   *SignedHead
+	First  int
+	Second int
+	Proof  [][]byte
+}
+
+type Log struct {
+	ID uint64
+
+	mu      sync.Mutex
+	file    *os.File
+	tree    *structs.MerkleTree
+	entries []time.Time
+}
+
+func EntryData(timestamp time.Time, hash []byte) []byte {
+	data := binary.BigEndian.AppendUint64(nil, uint64(timestamp.UnixNano()))
+	return append(data, hash...)
+}
+
+func Open(dir string, id uint64) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, LogFile)
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	valid := len(content) / entrySize * entrySize
+	if valid != len(content) {
+		if err := os.Truncate(path, int64(valid)); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &Log{ID: id, tree: structs.NewMerkleTree()}
+	for offset := 0; offset < valid; offset += entrySize {
+		entry := content[offset : offset+entrySize]
+		l.tree.AppendLeaf(entry)
+		l.entries = append(l.entries, time.Unix(0, int64(binary.BigEndian.Uint64(entry))))
+	}
+
+	l.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) Append(hash []byte, chain [][]byte, key gocrypto.PrivateKey) (*Receipt, error) {
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("expected a %d byte SHA-256 hash, got %d bytes", sha256.Size, len(hash))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	timestamp := time.Now().UTC()
+	entry := EntryData(timestamp, hash)
+	if _, err := l.file.Write(entry); err != nil {
+		return nil, err
+	}
+	if err := l.file.Sync(); err != nil {
+		return nil, err
+	}
+
+	index := l.tree.AppendLeaf(entry)
+	l.entries = append(l.entries, timestamp)
+
+	head, err := l.signHead(chain, key)
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := l.tree.InclusionProof(index, head.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Receipt{Index: index, Hash: hash, Timestamp: timestamp, Proof: proof, Head: head}, nil
+}
+
+func (l *Log) Head(first int, second int, chain [][]byte, key gocrypto.PrivateKey) (*HeadResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	head, err := l.signHead(chain, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if second <= 0 || second > head.Size {
+		second = head.Size
+	}
+	if first > second {
+		first = 0
+	}
+
+	proof, err := l.tree.ConsistencyProof(first, second)
+	if err != nil {
+		return nil, err
+	}
+	return &HeadResponse{Head: head, First: first, Second: second, Proof: proof}, nil
+}
+
+func (l *Log) signHead(chain [][]byte, key gocrypto.PrivateKey) (*SignedHead, error) {
+	head := &SignedHead{
+		LogID:     l.ID,
+		Size:      l.tree.Size(),
+		Root:      l.tree.Root(),
+		Timestamp: time.Now().UTC(),
+		Chain:     chain,
+	}
+
+	signature, err := crypto.Sign(key, head.SignedBytes())
+	if err != nil {
+		return nil, err
+	}
+	head.Signature = signature
+	return head, nil
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+func (h *SignedHead) SignedBytes() []byte {
+	buf := append([]byte{}, headContext...)
+	buf = binary.BigEndian.AppendUint64(buf, h.LogID)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Size))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.Timestamp.UnixNano()))
+	return append(buf, h.Root...)
+}
+
+func (h *SignedHead) Verify(roots *x509.CertPool) error {
+	if len(h.Chain) == 0 {
+		return fmt.Errorf("log head has no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(h.Chain[0])
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range h.Chain[1:] {
+		intermediate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		intermediates.AddCert(intermediate)
+	}
+
+	if role := crypto.GetCertificateRole(cert); role != crypto.RoleNode {
+		return fmt.Errorf("log head signed with %s certificate", role)
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   h.Timestamp,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return err
+	}
+
+	if err := cert.VerifyHostname(crypto.NodeServerName(int(h.LogID))); err != nil {
+		return err
+	}
+
+	return crypto.VerifySignature(cert, h.SignedBytes(), h.Signature)
+}
+
+func (r *Receipt) Verify(roots *x509.CertPool) error {
+	if err := r.Head.Verify(roots); err != nil {
+		return err
+	}
+
+	leaf := structs.LeafHash(EntryData(r.Timestamp, r.Hash))
+	return structs.VerifyInclusion(r.Index, r.Head.Size, leaf, r.Proof, r.Head.Root)
+}
+
+func VerifyHeadResponse(previous *SignedHead, resp *HeadResponse, roots *x509.CertPool) error {
+	if err := resp.Head.Verify(roots); err != nil {
+		return err
+	}
+
+	if previous == nil {
+		return nil
+	}
+
+	if previous.LogID != resp.Head.LogID {
+		return fmt.Errorf("log head from log %d, expected %d", resp.Head.LogID, previous.LogID)
+	}
+	if resp.First != previous.Size || resp.Second != resp.Head.Size || resp.Head.Size < previous.Size {
+		return fmt.Errorf("%w: log shrank from %d to %d entries", ErrSplitView, previous.Size, resp.Head.Size)
+	}
+
+	if err := structs.VerifyConsistency(previous.Size, resp.Head.Size, previous.Root, resp.Head.Root, resp.Proof); err != nil {
+		return fmt.Errorf("%w: %v", ErrSplitView, err)
+	}
+	return nil
+}
+
+func CompareHeads(a *SignedHead, b *SignedHead, resp *HeadResponse, roots *x509.CertPool) error {
+	for _, head := range []*SignedHead{a, b} {
+		if err := head.Verify(roots); err != nil {
+			return err
+		}
+	}
+	if a.LogID != b.LogID {
+		return fmt.Errorf("log heads from logs %d and %d", a.LogID, b.LogID)
+	}
+
+	if a.Size > b.Size {
+		a, b = b, a
+	}
+	if a.Size == b.Size {
+		if !bytes.Equal(a.Root, b.Root) {
+			return fmt.Errorf("%w: two roots for %d entries", ErrSplitView, a.Size)
+		}
+		return nil
+	}
+
+	if resp == nil || resp.First != a.Size || resp.Second != b.Size {
+		return fmt.Errorf("%w: log did not prove %d entries consistent with %d", ErrSplitView, a.Size, b.Size)
+	}
+	if err := structs.VerifyConsistency(a.Size, b.Size, a.Root, b.Root, resp.Proof); err != nil {
+		return fmt.Errorf("%w: %v", ErrSplitView, err)
+	}
+	return nil
+}
+
+func Encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func Decode(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func HashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,198 @@
+package transparency
+
+import (
+	gocrypto "crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jenyaftw/trust/internal/pkg/crypto"
+)
+
+type testNode struct {
+	roots *x509.CertPool
+	chain [][]byte
+	key   gocrypto.Signer
+}
+
+func newTestNode(t *testing.T, id int) *testNode {
+	t.Helper()
+
+	rootKey, err := crypto.GenerateKey(crypto.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := crypto.GenerateSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTemplate := crypto.GenerateCACertificate(serial)
+	rootPem, err := crypto.EncodeCertificate(rootTemplate, rootTemplate, rootKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := crypto.DecodeCertificate(rootPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuerKey, err := crypto.GenerateKey(crypto.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial, err = crypto.GenerateSerialNumber(); err != nil {
+		t.Fatal(err)
+	}
+	issuerPem, err := crypto.EncodeCertificate(crypto.GenerateIntermediateCertificate(serial), root, issuerKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := crypto.NewIssuer(issuerPem, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := crypto.NewCertPool(rootPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &testNode{roots: roots}
+	node.key, err = crypto.GenerateKey(crypto.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem, err := issuer.Issue(crypto.GenerateNodeCertificate(nil, id), node.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for block, rest := pem.Decode(certPem); block != nil; block, rest = pem.Decode(rest) {
+		node.chain = append(node.chain, block.Bytes)
+	}
+	return node
+}
+
+func (n *testNode) openLog(t *testing.T, entries ...string) *Log {
+	t.Helper()
+
+	l, err := Open(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	n.append(t, l, entries...)
+	return l
+}
+
+func (n *testNode) append(t *testing.T, l *Log, entries ...string) {
+	t.Helper()
+
+	for _, entry := range entries {
+		hash := sha256.Sum256([]byte(entry))
+		if _, err := l.Append(hash[:], n.chain, n.key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (n *testNode) head(t *testing.T, l *Log) *SignedHead {
+	t.Helper()
+
+	resp, err := l.Head(0, 0, n.chain, n.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Head
+}
+
+func entries(prefix string, count int) []string {
+	list := make([]string, count)
+	for i := range list {
+		list[i] = fmt.Sprintf("%s %d", prefix, i)
+	}
+	return list
+}
+
+func TestCompareHeads(t *testing.T) {
+	node := newTestNode(t, 1)
+
+	honest := node.openLog(t, entries("entry", 3)...)
+	early := node.head(t, honest)
+	node.append(t, honest, entries("later", 4)...)
+	late := node.head(t, honest)
+
+	// A fork that shares the first entries but shows other clients a
+	// different history from then on.
+	forked := node.openLog(t, entries("entry", 3)...)
+	node.append(t, forked, entries("other", 4)...)
+	forkHead := node.head(t, forked)
+
+	// A fork that rewrote history and is longer than the honest log.
+	rewritten := node.openLog(t, entries("rewritten", 9)...)
+	rewrittenHead := node.head(t, rewritten)
+
+	proof := func(l *Log, first, second int) *HeadResponse {
+		resp, err := l.Head(first, second, node.chain, node.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name string
+		a, b *SignedHead
+		resp *HeadResponse
+		err  error
+	}{
+		{"same head", late, late, nil, nil},
+		{"older and newer", early, late, proof(honest, early.Size, late.Size), nil},
+		{"newer and older", late, early, proof(honest, early.Size, late.Size), nil},
+		{"same size, other root", late, forkHead, nil, ErrSplitView},
+		{"fork sharing a prefix", early, forkHead, proof(honest, early.Size, forkHead.Size), ErrSplitView},
+		{"rewritten history proved by the fork", late, rewrittenHead, proof(rewritten, late.Size, rewrittenHead.Size), ErrSplitView},
+		{"proof for other sizes", early, late, proof(honest, 1, late.Size), ErrSplitView},
+		{"log shorter than a head it signed", late, rewrittenHead, proof(honest, late.Size, rewrittenHead.Size), ErrSplitView},
+		{"no proof", early, late, nil, ErrSplitView},
+	}
+
+	for _, tt := range tests {
+		if err := CompareHeads(tt.a, tt.b, tt.resp, node.roots); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	other := newTestNode(t, 1)
+	if err := CompareHeads(early, late, proof(honest, early.Size, late.Size), other.roots); err == nil || errors.Is(err, ErrSplitView) {
+		t.Errorf("heads signed under another CA: error = %v", err)
+	}
+}
+
+func TestVerifyHeadResponse(t *testing.T) {
+	node := newTestNode(t, 1)
+	l := node.openLog(t, entries("entry", 5)...)
+	previous := node.head(t, l)
+	node.append(t, l, entries("later", 3)...)
+
+	tests := []struct {
+		name          string
+		first, second int
+		err           error
+	}{
+		{"from the previous head", previous.Size, 0, nil},
+		{"from another size", 2, 0, ErrSplitView},
+		{"up to an older size", previous.Size, previous.Size + 1, ErrSplitView},
+	}
+
+	for _, tt := range tests {
+		resp, err := l.Head(tt.first, tt.second, node.chain, node.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyHeadResponse(previous, resp, node.roots); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}